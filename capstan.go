@@ -9,8 +9,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	goruntime "runtime"
 
 	"github.com/cloudius-systems/capstan/cmd"
 	"github.com/cloudius-systems/capstan/core"
@@ -286,6 +289,29 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "build-all",
+			Usage: "builds all images listed in the project file",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "file", Aliases: []string{"f"}, Value: core.ProjectFileName, Usage: "path to the project file"},
+				&cli.IntFlag{Name: "jobs", Aliases: []string{"j"}, Value: goruntime.NumCPU(), Usage: "maximum number of images composed concurrently"},
+				&cli.BoolFlag{Name: "update", Usage: "updates the existing images by uploading only modified files"},
+				&cli.BoolFlag{Name: "verbose", Aliases: []string{"v"}, Usage: "verbose mode"},
+				&cli.BoolFlag{Name: "pull-missing", Aliases: []string{"p"}, Usage: "attempt to pull packages missing from a local repository"},
+			},
+			Action: func(c *cli.Context) error {
+				if c.Args().Len() != 0 {
+					return cli.NewExitError("Usage: capstan build-all [--file capstan.yaml]", EX_USAGE)
+				}
+
+				repo := util.NewRepoFromCli(c)
+
+				if err := cmd.BuildAll(repo, c.String("file"), c.Int("jobs"), c.Bool("update"), c.Bool("verbose"), c.Bool("pull-missing")); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
 		{
 			Name:    "images",
 			Aliases: []string{"i"},
@@ -297,6 +323,168 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "image",
+			Usage: "image inspection tools",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "ls",
+					Usage:     "lists files of the ROFS filesystem in the image",
+					ArgsUsage: "[image-name|image-file] [path]",
+					Action: func(c *cli.Context) error {
+						if c.Args().Len() < 1 || c.Args().Len() > 2 {
+							return cli.NewExitError("usage: capstan image ls [image-name|image-file] [path]", EX_USAGE)
+						}
+
+						dirPath := "/"
+						if c.Args().Len() == 2 {
+							dirPath = c.Args().Get(1)
+						}
+
+						repo := util.NewRepoFromCli(c)
+						if err := cmd.ImageLs(repo, c.Args().First(), dirPath, os.Stdout); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+
+						return nil
+					},
+				},
+				{
+					Name:      "cat",
+					Usage:     "prints content of a file of the ROFS filesystem in the image",
+					ArgsUsage: "[image-name|image-file] [path]",
+					Action: func(c *cli.Context) error {
+						if c.Args().Len() != 2 {
+							return cli.NewExitError("usage: capstan image cat [image-name|image-file] [path]", EX_USAGE)
+						}
+
+						repo := util.NewRepoFromCli(c)
+						if err := cmd.ImageCat(repo, c.Args().First(), c.Args().Get(1), os.Stdout); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+
+						return nil
+					},
+				},
+				{
+					Name:      "extract",
+					Usage:     "extracts a file or a directory of the ROFS filesystem in the image",
+					ArgsUsage: "[image-name|image-file] [path]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Value: ".", Usage: "directory to extract the files into"},
+					},
+					Action: func(c *cli.Context) error {
+						if c.Args().Len() < 1 || c.Args().Len() > 2 {
+							return cli.NewExitError("usage: capstan image extract [image-name|image-file] [path]", EX_USAGE)
+						}
+
+						filePath := "/"
+						if c.Args().Len() == 2 {
+							filePath = c.Args().Get(1)
+						}
+
+						repo := util.NewRepoFromCli(c)
+						if err := cmd.ImageExtract(repo, c.Args().First(), filePath, c.String("output")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+
+						return nil
+					},
+				},
+				{
+					Name:  "cmdline",
+					Usage: "manages the boot command line of the image",
+					Subcommands: []*cli.Command{
+						{
+							Name:      "get",
+							Usage:     "prints the boot command line of the image",
+							ArgsUsage: "[image-name|image-file]",
+							Action: func(c *cli.Context) error {
+								if c.Args().Len() != 1 {
+									return cli.NewExitError("usage: capstan image cmdline get [image-name|image-file]", EX_USAGE)
+								}
+
+								repo := util.NewRepoFromCli(c)
+								cmdLine, err := cmd.ImageGetCmdLine(repo, c.Args().First())
+								if err != nil {
+									return cli.NewExitError(err.Error(), EX_DATAERR)
+								}
+								fmt.Println(cmdLine)
+
+								return nil
+							},
+						},
+						{
+							Name:      "set",
+							Usage:     "sets the boot command line of the image",
+							ArgsUsage: "[image-name|image-file] [command-line]",
+							Flags: []cli.Flag{
+								&cli.StringSliceFlag{Name: "boot", Usage: "specify config_set name to boot unikernel with (repeatable, will be run left to right)"},
+								&cli.StringSliceFlag{Name: "env", Value: new(cli.StringSlice), Usage: "specify value of environment variable e.g. PORT=8000 (repeatable)"},
+							},
+							Action: func(c *cli.Context) error {
+								if c.Args().Len() < 1 || c.Args().Len() > 2 {
+									return cli.NewExitError("usage: capstan image cmdline set [image-name|image-file] [command-line]", EX_USAGE)
+								}
+
+								bootOpts := cmd.BootOptions{
+									Cmd:     c.Args().Get(1),
+									Boot:    c.StringSlice("boot"),
+									EnvList: c.StringSlice("env"),
+								}
+
+								repo := util.NewRepoFromCli(c)
+								cmdLine, err := cmd.ImageSetCmdLine(repo, c.Args().First(), &bootOpts)
+								if err != nil {
+									return cli.NewExitError(err.Error(), EX_DATAERR)
+								}
+								fmt.Printf("Command line set to: %s\n", cmdLine)
+
+								return nil
+							},
+						},
+					},
+				},
+				{
+					Name:      "inspect",
+					Usage:     "describes the image: format, sizes, partitions, boot command line and metadata",
+					ArgsUsage: "[image-name|image-file]",
+					Action: func(c *cli.Context) error {
+						if c.Args().Len() != 1 {
+							return cli.NewExitError("usage: capstan image inspect [image-name|image-file]", EX_USAGE)
+						}
+
+						repo := util.NewRepoFromCli(c)
+						description, err := cmd.ImageInspect(repo, c.Args().First())
+						if err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						fmt.Print(description)
+
+						return nil
+					},
+				},
+				{
+					Name:      "size",
+					Usage:     "prints the size of the image content per package along with the largest files and directories",
+					ArgsUsage: "[image-name|dir]",
+					Action: func(c *cli.Context) error {
+						if c.Args().Len() != 1 {
+							return cli.NewExitError("usage: capstan image size [image-name|dir]", EX_USAGE)
+						}
+
+						repo := util.NewRepoFromCli(c)
+						report, err := cmd.ImageSizeReport(repo, c.Args().First())
+						if err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						fmt.Print(report)
+
+						return nil
+					},
+				},
+			},
+		},
 		{
 			Name:  "search",
 			Usage: "search a remote images",
@@ -441,7 +629,7 @@ func main() {
 					Usage:     "composes the package and all its dependencies into OSv image",
 					ArgsUsage: "[image-name]",
 					Flags: []cli.Flag{
-						&cli.StringFlag{Name: "size", Aliases: []string{"s"}, Value: "10G", Usage: "total size of the target image (use M or G suffix)"},
+						&cli.StringFlag{Name: "size", Aliases: []string{"s"}, Value: "10G", Usage: "total size of the target image (use M or G suffix) or auto[+headroom] to compute it from the package content"},
 						&cli.BoolFlag{Name: "update", Usage: "updates the existing target VM by uploading only modified files"},
 						&cli.BoolFlag{Name: "verbose", Aliases: []string{"v"}, Usage: "verbose mode"},
 						&cli.StringFlag{Name: "run", Usage: "the command line to be executed in the VM"},
@@ -450,13 +638,25 @@ func main() {
 						&cli.StringSliceFlag{Name: "env", Value: new(cli.StringSlice), Usage: "specify value of environment variable e.g. PORT=8000 (repeatable)"},
 						&cli.StringFlag{Name: "fs", Usage: "specify type of filesystem: zfs or rofs"},
 						&cli.StringSliceFlag{Name: "require", Usage: "specify extra package dependency"},
+						&cli.StringSliceFlag{Name: "exclude", Usage: "exclude files of the required packages matching the pattern (repeatable, see .capstanignore)"},
 						&cli.StringFlag{Name: "loader_image", Aliases: []string{"l"}, Value: "osv-loader", Usage: "the base loader image"},
+						&cli.StringFlag{Name: "format", Value: "qcow2", Usage: "comma-separated image formats to produce: qcow2, raw, vmdk, vdi, gce-tarball"},
+						&cli.StringFlag{Name: "base", Usage: "compose the image as an overlay of the given base image (see compose-base)"},
+						&cli.StringFlag{Name: "collect-dir", Usage: "collect the package content into this directory and keep it (default: a temporary directory)"},
+						&cli.StringFlag{Name: "values", Usage: "YAML file with values of package templates (overridden by --env)"},
+						&cli.BoolFlag{Name: "dry-run", Usage: "print what would be composed without composing the image"},
+						&cli.BoolFlag{Name: "json", Usage: "print the --dry-run plan as JSON"},
 					},
 					Action: func(c *cli.Context) error {
 						if c.Args().Len() != 1 {
 							return cli.NewExitError("Usage: capstan package compose [image-name]", EX_USAGE)
 						}
 
+						formats, err := cmd.ParseComposeFormats(c.String("format"))
+						if err != nil {
+							return cli.NewExitError(err.Error(), EX_USAGE)
+						}
+
 						// Use the provided repository.
 						repo := util.NewRepoFromCli(c)
 
@@ -464,7 +664,7 @@ func main() {
 						appName := c.Args().First()
 
 						// Parse image size descriptor.
-						imageSize, err := util.ParseMemSize(c.String("size"))
+						imageSize, err := cmd.ParseImageSize(c.String("size"))
 						if err != nil {
 							return cli.NewExitError(fmt.Sprintf("Incorrect image size format: %s\n", err), EX_USAGE)
 						}
@@ -490,14 +690,81 @@ func main() {
 							filesystem = "zfs"
 						}
 
-						if err := cmd.ComposePackage(repo, c.StringSlice("require"), imageSize, updatePackage, verbose, pullMissing,
-							packageDir, appName, &bootOpts, filesystem, loaderImage); err != nil {
+						values, err := cmd.TemplateValues(c.String("values"), c.StringSlice("env"))
+						if err != nil {
+							return cli.NewExitError(err.Error(), EX_USAGE)
+						}
+
+						if c.Bool("json") && !c.Bool("dry-run") {
+							return cli.NewExitError("--json can only be used with --dry-run", EX_USAGE)
+						}
+
+						if c.Bool("dry-run") {
+							// Progress messages must not be mixed with the JSON plan.
+							var progress io.Writer = os.Stdout
+							if c.Bool("json") {
+								progress = os.Stderr
+							}
+							plan, err := cmd.PlanCompose(repo, c.StringSlice("require"), c.StringSlice("exclude"), updatePackage, verbose, packageDir,
+								appName, &bootOpts, filesystem, loaderImage, c.String("base"), values, progress)
+							if err != nil {
+								return cli.NewExitError(err.Error(), EX_DATAERR)
+							}
+
+							if c.Bool("json") {
+								data, err := json.MarshalIndent(plan, "", "  ")
+								if err != nil {
+									return cli.NewExitError(err.Error(), EX_DATAERR)
+								}
+								fmt.Println(string(data))
+							} else {
+								fmt.Print(plan)
+							}
+							return nil
+						}
+
+						if err := cmd.ComposePackage(repo, c.StringSlice("require"), c.StringSlice("exclude"), imageSize, updatePackage, verbose, pullMissing,
+							packageDir, appName, &bootOpts, filesystem, loaderImage, c.String("base"), c.String("collect-dir"), values); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+
+						if err := cmd.ExportComposedImage(repo, appName, formats); err != nil {
 							return cli.NewExitError(err.Error(), EX_DATAERR)
 						}
 
 						return nil
 					},
 				},
+				{
+					Name:      "compose-base",
+					Usage:     "composes the required packages into a base image shared by application images",
+					ArgsUsage: "[base-name]",
+					Flags: []cli.Flag{
+						&cli.StringSliceFlag{Name: "require", Usage: "specify package to include in the base image (repeatable)"},
+						&cli.StringFlag{Name: "size", Aliases: []string{"s"}, Value: "10G", Usage: "total size of the base image (use M or G suffix) or auto[+headroom] to compute it from the package content"},
+						&cli.StringFlag{Name: "loader_image", Aliases: []string{"l"}, Value: "osv-loader", Usage: "the base loader image"},
+						&cli.BoolFlag{Name: "verbose", Aliases: []string{"v"}, Usage: "verbose mode"},
+						&cli.BoolFlag{Name: "pull-missing", Aliases: []string{"p"}, Usage: "attempt to pull packages missing from a local repository"},
+					},
+					Action: func(c *cli.Context) error {
+						if c.Args().Len() != 1 {
+							return cli.NewExitError("Usage: capstan package compose-base [base-name]", EX_USAGE)
+						}
+
+						imageSize, err := cmd.ParseImageSize(c.String("size"))
+						if err != nil {
+							return cli.NewExitError(fmt.Sprintf("Incorrect image size format: %s\n", err), EX_USAGE)
+						}
+
+						repo := util.NewRepoFromCli(c)
+
+						if err := cmd.ComposeBaseImage(repo, c.Args().First(), c.StringSlice("require"), imageSize,
+							c.Bool("verbose"), c.Bool("pull-missing"), c.String("loader_image")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
 				{
 					Name:      "compose-remote",
 					Usage:     "composes the package and all its dependencies and uploads resulting files into remote OSv instance",
@@ -506,6 +773,9 @@ func main() {
 						&cli.BoolFlag{Name: "verbose", Aliases: []string{"v"}, Usage: "verbose mode"},
 						&cli.BoolFlag{Name: "pull-missing", Aliases: []string{"p"}, Usage: "attempt to pull packages missing from a local repository"},
 						&cli.StringSliceFlag{Name: "require", Usage: "specify extra package dependency"},
+						&cli.StringSliceFlag{Name: "exclude", Usage: "exclude files of the required packages matching the pattern (repeatable, see .capstanignore)"},
+						&cli.StringSliceFlag{Name: "env", Usage: "specify value of package template variable e.g. PORT=8000 (repeatable)"},
+						&cli.StringFlag{Name: "values", Usage: "YAML file with values of package templates (overridden by --env)"},
 					},
 					Action: func(c *cli.Context) error {
 						if c.Args().Len() != 1 {
@@ -524,7 +794,12 @@ func main() {
 						// Always use the current directory for the package to compose.
 						packageDir, _ := os.Getwd()
 
-						if err := cmd.ComposePackageAndUploadToRemoteInstance(repo, c.StringSlice("require"), verbose, pullMissing,
+						values, err := cmd.TemplateValues(c.String("values"), c.StringSlice("env"))
+						if err != nil {
+							return cli.NewExitError(err.Error(), EX_USAGE)
+						}
+
+						if err := cmd.ComposePackageAndUploadToRemoteInstance(repo, c.StringSlice("require"), c.StringSlice("exclude"), values, verbose, pullMissing,
 							packageDir, remoteHostInstance); err != nil {
 							return cli.NewExitError(err.Error(), EX_DATAERR)
 						}
@@ -540,6 +815,10 @@ func main() {
 						&cli.BoolFlag{Name: "verbose", Aliases: []string{"v"}, Usage: "verbose mode"},
 						&cli.BoolFlag{Name: "remote", Usage: "set when previewing the compose-remote"},
 						&cli.StringSliceFlag{Name: "require", Usage: "specify extra package dependency"},
+						&cli.StringSliceFlag{Name: "exclude", Usage: "exclude files of the required packages matching the pattern (repeatable, see .capstanignore)"},
+						&cli.StringFlag{Name: "collect-dir", Usage: "collect into this directory, e.g. mpm-pkg (default: a new temporary directory)"},
+						&cli.StringSliceFlag{Name: "env", Usage: "specify value of package template variable e.g. PORT=8000 (repeatable)"},
+						&cli.StringFlag{Name: "values", Usage: "YAML file with values of package templates (overridden by --env)"},
 					},
 					Action: func(c *cli.Context) error {
 						repo := util.NewRepoFromCli(c)
@@ -547,9 +826,16 @@ func main() {
 
 						pullMissing := c.Bool("pull-missing")
 
-						if err := cmd.CollectPackage(repo, packageDir, c.StringSlice("require"), pullMissing, c.Bool("remote"), c.Bool("verbose")); err != nil {
+						values, err := cmd.TemplateValues(c.String("values"), c.StringSlice("env"))
+						if err != nil {
+							return cli.NewExitError(err.Error(), EX_USAGE)
+						}
+
+						targetPath, err := cmd.CollectPackage(repo, packageDir, c.String("collect-dir"), c.StringSlice("require"), c.StringSlice("exclude"), values, pullMissing, c.Bool("remote"), c.Bool("verbose"))
+						if err != nil {
 							return cli.NewExitError(err.Error(), EX_DATAERR)
 						}
+						fmt.Printf("Package content collected into %s\n", targetPath)
 
 						return nil
 					},
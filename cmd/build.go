@@ -20,7 +20,6 @@ import (
 	"github.com/cloudius-systems/capstan/util"
 	"io"
 	"io/ioutil"
-	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -90,12 +89,16 @@ func UploadRPM(r *util.Repo, hypervisor string, image string, template *core.Tem
 	if err != nil {
 		return err
 	}
+	cpiodRule, err := newCpiodRule()
+	if err != nil {
+		return err
+	}
 	vmconfig := &qemu.VMConfig{
 		Image:       file,
 		Verbose:     verbose,
 		Memory:      size,
 		Networking:  "nat",
-		NatRules:    []nat.Rule{nat.Rule{GuestPort: "10000", HostPort: "10000"}},
+		NatRules:    []nat.Rule{cpiodRule},
 		BackingFile: false,
 		AioType:     r.QemuAioType,
 	}
@@ -105,7 +108,7 @@ func UploadRPM(r *util.Repo, hypervisor string, image string, template *core.Tem
 	}
 	defer vm.Process.Kill()
 
-	conn, err := util.ConnectAndWait("tcp", "localhost:10000")
+	conn, err := util.ConnectAndWait("tcp", "localhost:"+cpiodRule.HostPort)
 	if err != nil {
 		return err
 	}
@@ -130,15 +133,27 @@ func IsReg(m os.FileMode) bool {
 	return (m & nonreg) == 0
 }
 
-func CopyFile(conn net.Conn, src string, dst string) error {
+// CopyFile writes the file, directory or symbolic link at src into the cpio
+// stream under the dst path, preserving its permissions and modification time.
+// Hard links of regular files share the inode in the stream.
+func CopyFile(w *cpio.Writer, src string, dst string) error {
 	fi, err := os.Lstat(src)
 	if err != nil {
 		return err
 	}
 
+	header := &cpio.Header{
+		Name:  dst,
+		Mode:  cpioPermissions(fi.Mode()),
+		Mtime: fi.ModTime().Unix(),
+	}
+
 	switch {
 	case fi.Mode()&os.ModeSymlink == os.ModeSymlink:
-		linkTarget, _ := os.Readlink(src)
+		linkTarget, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
 
 		if strings.HasPrefix(linkTarget, "/") || strings.HasPrefix(linkTarget, "..") {
 			srcDir := filepath.Dir(src)
@@ -150,40 +165,48 @@ func CopyFile(conn net.Conn, src string, dst string) error {
 			linkTarget = strings.TrimPrefix(linkTarget, strings.TrimSuffix(src, dst))
 		}
 
-		perm := uint64(fi.Mode()) & 0777
-		cpio.WritePadded(conn, cpio.ToWireFormat(dst, cpio.C_ISLNK|perm, int64(len(linkTarget))))
-		cpio.WritePadded(conn, []byte(linkTarget))
-
-		return nil
+		header.Mode |= cpio.C_ISLNK
+		header.Size = int64(len(linkTarget))
+		return w.WriteEntry(header, strings.NewReader(linkTarget))
 
 	case fi.Mode().IsDir():
-		fi, err := os.Stat(src)
-		if err != nil {
-			return err
-		}
-		perm := uint64(fi.Mode()) & 0777
-		cpio.WritePadded(conn, cpio.ToWireFormat(dst, cpio.C_ISDIR|perm, 0))
-		return nil
+		header.Mode |= cpio.C_ISDIR
+		return w.WriteEntry(header, nil)
 
 	case fi.Mode().IsRegular():
-		contents, err := ioutil.ReadFile(src)
-		if err != nil {
-			return nil
-		}
-		fi, err := os.Stat(src)
+		f, err := os.Open(src)
 		if err != nil {
 			return err
 		}
-		perm := uint64(fi.Mode()) & 0777
-		cpio.WritePadded(conn, cpio.ToWireFormat(dst, cpio.C_ISREG|perm, fi.Size()))
-		cpio.WritePadded(conn, contents)
+		defer f.Close()
+
+		header.Mode |= cpio.C_ISREG
+		header.Size = fi.Size()
+		if key, nlink := util.HardLinkIdentity(fi); key != nil && nlink > 1 {
+			header.Nlink = nlink
+			return w.WriteHardLink(header, key, f)
+		}
+		return w.WriteEntry(header, f)
 
 	default:
 		fmt.Println("skipping non-file path " + src)
 		return nil
 	}
+}
 
-	return nil
+// cpioPermissions converts permission bits of the file mode to the cpio mode.
+func cpioPermissions(mode os.FileMode) uint64 {
+	perm := uint64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perm |= cpio.C_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= cpio.C_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= cpio.C_ISVTX
+	}
+	return perm
 }
 
 func UploadFiles(r *util.Repo, hypervisor string, image string, t *core.Template, verbose bool, mem string) error {
@@ -192,12 +215,16 @@ func UploadFiles(r *util.Repo, hypervisor string, image string, t *core.Template
 	if err != nil {
 		return err
 	}
+	cpiodRule, err := newCpiodRule()
+	if err != nil {
+		return err
+	}
 	vmconfig := &qemu.VMConfig{
 		Image:       file,
 		Verbose:     verbose,
 		Memory:      size,
 		Networking:  "nat",
-		NatRules:    []nat.Rule{nat.Rule{GuestPort: "10000", HostPort: "10000"}},
+		NatRules:    []nat.Rule{cpiodRule},
 		BackingFile: false,
 		DisableKvm:  r.DisableKvm,
 		AioType:     r.QemuAioType,
@@ -239,7 +266,7 @@ func UploadFiles(r *util.Repo, hypervisor string, image string, t *core.Template
 		go io.Copy(ioutil.Discard, stderr)
 	}
 
-	conn, err := util.ConnectAndWait("tcp", "localhost:10000")
+	conn, err := util.ConnectAndWait("tcp", "localhost:"+cpiodRule.HostPort)
 	if err != nil {
 		return err
 	}
@@ -257,6 +284,8 @@ func UploadFiles(r *util.Repo, hypervisor string, image string, t *core.Template
 
 	fmt.Println("Uploading files...")
 
+	writer := cpio.NewWriter(conn)
+
 	bar := pb.New(len(rootfsFiles) + len(t.Files))
 
 	if !verbose {
@@ -264,7 +293,7 @@ func UploadFiles(r *util.Repo, hypervisor string, image string, t *core.Template
 	}
 
 	for dst, src := range rootfsFiles {
-		err = CopyFile(conn, src, dst)
+		err = CopyFile(writer, src, dst)
 		if verbose {
 			fmt.Println(src + "  --> " + dst)
 		} else {
@@ -276,7 +305,7 @@ func UploadFiles(r *util.Repo, hypervisor string, image string, t *core.Template
 	}
 
 	for dst, src := range t.Files {
-		err = CopyFile(conn, src, dst)
+		err = CopyFile(writer, src, dst)
 		if verbose {
 			fmt.Println(src + "  --> " + dst)
 		} else {
@@ -287,30 +316,14 @@ func UploadFiles(r *util.Repo, hypervisor string, image string, t *core.Template
 		}
 	}
 
-	cpio.WritePadded(conn, cpio.ToWireFormat("TRAILER!!!", 0, 0))
+	if err := writer.Close(); err != nil {
+		return err
+	}
 
 	conn.Close()
 	return cmd.Wait()
 }
 
 func SetArgs(r *util.Repo, hypervisor, image string, args string) error {
-	file := r.ImagePath(hypervisor, image)
-	nbdFile, err := util.NewNbdFile(file)
-	if err != nil {
-		return err
-	}
-
-	padding := 512 - (len(args) % 512)
-
-	data := append([]byte(args), make([]byte, padding)...)
-	if err := nbdFile.Write(512, data); err != nil {
-		return err
-	}
-
-	// Close the image file.
-	if err := nbdFile.Close(); err != nil {
-		return err
-	}
-
-	return nil
+	return util.SetCmdLine(r.ImagePath(hypervisor, image), args)
 }
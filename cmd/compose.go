@@ -10,6 +10,7 @@ package cmd
 import (
 	"bufio"
 	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"github.com/cheggaaa/pb/v3"
 	"github.com/cloudius-systems/capstan/core"
@@ -23,7 +24,11 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 func Compose(r *util.Repo, loaderImage string, imageSize int64, filesystem string, uploadPath string, appName string, commandLine string, verbose bool) error {
@@ -50,7 +55,7 @@ func Compose(r *util.Repo, loaderImage string, imageSize int64, filesystem strin
 		}
 
 		// Upload the specified path onto virtual image.
-		if _, err = UploadPackageContents(r, imagePath, paths, nil, verbose, zfsBuilderPath); err != nil {
+		if _, err = UploadPackageContents(r, imagePath, paths, nil, nil, verbose, zfsBuilderPath); err != nil {
 			return err
 		}
 	} else {
@@ -61,7 +66,7 @@ func Compose(r *util.Repo, loaderImage string, imageSize int64, filesystem strin
 		defer os.RemoveAll(tmp)
 		rofs_image_path := path.Join(tmp, "rofs.img")
 
-		if err := util.WriteRofsImage(rofs_image_path, paths, uploadPath, verbose); err != nil {
+		if err := util.WriteRofsImage(rofs_image_path, paths, verbose); err != nil {
 			return fmt.Errorf("Failed to write ROFS image named %s.\nError was: %s", rofs_image_path, err)
 		}
 
@@ -81,7 +86,40 @@ func Compose(r *util.Repo, loaderImage string, imageSize int64, filesystem strin
 	return nil
 }
 
-func UploadPackageContents(r *util.Repo, appImage string, uploadPaths map[string]string, imageCache core.HashCache, verbose bool, zfsBuilderPath string) (core.HashCache, error) {
+// cpiodPort is the port cpiod listens on in the guest.
+const cpiodPort = "10000"
+
+// rmCommand removes paths in the guest, directories along with their content.
+// cpiod can only add files, so paths removed from the package are removed
+// with it before cpiod is started.
+const rmCommand = "/tools/rm.so -rf"
+
+// removeCmdline returns the command removing the given paths in the guest.
+// OSv splits the command line on whitespace and semicolons, so paths
+// containing them cannot be removed this way.
+func removeCmdline(paths []string) (string, error) {
+	for _, p := range paths {
+		if strings.ContainsAny(p, " \t\n;&\"'") {
+			return "", fmt.Errorf("%s cannot be removed on the command line of the guest", p)
+		}
+	}
+	return rmCommand + " " + strings.Join(paths, " "), nil
+}
+
+// newCpiodRule forwards a free host port to cpiod in the guest, so that
+// several VMs can be uploaded to at the same time.
+func newCpiodRule() (nat.Rule, error) {
+	port, err := util.FreeTCPPort()
+	if err != nil {
+		return nat.Rule{}, err
+	}
+	return nat.Rule{GuestPort: cpiodPort, HostPort: strconv.Itoa(port)}, nil
+}
+
+// UploadPackageContents boots the image and uploads the paths into it. Paths
+// in removedPaths are removed from an existing image before the upload.
+func UploadPackageContents(r *util.Repo, appImage string, uploadPaths map[string]string, imageCache core.HashCache,
+	removedPaths []string, verbose bool, zfsBuilderPath string) (core.HashCache, error) {
 
 	var osvCmdline string
 
@@ -97,16 +135,28 @@ func UploadPackageContents(r *util.Repo, appImage string, uploadPaths map[string
 		// allowing us to upload modified files. Files are always uploaded onto
 		// root
 		osvCmdline = "/tools/cpiod.so --prefix /"
+		if len(removedPaths) > 0 {
+			rmCmdline, err := removeCmdline(removedPaths)
+			if err != nil {
+				return nil, err
+			}
+			osvCmdline = rmCmdline + "; " + osvCmdline
+		}
 	}
 	osvCmdline = "--console=serial " + osvCmdline
 
+	cpiodRule, err := newCpiodRule()
+	if err != nil {
+		return nil, err
+	}
+
 	// Specify the VM properties. Use the app image as the source to start.
 	vmconfig := &qemu.VMConfig{
 		Image:       appImage,
 		Verbose:     false,
 		Memory:      512,
 		Networking:  "nat",
-		NatRules:    []nat.Rule{nat.Rule{GuestPort: "10000", HostPort: "10000"}},
+		NatRules:    []nat.Rule{cpiodRule},
 		BackingFile: false,
 		Cmd:         osvCmdline,
 		DisableKvm:  r.DisableKvm,
@@ -145,6 +195,7 @@ func UploadPackageContents(r *util.Repo, appImage string, uploadPaths map[string
 	go io.Copy(os.Stderr, stderr)
 
 	scanner := bufio.NewScanner(stdout)
+	ready, lastLine := false, ""
 	for scanner.Scan() {
 		text := scanner.Text()
 		if verbose {
@@ -154,15 +205,21 @@ func UploadPackageContents(r *util.Repo, appImage string, uploadPaths map[string
 		// We are looking for the following message from the OSv guest.
 		if text == "Waiting for connection from host..." {
 			// Cancel the scanner as soon as this message has been received.
+			ready = true
 			break
 		}
+		lastLine = text
+	}
+	// The guest stops early if any of the commands preceding cpiod fails.
+	if !ready {
+		return nil, fmt.Errorf("%s: guest stopped before cpiod was started: %s", appImage, lastLine)
 	}
 
 	// Consuming stdout is mandatory once it is redirected to linux socket.
 	// If not, buffer will fill up and capstan will hang.
 	go io.Copy(ioutil.Discard, stdout)
 
-	conn, err := util.ConnectAndWait("tcp", "localhost:10000")
+	conn, err := util.ConnectAndWait("tcp", "localhost:"+cpiodRule.HostPort)
 	if err != nil {
 		if !r.DisableKvm && strings.Contains(err.Error(), "getsockopt: connection refused") {
 			// Probably KVM is already in use e.g. by VirtualBox. Suggest user to turn it off for qemu.
@@ -184,7 +241,7 @@ func UploadPackageContentsToRemoteGuest(uploadPaths map[string]string, remoteHos
 
 	fmt.Printf("Uploading files to %s...\n", remoteHostNameOrIpAddress)
 
-	conn, err := util.ConnectAndWait("tcp", remoteHostNameOrIpAddress+":10000")
+	conn, err := util.ConnectAndWait("tcp", remoteHostNameOrIpAddress+":"+cpiodPort)
 	if err != nil {
 		if strings.Contains(err.Error(), "getsockopt: connection refused") {
 			fmt.Println("Could not connect to " + remoteHostNameOrIpAddress)
@@ -206,26 +263,23 @@ func uploadFiles(conn net.Conn, uploadPaths map[string]string, imageCache core.H
 		bar = pb.ProgressBarTemplate(tmpl).Start(len(uploadPaths))
 	}
 
-	// Initialise a dictionary for the up-to-date file hashes.
-	newHashes := core.NewHashCache()
+	// Compute up-to-date hashes of all paths, skipping the files that did not
+	// change since the last upload.
+	newHashes, unchanged, err := hashPaths(uploadPaths, imageCache)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := cpio.NewWriter(conn)
 
 	// Loop over collected paths and upload them to the image if necessary.
 	for src, dest := range uploadPaths {
-		// Get the hash of this path.
-		hash, _ := hashPath(src, dest)
-
-		// By default it should upload all files, except those whose cached
-		// hash value hasn't changed since the last upload.
-		uploadFile := true
-		if cachedHash, ok := imageCache[dest]; ok {
-			// If hashes are the same, we should not upload.
-			uploadFile = hash != cachedHash
-		}
-
-		if uploadFile {
+		// Upload all files, except those whose content hasn't changed since
+		// the last upload.
+		if !unchanged[dest] {
 			// Upload the file from host to guest. This will access cpiod
 			// running in OSv.
-			err := CopyFile(conn, src, dest)
+			err := CopyFile(writer, src, dest)
 			if err != nil {
 				return nil, err
 			}
@@ -241,8 +295,6 @@ func uploadFiles(conn net.Conn, uploadPaths map[string]string, imageCache core.H
 			bar.Increment()
 		}
 
-		// Store the new hash whenever a file is successfully uploaded to the VM.
-		newHashes[dest] = hash
 	}
 
 	if !verbose {
@@ -250,11 +302,39 @@ func uploadFiles(conn net.Conn, uploadPaths map[string]string, imageCache core.H
 	}
 
 	// Finalise the transfer.
-	cpio.WritePadded(conn, cpio.ToWireFormat("TRAILER!!!", 0, 0))
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
 
 	return newHashes, nil
 }
 
+// deletedPaths returns paths from the image cache that are no longer present.
+// Paths within an already deleted directory are omitted since removing the
+// directory removes its content as well.
+func deletedPaths(imageCache core.HashCache, currentPaths map[string]bool) []string {
+	var deleted []string
+	for dest := range imageCache {
+		if currentPaths[dest] {
+			continue
+		}
+
+		parentDeleted := false
+		for dir := path.Dir(dest); dir != "/" && dir != "."; dir = path.Dir(dir) {
+			if _, cached := imageCache[dir]; cached && !currentPaths[dir] {
+				parentDeleted = true
+				break
+			}
+		}
+		if !parentDeleted {
+			deleted = append(deleted, dest)
+		}
+	}
+	sort.Strings(deleted)
+
+	return deleted
+}
+
 func CollectPathContents(path string) (map[string]string, error) {
 	fi, err := os.Stat(path)
 
@@ -291,6 +371,176 @@ func CollectPathContents(path string) (map[string]string, error) {
 	return contents, nil
 }
 
+// hashPaths computes cache entries of all given paths using all available
+// CPUs. Regular files whose size and modification time match their cached
+// entries are not read at all. The returned set marks target paths whose
+// content is the same as recorded in the image cache.
+func hashPaths(paths map[string]string, imageCache core.HashCache) (core.HashCache, map[string]bool, error) {
+	type result struct {
+		dest      string
+		entry     core.HashEntry
+		unchanged bool
+		err       error
+	}
+
+	sources := make(chan string)
+	results := make(chan result)
+	wg := sync.WaitGroup{}
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for src := range sources {
+				dest := paths[src]
+				cached, ok := imageCache[dest]
+				entry, unchanged, err := hashEntry(src, dest, cached, ok)
+				results <- result{dest: dest, entry: entry, unchanged: unchanged, err: err}
+			}
+		}()
+	}
+	go func() {
+		for src := range paths {
+			sources <- src
+		}
+		close(sources)
+		wg.Wait()
+		close(results)
+	}()
+
+	newHashes := core.NewHashCache()
+	unchanged := make(map[string]bool)
+	var err error
+	for r := range results {
+		if r.err != nil {
+			// Keep consuming the results so that all workers can finish.
+			if err == nil {
+				err = r.err
+			}
+			continue
+		}
+		newHashes[r.dest] = r.entry
+		if r.unchanged {
+			unchanged[r.dest] = true
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newHashes, unchanged, nil
+}
+
+// hashTree computes cache entries of all nodes of the tree just like
+// hashPaths. Files on the host are hashed right away, but hashes of the files
+// streamed from package archives are only known once their data is written.
+// Such files are unchanged if their size and modification time match the cache
+// and their cache entries are left without the hash otherwise.
+func hashTree(tree *util.FileTree, imageCache core.HashCache) (core.HashCache, map[string]bool, error) {
+	hostPaths := make(map[string]string)
+	newHashes := core.NewHashCache()
+	unchanged := make(map[string]bool)
+
+	tree.Walk(func(node *util.FileNode) error {
+		if node.HostPath() != "" {
+			hostPaths[node.HostPath()] = node.Path
+			return nil
+		}
+
+		cached, isCached := imageCache[node.Path]
+		entry := core.HashEntry{Size: node.Size, Mode: node.Mode.Perm()}
+		if !node.ModTime.IsZero() {
+			entry.ModTime = node.ModTime.UnixNano()
+		}
+		switch {
+		case node.IsDir():
+			entry.Size, entry.ModTime = 0, 0
+			entry.Hash = fmt.Sprintf("%x", sha256.Sum256([]byte(node.Path)))
+		case node.IsSymlink():
+			entry.Hash = fmt.Sprintf("%x", sha256.Sum256([]byte(node.Link)))
+		case node.Hash != "":
+			entry.Hash = node.Hash
+		case isCached && cached.Hash != "" && cached.Size == entry.Size && cached.ModTime == entry.ModTime &&
+			cached.Mode == entry.Mode:
+			entry = cached
+		}
+
+		newHashes[node.Path] = entry
+		if isCached && entry.Hash != "" && entry.Hash == cached.Hash && entry.Mode == cached.Mode {
+			unchanged[node.Path] = true
+		}
+		return nil
+	})
+
+	hostHashes, hostUnchanged, err := hashPaths(hostPaths, imageCache)
+	if err != nil {
+		return nil, nil, err
+	}
+	for dest, entry := range hostHashes {
+		newHashes[dest] = entry
+	}
+	for dest := range hostUnchanged {
+		unchanged[dest] = true
+	}
+
+	return newHashes, unchanged, nil
+}
+
+// hashEntry returns the cache entry of the given path and whether it matches
+// the cached one, including the permission bits. Directories are identified by their target path and symbolic
+// links by their target.
+func hashEntry(hostPath, vmPath string, cached core.HashEntry, isCached bool) (core.HashEntry, bool, error) {
+	info, err := os.Lstat(hostPath)
+	if os.IsNotExist(err) {
+		return core.HashEntry{}, false, fmt.Errorf("Unable to hash unexistent path: %s", hostPath)
+	} else if err != nil {
+		return core.HashEntry{}, false, err
+	}
+
+	entry := core.HashEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Mode: info.Mode().Perm()}
+	if isCached && cached.Hash != "" && info.Mode().IsRegular() &&
+		cached.Size == entry.Size && cached.ModTime == entry.ModTime && cached.Mode == entry.Mode {
+		return cached, true, nil
+	}
+
+	h := sha256.New()
+	switch {
+	case info.IsDir():
+		// Modification time of a directory changes along with its content.
+		entry.Size, entry.ModTime = 0, 0
+		h.Write([]byte(vmPath))
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(hostPath)
+		if err != nil {
+			return core.HashEntry{}, false, err
+		}
+		h.Write([]byte(target))
+	case info.Mode().IsRegular():
+		f, err := os.Open(hostPath)
+		if err != nil {
+			return core.HashEntry{}, false, err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return core.HashEntry{}, false, err
+		}
+	default:
+		h.Write([]byte(vmPath))
+	}
+	entry.Hash = fmt.Sprintf("%x", h.Sum(nil))
+
+	if !isCached {
+		return entry, false, nil
+	}
+	if cached.LegacyHash != "" {
+		// Entries migrated from the old cache format can only be compared
+		// using the MD5 hash.
+		legacyHash, err := hashPath(hostPath, vmPath)
+		return entry, err == nil && legacyHash == cached.LegacyHash, nil
+	}
+	return entry, entry.Hash == cached.Hash && entry.Mode == cached.Mode, nil
+}
+
 func hashPath(hostPath, vmPath string) (string, error) {
 	info, err := os.Stat(hostPath)
 	if os.IsNotExist(err) {
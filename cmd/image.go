@@ -0,0 +1,249 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudius-systems/capstan/image"
+	"github.com/cloudius-systems/capstan/image/mbr"
+	"github.com/cloudius-systems/capstan/image/qcow2"
+	"github.com/cloudius-systems/capstan/image/rofs"
+	"github.com/cloudius-systems/capstan/util"
+)
+
+// ImageLs lists the content of the given directory of the ROFS filesystem
+// in the image. If the path points to a file, only the file itself is listed.
+func ImageLs(repo *util.Repo, imageName string, dirPath string, w io.Writer) error {
+	return withImageRofs(repo, imageName, func(fs *rofs.Filesystem) error {
+		inode, err := fs.Stat(dirPath)
+		if err != nil {
+			return err
+		}
+
+		if !inode.IsDir() {
+			return printRofsEntry(w, fs, path.Base(path.Clean("/"+dirPath)), inode)
+		}
+
+		entries, err := fs.ReadDir(inode)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := printRofsEntry(w, fs, entry.Name, entry.Inode); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ImageCat writes the content of the given file of the ROFS filesystem in
+// the image.
+func ImageCat(repo *util.Repo, imageName string, filePath string, w io.Writer) error {
+	return withImageRofs(repo, imageName, func(fs *rofs.Filesystem) error {
+		inode, err := fs.Stat(filePath)
+		if err != nil {
+			return err
+		}
+		if !inode.IsRegular() {
+			return fmt.Errorf("%s: not a regular file", filePath)
+		}
+
+		reader, err := fs.Open(inode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, reader)
+		return err
+	})
+}
+
+// ImageExtract extracts the given file or directory of the ROFS filesystem
+// in the image into the destination directory.
+func ImageExtract(repo *util.Repo, imageName string, filePath string, destination string) error {
+	return withImageRofs(repo, imageName, func(fs *rofs.Filesystem) error {
+		return fs.Extract(filePath, destination)
+	})
+}
+
+// ImageInspect describes the image: its format, sizes, backing file,
+// partitions with their filesystems, boot command line and the metadata from
+// index.yaml stored next to the image.
+func ImageInspect(repo *util.Repo, imageName string) (string, error) {
+	imagePath := resolveImagePath(repo, imageName)
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("%s: no such image", imageName)
+	}
+
+	format, err := image.Probe(imagePath)
+	if err != nil {
+		return "", err
+	}
+
+	b := bytes.Buffer{}
+	fmt.Fprintf(&b, "%-16s %s\n", "Image:", imagePath)
+	fmt.Fprintf(&b, "%-16s %s\n", "Format:", format)
+	fmt.Fprintf(&b, "%-16s %s\n", "Actual size:", formatSize(info.Size()))
+
+	if format == image.QCOW2 || format == image.RAW {
+		disk, err := image.OpenDisk(imagePath)
+		if err != nil {
+			return "", err
+		}
+		defer disk.Close()
+
+		fmt.Fprintf(&b, "%-16s %s\n", "Virtual size:", formatSize(disk.Size()))
+		if img, ok := disk.(*qcow2.Image); ok && img.BackingFile != "" {
+			fmt.Fprintf(&b, "%-16s %s\n", "Backing file:", img.BackingFile)
+		}
+
+		if err := describeDisk(&b, disk); err != nil {
+			return "", err
+		}
+	}
+
+	if meta, err := util.ReadImageInfoFile(filepath.Join(filepath.Dir(imagePath), "index.yaml")); err == nil {
+		fmt.Fprintln(&b, "Metadata:")
+		fmt.Fprintf(&b, "  %-14s %s\n", "Version:", meta.Version)
+		fmt.Fprintf(&b, "  %-14s %s\n", "Created:", meta.Created)
+		fmt.Fprintf(&b, "  %-14s %s\n", "Description:", meta.Description)
+		fmt.Fprintf(&b, "  %-14s %s\n", "Build:", meta.Build)
+		if meta.Base != "" {
+			fmt.Fprintf(&b, "  %-14s %s\n", "Base image:", meta.Base)
+		}
+		if len(meta.Packages) > 0 {
+			fmt.Fprintf(&b, "  %-14s %s\n", "Packages:", strings.Join(meta.Packages, ", "))
+		}
+	}
+
+	return b.String(), nil
+}
+
+func describeDisk(w io.Writer, disk image.Disk) error {
+	partitions, err := mbr.ReadPartitions(disk)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "Partitions:")
+	for i, partition := range partitions {
+		if partition.IsEmpty() {
+			continue
+		}
+		filesystem := image.ProbeFilesystem(disk, partition)
+		if filesystem == "" {
+			filesystem = "unknown"
+		}
+		fmt.Fprintf(w, "  %d: start %d, size %s, type 0x%02x, filesystem %s\n",
+			i+1, partition.Start(), formatSize(partition.Size()), partition.SystemId, filesystem)
+	}
+
+	cmdLine, err := image.ReadCmdLine(disk)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%-16s %s\n", "Command line:", cmdLine)
+	return nil
+}
+
+// formatSize returns the size in bytes along with its human readable form.
+func formatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%d (%.1f %s)", size, value, units[unit])
+}
+
+// ImageGetCmdLine returns the boot command line stored in the image.
+func ImageGetCmdLine(repo *util.Repo, imageName string) (string, error) {
+	return util.GetCmdLine(resolveImagePath(repo, imageName))
+}
+
+// ImageSetCmdLine replaces the boot command line stored in the image. The
+// command line is built from the boot options the same way as when composing
+// a package. Binary aliases recorded in the image metadata are resolved as well.
+func ImageSetCmdLine(repo *util.Repo, imageName string, bootOpts *BootOptions) (string, error) {
+	imagePath := resolveImagePath(repo, imageName)
+	if _, err := os.Stat(imagePath); err != nil {
+		return "", fmt.Errorf("%s: no such image", imageName)
+	}
+	if err := repo.CheckNoDependents(imageName); err != nil {
+		return "", err
+	}
+
+	if bootOpts.Binaries == nil {
+		if meta, err := util.ReadImageInfoFile(filepath.Join(filepath.Dir(imagePath), "index.yaml")); err == nil {
+			bootOpts.Binaries = meta.Binary
+		}
+	}
+
+	cmdLine, err := bootOpts.GetCmd()
+	if err != nil {
+		return "", err
+	}
+
+	return cmdLine, util.SetCmdLine(imagePath, cmdLine)
+}
+
+// withImageRofs opens the ROFS filesystem of the image and passes it to fn.
+// The image is either a path to an image file or a name of an image in the
+// repository.
+func withImageRofs(repo *util.Repo, imageName string, fn func(fs *rofs.Filesystem) error) error {
+	disk, err := image.OpenDisk(resolveImagePath(repo, imageName))
+	if err != nil {
+		return err
+	}
+	defer disk.Close()
+
+	fs, err := image.OpenRofs(disk)
+	if err != nil {
+		return fmt.Errorf("%s: %s", imageName, err)
+	}
+
+	return fn(fs)
+}
+
+// resolveImagePath returns the path of the image file. Existing files take
+// precedence over the images in the repository.
+func resolveImagePath(repo *util.Repo, imageName string) string {
+	if info, err := os.Stat(imageName); err == nil && !info.IsDir() {
+		return imageName
+	}
+	return repo.ImagePath("qemu", imageName)
+}
+
+func printRofsEntry(w io.Writer, fs *rofs.Filesystem, name string, inode *rofs.Inode) error {
+	switch {
+	case inode.IsDir():
+		fmt.Fprintf(w, "d %10d %s/\n", inode.Count, name)
+	case inode.IsSymlink():
+		target, err := fs.Readlink(inode)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "l %10d %s -> %s\n", len(target), name, target)
+	default:
+		fmt.Fprintf(w, "- %10d %s\n", inode.Count, name)
+	}
+	return nil
+}
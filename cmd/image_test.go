@@ -0,0 +1,243 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudius-systems/capstan/util"
+
+	. "github.com/cloudius-systems/capstan/testing"
+	. "gopkg.in/check.v1"
+)
+
+func (s *suite) TestImageLs(c *C) {
+	imagePath := prepareRofsDiskImage(c, s.packageFiles)
+
+	// This is what we're testing here.
+	out := bytes.Buffer{}
+	err := ImageLs(s.repo, imagePath, "/", &out)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	expected := `
+		d +1 data/
+		- +12 file.txt
+	`
+	c.Check(out.String(), MatchesMultiline, FixIndent(expected))
+}
+
+func (s *suite) TestImageLsFromRepository(c *C) {
+	imagePath := prepareRofsDiskImage(c, s.packageFiles)
+	os.MkdirAll(filepath.Dir(s.repo.ImagePath("qemu", "hello")), 0775)
+	c.Assert(os.Rename(imagePath, s.repo.ImagePath("qemu", "hello")), IsNil)
+
+	// This is what we're testing here.
+	out := bytes.Buffer{}
+	err := ImageLs(s.repo, "hello", "/data", &out)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(out.String(), MatchesMultiline, "- +12 data-file.txt\n")
+}
+
+func (s *suite) TestImageCat(c *C) {
+	imagePath := prepareRofsDiskImage(c, s.packageFiles)
+
+	// This is what we're testing here.
+	out := bytes.Buffer{}
+	err := ImageCat(s.repo, imagePath, "/data/data-file.txt", &out)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(out.String(), Equals, DefaultText)
+}
+
+func (s *suite) TestImageCatMissingFile(c *C) {
+	imagePath := prepareRofsDiskImage(c, s.packageFiles)
+
+	// This is what we're testing here.
+	err := ImageCat(s.repo, imagePath, "/missing.txt", &bytes.Buffer{})
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "/missing.txt: no such file or directory")
+}
+
+func (s *suite) TestImageExtract(c *C) {
+	imagePath := prepareRofsDiskImage(c, s.packageFiles)
+	outDir := c.MkDir()
+
+	// This is what we're testing here.
+	err := ImageExtract(s.repo, imagePath, "/data", outDir)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(filepath.Join(outDir, "data"), DirEquals, map[string]interface{}{
+		"data-file.txt": DefaultText,
+	})
+}
+
+func (s *suite) TestImageExtractNoRofs(c *C) {
+	imagePath := filepath.Join(c.MkDir(), "empty.raw")
+	c.Assert(ioutil.WriteFile(imagePath, make([]byte, 4096), 0644), IsNil)
+
+	// This is what we're testing here.
+	err := ImageExtract(s.repo, imagePath, "/", c.MkDir())
+
+	// Expectations.
+	c.Check(err, ErrorMatches, ".*no ROFS partition found")
+}
+
+func (s *suite) TestImageInspect(c *C) {
+	imagePath := prepareRofsDiskImage(c, s.packageFiles)
+	c.Assert(util.SetCmdLine(imagePath, "--verbose /hello.so"), IsNil)
+	meta := "format_version: \"1\"\nversion: \"0.1\"\ncreated: \"2018-01-01\"\ndescription: Hello\nbuild: \"\"\n"
+	c.Assert(ioutil.WriteFile(filepath.Join(filepath.Dir(imagePath), "index.yaml"), []byte(meta), 0644), IsNil)
+
+	// This is what we're testing here.
+	out, err := ImageInspect(s.repo, imagePath)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(out, MatchesMultiline, "Format: +raw\n")
+	c.Check(out, MatchesMultiline, "  2: start 1048576, size .*, type 0x83, filesystem ROFS\n")
+	c.Check(out, MatchesMultiline, "Command line: +--verbose /hello.so\n")
+	c.Check(out, MatchesMultiline, "  Description: +Hello\n")
+}
+
+func (s *suite) TestImageInspectQcow2(c *C) {
+	imagePath := prepareRofsDiskImage(c, s.packageFiles)
+	c.Assert(util.ConvertImageToQCOW2(imagePath), IsNil)
+
+	// This is what we're testing here.
+	out, err := ImageInspect(s.repo, imagePath)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(out, MatchesMultiline, "Format: +QCOW2\n")
+	c.Check(out, MatchesMultiline, "filesystem ROFS\n")
+}
+
+func (s *suite) TestImageInspectMissing(c *C) {
+	// This is what we're testing here.
+	_, err := ImageInspect(s.repo, "missing")
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "missing: no such image")
+}
+
+func (s *suite) TestImageSetCmdLine(c *C) {
+	m := []struct {
+		comment  string
+		bootOpts BootOptions
+		expected string
+	}{
+		{
+			"explicit command line",
+			BootOptions{Cmd: "/hello.so"},
+			"/hello.so",
+		},
+		{
+			"boot config sets",
+			BootOptions{Boot: []string{"first", "second"}},
+			"runscript /run/first;runscript /run/second;",
+		},
+		{
+			"environment variables",
+			BootOptions{Cmd: "/hello.so", EnvList: []string{"PORT=8000"}},
+			"--env=PORT=8000 /hello.so",
+		},
+		{
+			"default boot",
+			BootOptions{},
+			"runscript /run/default;",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		imagePath := prepareRofsDiskImage(c, s.packageFiles)
+
+		// This is what we're testing here.
+		cmdLine, err := ImageSetCmdLine(s.repo, imagePath, &args.bootOpts)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(cmdLine, Equals, args.expected)
+		stored, err := ImageGetCmdLine(s.repo, imagePath)
+		c.Assert(err, IsNil)
+		c.Check(stored, Equals, args.expected)
+	}
+}
+
+func (s *suite) TestImageSetCmdLineRefusesBaseImage(c *C) {
+	PrepareFiles(s.repo.Path, map[string]string{
+		"/repository/base/base.qemu":  DefaultText,
+		"/repository/base/index.yaml": "format_version: \"1\"\n",
+		"/repository/app/index.yaml":  "base: base\n",
+	})
+
+	// This is what we're testing here.
+	_, err := ImageSetCmdLine(s.repo, "base", &BootOptions{Cmd: "/hello.so"})
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "base: image is the base of app, remove them first")
+}
+
+func (s *suite) TestImageSetCmdLineResolvesBinaryAlias(c *C) {
+	imagePath := prepareRofsDiskImage(c, s.packageFiles)
+	meta := "format_version: \"1\"\nbinary:\n  hello: /usr/bin/hello.so\n"
+	c.Assert(ioutil.WriteFile(filepath.Join(filepath.Dir(imagePath), "index.yaml"), []byte(meta), 0644), IsNil)
+
+	// This is what we're testing here.
+	cmdLine, err := ImageSetCmdLine(s.repo, imagePath, &BootOptions{Cmd: "hello --verbose"})
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(cmdLine, Equals, "/usr/bin/hello.so --verbose")
+}
+
+func (s *suite) TestImageSetCmdLineMissingImage(c *C) {
+	// This is what we're testing here.
+	_, err := ImageSetCmdLine(s.repo, "missing", &BootOptions{Cmd: "/hello.so"})
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "missing: no such image")
+}
+
+// prepareRofsDiskImage creates a raw disk image with ROFS filesystem, made of
+// given files (except /meta), in its second partition.
+func prepareRofsDiskImage(c *C, files map[string]string) string {
+	tmp := c.MkDir()
+	contentDir := filepath.Join(tmp, "content")
+	c.Assert(PrepareFiles(contentDir, files), IsNil)
+
+	paths, err := CollectDirectoryContents(contentDir)
+	c.Assert(err, IsNil)
+	rofsImagePath := filepath.Join(tmp, "rofs.img")
+	c.Assert(util.WriteRofsImage(rofsImagePath, paths, false), IsNil)
+	rofsImage, err := ioutil.ReadFile(rofsImagePath)
+	c.Assert(err, IsNil)
+
+	// The ROFS partition starts at 1MB just like it would after the loader.
+	rofsStart := uint32(2048)
+	disk := make([]byte, int(rofsStart)*512+len(rofsImage))
+	copy(disk[rofsStart*512:], rofsImage)
+	partition := disk[0x1be+0x10:]
+	partition[4] = 0x83
+	binary.LittleEndian.PutUint32(partition[8:], rofsStart)
+	binary.LittleEndian.PutUint32(partition[12:], uint32(len(rofsImage)/512))
+	disk[510], disk[511] = 0x55, 0xaa
+
+	imagePath := filepath.Join(tmp, "disk.raw")
+	c.Assert(ioutil.WriteFile(imagePath, disk, 0644), IsNil)
+	return imagePath
+}
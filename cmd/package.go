@@ -9,6 +9,7 @@ package cmd
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
 	"fmt"
 	"io"
@@ -17,10 +18,13 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/cloudius-systems/capstan/core"
+	"github.com/cloudius-systems/capstan/image"
 	"github.com/cloudius-systems/capstan/runtime"
 	"github.com/cloudius-systems/capstan/util"
 	"gopkg.in/yaml.v2"
@@ -91,90 +95,188 @@ func BuildPackage(packageDir string) (string, error) {
 			return nil
 		}
 
-		link := ""
-		// Check whether the current path is a link
-		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
-			// Get the link target. It is relative to the link.
-			//if link, err = filepath.EvalSymlinks(path); err != nil {
-			if link, err = os.Readlink(path); err != nil {
-				return err
-			}
-		}
-
-		// Link is an empty string in case the path represents a regular file or dir.
-		header, err := tar.FileInfoHeader(info, link)
-		if err != nil {
-			return err
-		}
-
 		// Since the default initialisation uses only the basename for the name
 		// we have to use a path relative to the package in order to presserve
 		// hierarchy.
-		if info.IsDir() {
-			header.Name = relPath + "/"
-		} else {
-			header.Name = relPath
+		return writePackageTarEntry(tarball, relPath, path, info)
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	// Files on the host mapped by meta/manifest.yaml are stored at their paths
+	// in the image, so that the package does not depend on the host.
+	manifest, err := core.ParseFileManifest(filepath.Join(packageDir, "meta", "manifest.yaml"))
+	if err != nil {
+		return "", err
+	}
+	files, err := manifest.Resolve(packageDir)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if file.GuestPath == "/" {
+			continue
+		}
+		if err := writePackageTarEntry(tarball, file.GuestPath, file.HostPath, file.Info); err != nil {
+			return "", err
 		}
+	}
+
+	fmt.Printf("Package built and stored in %s\n", target)
 
-		if err := tarball.WriteHeader(header); err != nil {
+	return target, nil
+}
+
+// writePackageTarEntry writes the file on the host into the package archive
+// under the given name.
+func writePackageTarEntry(tarball *tar.Writer, name string, path string, info os.FileInfo) error {
+	link := ""
+	// Check whether the current path is a link
+	if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+		// Get the link target. It is relative to the link.
+		var err error
+		if link, err = os.Readlink(path); err != nil {
 			return err
 		}
+	}
 
-		switch {
-		case info.Mode()&os.ModeSymlink == os.ModeSymlink:
-			return nil
+	// Link is an empty string in case the path represents a regular file or dir.
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
 
-		case info.Mode().IsDir():
-			return nil
+	if info.IsDir() {
+		header.Name = name + "/"
+	} else {
+		header.Name = name
+	}
 
-		case info.Mode().IsRegular():
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
+	if err := tarball.WriteHeader(header); err != nil {
+		return err
+	}
 
-			defer file.Close()
-			_, err = io.Copy(tarball, file)
+	switch {
+	case info.Mode()&os.ModeSymlink == os.ModeSymlink:
+		return nil
 
-			return err
+	case info.Mode().IsDir():
+		return nil
 
-		default:
-			return fmt.Errorf("File %s has unsupported mode %v", path, info.Mode())
+	case info.Mode().IsRegular():
+		file, err := os.Open(path)
+		if err != nil {
+			return err
 		}
-	})
 
-	if err != nil {
-		return "", err
-	}
+		defer file.Close()
+		_, err = io.Copy(tarball, file)
 
-	fmt.Printf("Package built and stored in %s\n", target)
+		return err
 
-	return target, nil
+	default:
+		return fmt.Errorf("File %s has unsupported mode %v", path, info.Mode())
+	}
 }
 
 // ComposePackage uses the contents of the specified package directory and
 // create a (QEMU) virtual machine image. The image consists of all of the
 // required packages.
 // If updatePackage is set, ComposePackage tries to update an existing image
-// by comparing previous MD5 hashes to the ones in the current package
-// directory. Only modified files are uploaded and no file deletions are
-// possible at this time.
-func ComposePackage(repo *util.Repo, extraDependencies []string, imageSize int64, updatePackage, verbose, pullMissing bool,
-	packageDir, appName string, bootOpts *BootOptions, filesystem string, loaderImage string) error {
-
-	// Package content should be collected in a subdirectory called mpm-pkg.
-	targetPath := filepath.Join(packageDir, "mpm-pkg")
-	// Remove collected directory afterwards.
-	defer os.RemoveAll(targetPath)
-
-	// Construct final bootcmd for the image.
-	commandLine, err := bootOpts.GetCmd()
+// by comparing the SHA-256 cache of the previous compose to the current
+// package directory. Only files whose content or mode changed are uploaded
+// and files that are no longer part of the package are removed from the
+// image. In case of ROFS, the ROFS partition of the image is updated in place
+// and data of unchanged files is reused from it.
+// If baseImage is set, the image is created as an overlay of the base image
+// and only the files that differ from the base are written into it.
+// The content is collected into collectDir (see CollectPackage), which is
+// kept afterwards. If collectDir is empty, a temporary directory is used and
+// removed once the image is composed.
+// Package templates are rendered with the given values (see TemplateValues).
+func ComposePackage(repo *util.Repo, extraDependencies []string, exclude []string, imageSize ImageSize, updatePackage, verbose, pullMissing bool,
+	packageDir, appName string, bootOpts *BootOptions, filesystem string, loaderImage string, baseImage string,
+	collectDir string, values map[string]interface{}) error {
+
+	extraDependencies, err := withBasePackages(repo, baseImage, extraDependencies)
 	if err != nil {
 		return err
 	}
 
+	// Unless the content is to be kept, ROFS image is written directly from
+	// the package archives without collecting their content first.
+	if filesystem == "rofs" && collectDir == "" {
+		tree, binaries, packages, err := collectPackageTree(repo, packageDir, "", extraDependencies, exclude, values, pullMissing, false, verbose, os.Stdout)
+		if err != nil {
+			return err
+		}
+		if err := composeContent(repo, nil, tree, binaries, imageSize, updatePackage, verbose, appName, bootOpts,
+			filesystem, loaderImage, baseImage); err != nil {
+			return err
+		}
+		return saveSizeReport(repo, appName, newSizeReport(tree, packages[len(packages)-1].Name))
+	}
+
 	// First, collect the contents of the package.
-	if err := CollectPackage(repo, packageDir, extraDependencies, pullMissing, false, verbose); err != nil {
+	targetPath, err := CollectPackage(repo, packageDir, collectDir, extraDependencies, exclude, values, pullMissing, false, verbose)
+	if err != nil {
+		return err
+	}
+	if collectDir == "" {
+		defer os.RemoveAll(targetPath)
+	}
+
+	return composeCollectedPackage(repo, targetPath, imageSize, updatePackage, verbose, appName, bootOpts, filesystem, loaderImage, baseImage)
+}
+
+// withBasePackages prepends the packages of the base image (if any) to the
+// extra dependencies, since they are always part of the overlay.
+func withBasePackages(repo *util.Repo, baseImage string, extraDependencies []string) ([]string, error) {
+	if baseImage == "" {
+		return extraDependencies, nil
+	}
+	info, err := repo.ReadImageInfo(baseImage)
+	if err != nil {
+		return nil, fmt.Errorf("%s: no such base image", baseImage)
+	}
+	return append(append([]string{}, info.Packages...), extraDependencies...), nil
+}
+
+// ComposeBaseImage composes the given packages into a ZFS image that other
+// images can be composed on top of (see ComposePackage).
+func ComposeBaseImage(repo *util.Repo, baseName string, packages []string, imageSize ImageSize, verbose, pullMissing bool,
+	loaderImage string) error {
+
+	// The base image has no content of its own, just the required packages.
+	tmp, err := ioutil.TempDir("", "capstan-base")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := ComposePackage(repo, packages, nil, imageSize, false, verbose, pullMissing, tmp, baseName,
+		&BootOptions{}, "zfs", loaderImage, "", "", nil); err != nil {
+		return err
+	}
+
+	info, err := repo.ReadImageInfo(baseName)
+	if err != nil {
+		return err
+	}
+	info.Packages = packages
+	return repo.WriteImageInfo(baseName, info)
+}
+
+// composeCollectedPackage creates the image out of the package content that
+// has already been collected into targetPath.
+func composeCollectedPackage(repo *util.Repo, targetPath string, imageSize ImageSize, updatePackage, verbose bool,
+	appName string, bootOpts *BootOptions, filesystem string, loaderImage string, baseImage string) error {
+
+	// Binary aliases exported by the collected packages may be used in the command line.
+	binaries, err := readCollectedBinaries(targetPath)
+	if err != nil {
 		return err
 	}
 
@@ -184,6 +286,43 @@ func ComposePackage(repo *util.Repo, extraDependencies []string, imageSize int64
 		return err
 	}
 
+	if err := composeContent(repo, paths, nil, binaries, imageSize, updatePackage, verbose, appName, bootOpts,
+		filesystem, loaderImage, baseImage); err != nil {
+		return err
+	}
+
+	// Origins of the files are only known to the collection.
+	report, err := core.ParseSizeReport(filepath.Join(targetPath, "meta", "size.yaml"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return saveSizeReport(repo, appName, report)
+}
+
+// composeContent creates the image out of the package content given either
+// by the collected host paths mapped to their target paths or, for ROFS
+// images only, by the tree whose data is streamed from its sources.
+func composeContent(repo *util.Repo, paths map[string]string, tree *util.FileTree, binaries map[string]string,
+	imageSize ImageSize, updatePackage, verbose bool, appName string, bootOpts *BootOptions, filesystem string,
+	loaderImage string, baseImage string) error {
+
+	// Images other images are based on must be left intact.
+	if err := repo.CheckNoDependents(appName); err != nil {
+		return err
+	}
+	if baseImage != "" && filesystem != "zfs" {
+		return fmt.Errorf("Base images are only supported with ZFS filesystem")
+	}
+	bootOpts.Binaries = binaries
+
+	// Construct final bootcmd for the image.
+	commandLine, err := bootOpts.GetCmd()
+	if err != nil {
+		return err
+	}
+
 	// Get the path of imported image.
 	imagePath := repo.ImagePath("qemu", appName)
 	// Check whether the image already exists.
@@ -193,75 +332,323 @@ func ComposePackage(repo *util.Repo, extraDependencies []string, imageSize int64
 	}
 
 	if filesystem == "zfs" {
-		imageCachePath := repo.ImageCachePath("qemu", appName)
-		var imageCache core.HashCache
-		zfsBuilderPath := ""
-
-		// If the user requested new image or requested to update a non-existent image,
-		// initialize it first.
-		if !updatePackage || !imageExists {
-			zfsBuilderPath, err = repo.GetZfsBuilderImagePath()
-			if err != nil {
-				return fmt.Errorf("Failed to find ZFS builder path.\nError was: %s", err)
-			}
-			// Initialize an empty image based on the provided loader image. imageSize is used to
-			// determine the size of the user partition. Use default loader image.
-			if err := repo.InitializeZfsImage(loaderImage, appName, imageSize); err != nil {
-				return fmt.Errorf("Failed to initialize empty image named %s.\nError was: %s", appName, err)
+		if err := composeZfsImage(repo, paths, imageSize, updatePackage && imageExists, verbose, appName,
+			loaderImage, baseImage); err != nil {
+			return err
+		}
+	} else {
+		if tree == nil {
+			if tree, err = util.NewFileTreeFromPaths(paths); err != nil {
+				return err
 			}
-		} else {
-			// We are updating an existing image so try to parse the cache
-			// config file. Note that we are not interested in any errors as
-			// no-cache or invalid cache means that all files will be uploaded.
-			imageCache, _ = core.ParseHashCache(imageCachePath)
 		}
+		if err := composeRofsImage(repo, tree, updatePackage && imageExists, verbose, appName, loaderImage); err != nil {
+			return err
+		}
+	}
+
+	// Set the command line.
+	if err = util.SetCmdLine(imagePath, commandLine); err != nil {
+		return err
+	}
+	fmt.Printf("Command line set to: '%s'\n", commandLine)
 
-		// Upload the specified path onto virtual image.
-		imageCache, err = UploadPackageContents(repo, imagePath, paths, imageCache, verbose, zfsBuilderPath)
+	// Remember the binary aliases so that 'capstan run -e <alias>' can resolve them.
+	return saveImageBinaries(repo, appName, binaries)
+}
+
+// composeZfsImage uploads the paths into a ZFS image. If update is set, only
+// modified files are uploaded into the existing image and the files that are
+// no longer part of the package are removed from it. The image is composed
+// from scratch in case the removal fails.
+func composeZfsImage(repo *util.Repo, paths map[string]string, imageSize ImageSize, update, verbose bool,
+	appName string, loaderImage string, baseImage string) error {
+
+	imagePath := repo.ImagePath("qemu", appName)
+	imageCachePath := repo.ImageCachePath("qemu", appName)
+	var imageCache core.HashCache
+	var removedPaths []string
+	zfsBuilderPath := ""
+	var err error
+
+	if baseImage != "" && !(update && isOverlayOf(repo, appName, baseImage)) {
+		if err := repo.CreateOverlayImage(baseImage, appName); err != nil {
+			return fmt.Errorf("Failed to create overlay image named %s.\nError was: %s", appName, err)
+		}
+		// The overlay starts with the content of the base image, so only
+		// the paths that differ from it have to be uploaded.
+		imageCache, err = core.ParseHashCache(repo.ImageCachePath("qemu", baseImage))
+		if err != nil {
+			return fmt.Errorf("Failed to read file cache of base image %s.\nError was: %s", baseImage, err)
+		}
+	} else if !update {
+		// If the user requested new image or requested to update a non-existent image,
+		// initialize it first.
+		sizeMB, err := resolveImageSize(repo, loaderImage, imageSize, paths)
 		if err != nil {
 			return err
 		}
 
-		// Save the new image cache
-		imageCache.WriteToFile(imageCachePath)
+		zfsBuilderPath, err = repo.GetZfsBuilderImagePath()
+		if err != nil {
+			return fmt.Errorf("Failed to find ZFS builder path.\nError was: %s", err)
+		}
+		// Initialize an empty image based on the provided loader image. imageSize is used to
+		// determine the size of the user partition. Use default loader image.
+		if err := repo.InitializeZfsImage(loaderImage, appName, sizeMB); err != nil {
+			return fmt.Errorf("Failed to initialize empty image named %s.\nError was: %s", appName, err)
+		}
 	} else {
-		// Create ROFS
+		// We are updating an existing image so try to parse the cache
+		// config file. Note that we are not interested in any errors as
+		// no-cache or invalid cache means that all files will be uploaded.
+		imageCache, _ = core.ParseHashCache(imageCachePath)
+		// Paths uploaded before that are not part of the package anymore are
+		// removed in the guest before the upload.
+		currentPaths := make(map[string]bool, len(paths))
+		for _, dest := range paths {
+			currentPaths[dest] = true
+		}
+		removedPaths = deletedPaths(imageCache, currentPaths)
+	}
+
+	// Upload the specified path onto virtual image.
+	imageCache, err = UploadPackageContents(repo, imagePath, paths, imageCache, removedPaths, verbose, zfsBuilderPath)
+	if err != nil && len(removedPaths) > 0 {
+		fmt.Printf("Failed to remove files from image %s, composing it from scratch.\nError was: %s\n", appName, err)
+		return composeZfsImage(repo, paths, imageSize, false, verbose, appName, loaderImage, baseImage)
+	} else if err != nil {
+		return err
+	}
+
+	// Save the new image cache
+	return imageCache.WriteToFile(imageCachePath)
+}
+
+// saveImageBinaries stores the binary aliases into index.yaml of the image.
+// Aliases of the previous compose are removed, since the index of an updated
+// image is kept.
+func saveImageBinaries(repo *util.Repo, appName string, binaries map[string]string) error {
+	info, err := repo.ReadImageInfo(appName)
+	if err != nil {
+		return err
+	}
+	info.Binary = binaries
+	if len(binaries) == 0 {
+		info.Binary = nil
+	}
+	return repo.WriteImageInfo(appName, info)
+}
+
+// composeRofsImage writes the tree into a ROFS image. If update is set, the
+// ROFS partition of the existing image is updated in place and data of the
+// unchanged files is reused from it.
+func composeRofsImage(repo *util.Repo, tree *util.FileTree, update, verbose bool, appName string, loaderImage string) error {
+	// The cache tells which files of the ROFS partition of the image are
+	// unchanged, so that their data can be reused.
+	imageCachePath := repo.ImageRofsCachePath("qemu", appName)
+	var imageCache core.HashCache
+	if update {
+		imageCache, _ = core.ParseHashCache(imageCachePath)
+	}
+
+	// Only data of unchanged regular files is reused, other paths are
+	// cheap to write again.
+	newCache, unchanged, err := hashTree(tree, imageCache)
+	if err != nil {
+		return err
+	}
+
+	updated := false
+	if len(unchanged) > 0 {
+		fmt.Printf("Updating ROFS image, %d out of %d paths are unchanged\n", len(unchanged), len(newCache))
+		imagePath := repo.ImagePath("qemu", appName)
+		if updated, err = util.UpdateRofsPartition(imagePath, tree, unchanged, verbose); err != nil {
+			fmt.Printf("Failed to update ROFS image %s, composing it from scratch.\nError was: %s\n", appName, err)
+			updated = false
+		}
+	}
+
+	if !updated {
 		// Create temporary folder in which the image will be composed.
 		tmp, _ := ioutil.TempDir("", "capstan")
 		// Once this function is finished, remove temporary file.
 		defer os.RemoveAll(tmp)
 		rofs_image_path := path.Join(tmp, "rofs.img")
 
-		if err := util.WriteRofsImage(rofs_image_path, paths, targetPath, verbose); err != nil {
+		if err := util.WriteRofsTree(rofs_image_path, tree, verbose); err != nil {
 			return fmt.Errorf("Failed to write ROFS image named %s.\nError was: %s", rofs_image_path, err)
 		}
-
 		if err = repo.CreateRofsImage(loaderImage, appName, rofs_image_path); err != nil {
 			return fmt.Errorf("Failed to create ROFS image named %s.\nError was: %s", appName, err)
 		}
 	}
 
-	// Set the command line.
-	if err = util.SetCmdLine(imagePath, commandLine); err != nil {
-		return err
+	// Hashes of the files streamed from package archives are only known
+	// once they have been written.
+	for dest, entry := range newCache {
+		if node := tree.Lookup(dest); entry.Hash == "" && node != nil {
+			entry.Hash = node.Hash
+			newCache[dest] = entry
+		}
 	}
-	fmt.Printf("Command line set to: '%s'\n", commandLine)
+	return newCache.WriteToFile(imageCachePath)
+}
 
-	return nil
+// isOverlayOf checks whether the image is an overlay of the given base image.
+func isOverlayOf(repo *util.Repo, appName string, baseImage string) bool {
+	info, err := repo.ReadImageInfo(appName)
+	return err == nil && info.Base == baseImage
+}
+
+// ImageSize is the requested total size of the composed image. If Auto is
+// set, the size is computed from the content of the package and Headroom (in
+// MB) is added on top of it.
+type ImageSize struct {
+	MB       int64
+	Auto     bool
+	Headroom int64
 }
 
-func ComposePackageAndUploadToRemoteInstance(repo *util.Repo, extraDependencies []string, verbose, pullMissing bool,
-	packageDir, remoteHostInstance string) error {
+// Images with automatically computed size are rounded up to a multiple of
+// this size (in MB).
+const autoImageSizeAlignment = 64
 
-	// Package content should be collected in a subdirectory called mpm-pkg.
-	targetPath := filepath.Join(packageDir, "mpm-pkg")
-	// Remove collected directory afterwards.
-	defer os.RemoveAll(targetPath)
+// ParseImageSize parses size of the image given either explicitly (e.g. 512M
+// or 10G) or as auto[+headroom] (e.g. auto or auto+1G).
+func ParseImageSize(size string) (ImageSize, error) {
+	if !strings.HasPrefix(size, "auto") {
+		mb, err := util.ParseMemSize(size)
+		return ImageSize{MB: mb}, err
+	}
+
+	result := ImageSize{Auto: true}
+	if headroom := strings.TrimPrefix(size, "auto"); headroom != "" {
+		if !strings.HasPrefix(headroom, "+") {
+			return result, fmt.Errorf("%s: expected auto or auto+<headroom>, e.g. auto+512M", size)
+		}
+		var err error
+		if result.Headroom, err = util.ParseMemSize(headroom[1:]); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// resolveImageSize returns the total size (in MB) of the ZFS image that is
+// to hold the given paths. Explicit size is returned as is, but a warning is
+// printed when it is too small for the content.
+func resolveImageSize(repo *util.Repo, loaderImage string, imageSize ImageSize, paths map[string]string) (int64, error) {
+	var contentSize int64
+	for src := range paths {
+		if info, err := os.Lstat(src); err == nil && info.Mode().IsRegular() {
+			contentSize += info.Size()
+		}
+	}
+
+	partitionStart, err := repo.UserPartitionStart(loaderImage)
+	if err != nil {
+		return 0, err
+	}
+	requiredBytes := partitionStart + util.EstimateZfsPartitionSize(contentSize, len(paths))
+	requiredMB := (requiredBytes + (1 << 20) - 1) >> 20
+
+	if !imageSize.Auto {
+		if imageSize.MB < requiredMB {
+			fmt.Printf("WARNING: image size %dMB is likely too small for %dMB of package content, "+
+				"at least %dMB is needed (consider --size auto)\n", imageSize.MB, contentSize>>20, requiredMB)
+		}
+		return imageSize.MB, nil
+	}
+
+	sizeMB := requiredMB + imageSize.Headroom
+	sizeMB = (sizeMB + autoImageSizeAlignment - 1) / autoImageSizeAlignment * autoImageSizeAlignment
+	fmt.Printf("Image size computed from the package content: %dMB\n", sizeMB)
+	return sizeMB, nil
+}
+
+// composeFormat describes an image format package compose can produce. The
+// image is registered in the repository for the hypervisor able to run it,
+// if any. Images with an extension are stored next to the QCOW2 image under
+// that extension instead, formats without a hypervisor are not registered.
+type composeFormat struct {
+	format     image.ImageFormat
+	hypervisor string
+	extension  string
+}
+
+var composeFormats = map[string]composeFormat{
+	"qcow2":       {image.QCOW2, "qemu", ""},
+	"raw":         {image.RAW, "", "raw"},
+	"vmdk":        {image.VMDK, "vmw", ""},
+	"vdi":         {image.VDI, "vbox", ""},
+	"gce-tarball": {image.GCE_TARBALL, "gce", "tar.gz"},
+}
+
+// ParseComposeFormats parses comma-separated list of image formats requested
+// from package compose. Duplicates are ignored.
+func ParseComposeFormats(formats string) ([]string, error) {
+	var result []string
+	seen := make(map[string]bool)
+	for _, format := range strings.Split(formats, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "" || seen[format] {
+			continue
+		}
+		if _, ok := composeFormats[format]; !ok {
+			return nil, fmt.Errorf("unsupported image format '%s', use one of qcow2, raw, vmdk, vdi, gce-tarball", format)
+		}
+		seen[format] = true
+		result = append(result, format)
+	}
+	return result, nil
+}
+
+// ExportComposedImage converts the composed (QCOW2) image into each of the
+// given formats. VMDK and VDI images are registered under paths of the vmw and
+// vbox hypervisors, while raw image is only stored next to the QCOW2 image as
+// <name>.raw. The QCOW2 image itself is always kept as it is the base for
+// subsequent updates. GCE tarball is stored next to the image and the path of
+// the gce hypervisor points to it, just like with images pulled for GCE.
+func ExportComposedImage(repo *util.Repo, appName string, formats []string) error {
+	imagePath := repo.ImagePath("qemu", appName)
+	for _, name := range formats {
+		format := composeFormats[name]
+		if format.format == image.QCOW2 {
+			continue
+		}
+
+		targetPath := repo.ImagePath(format.hypervisor, appName)
+		if format.extension != "" {
+			targetPath = filepath.Join(filepath.Dir(imagePath), filepath.Base(appName)+"."+format.extension)
+		}
+
+		fmt.Printf("Exporting %s image to %s\n", name, targetPath)
+		if err := util.ExportImage(imagePath, targetPath, format.format); err != nil {
+			return fmt.Errorf("Failed to export %s image.\nError was: %s", name, err)
+		}
+
+		if format.hypervisor != "" && format.extension != "" {
+			pointer := repo.ImagePath(format.hypervisor, appName)
+			if err := ioutil.WriteFile(pointer, []byte(targetPath+"\n"), 0644); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func ComposePackageAndUploadToRemoteInstance(repo *util.Repo, extraDependencies []string, exclude []string,
+	values map[string]interface{}, verbose, pullMissing bool, packageDir, remoteHostInstance string) error {
 
 	// First, collect the contents of the package.
-	if err := CollectPackage(repo, packageDir, extraDependencies, pullMissing, true, verbose); err != nil {
+	targetPath, err := CollectPackage(repo, packageDir, "", extraDependencies, exclude, values, pullMissing, true, verbose)
+	if err != nil {
 		return err
 	}
+	// Remove collected directory afterwards.
+	defer os.RemoveAll(targetPath)
 
 	// If all is well, we have to start preparing the files for upload.
 	paths, err := CollectDirectoryContents(targetPath)
@@ -273,22 +660,110 @@ func ComposePackageAndUploadToRemoteInstance(repo *util.Repo, extraDependencies
 }
 
 // CollectPackage will try to resolve all of the dependencies of the given package
-// and collect the content in the $CWD/mpm-pkg directory.
-func CollectPackage(repo *util.Repo, packageDir string, extraDependencies []string, pullMissing, remote, verbose bool) error {
+// and collect the content in collectDir, replacing its previous content. The
+// collectDir is resolved relative to the package directory, so "mpm-pkg"
+// collects the content into the package directory itself. If collectDir is
+// empty, a new temporary directory is created so that concurrent collections
+// of the same package do not interfere and the package directory is never
+// written to. The directory holding the collected content is returned.
+// Package templates are rendered with the given values (see TemplateValues).
+func CollectPackage(repo *util.Repo, packageDir string, collectDir string, extraDependencies []string, exclude []string,
+	values map[string]interface{}, pullMissing, remote, verbose bool) (string, error) {
+
+	if collectDir == "" {
+		targetPath, err := ioutil.TempDir("", "capstan-collect")
+		if err != nil {
+			return "", err
+		}
+		if err := collectPackageInto(repo, packageDir, targetPath, extraDependencies, exclude, values, pullMissing, remote, verbose); err != nil {
+			os.RemoveAll(targetPath)
+			return "", err
+		}
+		return targetPath, nil
+	}
+
+	if !filepath.IsAbs(collectDir) {
+		collectDir = filepath.Join(packageDir, collectDir)
+	}
+	// The previous content of the collect directory is removed, so it must
+	// not hold the package itself.
+	absPackageDir, err := filepath.Abs(packageDir)
+	if err != nil {
+		return "", err
+	}
+	absCollectDir, err := filepath.Abs(collectDir)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(absCollectDir, absPackageDir); err == nil && !strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("Collect directory %s must not contain the package directory", collectDir)
+	}
+
+	return collectDir, collectPackageInto(repo, packageDir, collectDir, extraDependencies, exclude, values, pullMissing, remote, verbose)
+}
+
+// collectPackageInto collects the content of the package and all its
+// dependencies into targetPath.
+func collectPackageInto(repo *util.Repo, packageDir string, targetPath string, extraDependencies []string, exclude []string,
+	values map[string]interface{}, pullMissing, remote, verbose bool) error {
+
+	tree, binaries, packages, err := collectPackageTree(repo, packageDir, targetPath, extraDependencies, exclude, values, pullMissing, remote, verbose, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	// Delete previously collected content if exists
+	if _, err := os.Stat(targetPath); err == nil {
+		if err = os.RemoveAll(targetPath); err != nil {
+			fmt.Printf("failed to remove '%s' folder: %s\n", targetPath, err)
+		}
+	}
+
+	if err = os.MkdirAll(targetPath, 0775); err != nil {
+		return err
+	}
+
+	if err := tree.Extract(targetPath); err != nil {
+		return err
+	}
+
+	if err := persistBinaries(targetPath, binaries); err != nil {
+		return err
+	}
+
+	// The size report is stored in meta/size.yaml, which is not uploaded.
+	if err := os.MkdirAll(filepath.Join(targetPath, "meta"), 0775); err != nil {
+		return err
+	}
+	return newSizeReport(tree, packages[len(packages)-1].Name).WriteToFile(filepath.Join(targetPath, "meta", "size.yaml"))
+}
+
+// collectPackageTree resolves all dependencies of the package and returns the
+// tree of the content they are composed of, along with the binary aliases they
+// export and the packages themselves, the collected package last. Files of
+// the package override files of the required packages, which in turn
+// override files of the packages required before them. Data of the files is
+// not read here, so the tree can be streamed directly into the image.
+// Directory skipPath (if any) is not collected from the package directory.
+// Files of the required packages matching the exclude patterns or the exclude
+// list of the package are left out. Templates of the package are rendered
+// once all the content is collected. Progress messages are written to out.
+func collectPackageTree(repo *util.Repo, packageDir string, skipPath string, extraDependencies []string, exclude []string,
+	values map[string]interface{}, pullMissing, remote, verbose bool, out io.Writer) (*util.FileTree, map[string]string, []core.Package, error) {
 	// Get the manifest file of the given package.
 	pkg, err := core.ParsePackageManifestAndFallbackToDefault(filepath.Join(packageDir, "meta", "package.yaml"))
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
 	genRuntime, err := runtime.PackageRunManifestGeneral(filepath.Join(packageDir, "meta", "run.yaml"))
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
 	// If runtime is known, then we add runtime dependencies to the list.
 	if genRuntime != nil && len(genRuntime.GetDependencies()) > 0 {
-		fmt.Printf("Prepending '%s' runtime dependencies to dep list: %s\n",
+		fmt.Fprintf(out, "Prepending '%s' runtime dependencies to dep list: %s\n",
 			genRuntime.GetRuntimeName(), genRuntime.GetDependencies())
 		pkg.Require = append(genRuntime.GetDependencies(), pkg.Require...)
 	}
@@ -311,34 +786,34 @@ func CollectPackage(repo *util.Repo, packageDir string, extraDependencies []stri
 	// Look for all dependencies and make sure they are all available in the repository.
 	requiredPackages, err := repo.GetPackageDependencies(pkg, pullMissing)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
-	targetPath := filepath.Join(packageDir, "mpm-pkg")
+	tree := util.NewFileTree()
+	allCmdConfigs := &runtime.AllCmdConfigs{}
 
-	// Delete old 'mpm-package' folder if exists
-	if _, err := os.Stat(targetPath); err == nil {
-		if err = os.RemoveAll(targetPath); err != nil {
-			fmt.Printf("failed to remove 'mpm-pkg' folder: %s\n", err)
-		}
+	excluded, err := newExclusions(append(append([]string{}, pkg.Exclude...), exclude...), verbose, out)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	if err = os.MkdirAll(targetPath, 0775); err != nil {
-		return err
+	// Binary aliases exported by the required packages. Aliases of the package
+	// being collected are added last so that they override the inherited ones.
+	binaries := make(map[string]string)
+	for _, req := range requiredPackages {
+		for alias, target := range req.Binary {
+			binaries[alias] = target
+		}
+	}
+	for alias, target := range pkg.Binary {
+		binaries[alias] = target
 	}
-
-	allCmdConfigs := &runtime.AllCmdConfigs{}
 
 	// First collect everything from the required packages.
 	for _, req := range requiredPackages {
-		reader, err := repo.GetPackageTarReader(req.Name)
-		if err != nil {
-			return err
-		}
-
-		cmdConf, err := extractPackageContent(reader, targetPath, req.Name)
+		cmdConf, err := addPackageContent(repo, tree, req.Name, excluded, out)
 		if err != nil {
-			return err
+			return nil, nil, nil, err
 		}
 		allCmdConfigs.Add(req.Name, cmdConf)
 	}
@@ -347,33 +822,40 @@ func CollectPackage(repo *util.Repo, packageDir string, extraDependencies []stri
 	capstanignorePath := filepath.Join(packageDir, ".capstanignore")
 	if _, err := os.Stat(capstanignorePath); os.IsNotExist(err) {
 		if verbose {
-			fmt.Println("WARN: .capstanignore not found, all files will be uploaded")
+			fmt.Fprintln(out, "WARN: .capstanignore not found, all files will be uploaded")
 		}
 		capstanignorePath = ""
 	}
 	capstanignore, err := core.CapstanignoreInit(capstanignorePath)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
-	// Now we need to append the content of the current package into the target directory.
+	// The target directory might be inside the package directory and must
+	// not be collected into itself.
+	skipRelPath := ""
+	if skipPath != "" {
+		absPackageDir, _ := filepath.Abs(packageDir)
+		absSkipPath, _ := filepath.Abs(skipPath)
+		if rel, err := filepath.Rel(absPackageDir, absSkipPath); err == nil && !strings.HasPrefix(rel, "..") {
+			skipRelPath = string(filepath.Separator) + rel
+		}
+	}
+
+	// Now we need to append the content of the current package.
 	// This should override any file from the required packages.
 	err = filepath.Walk(packageDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		link := ""
-		// Check whether the current path is a link
-		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
-			// Get the link target. It is relative to the link.
-			//if link, err = filepath.EvalSymlinks(path); err != nil {
-			if link, err = os.Readlink(path); err != nil {
-				return err
-			}
-		}
-
 		relPath := strings.TrimPrefix(path, packageDir)
+		if relPath == "" {
+			return nil
+		}
+		if skipRelPath != "" && info.IsDir() && relPath == skipRelPath {
+			return filepath.SkipDir
+		}
 
 		// Apply meta/run.yaml before ignoring it.
 		if relPath == "/meta/run.yaml" {
@@ -392,14 +874,27 @@ func CollectPackage(repo *util.Repo, packageDir string, extraDependencies []stri
 			return nil
 		}
 
-		// Ignore what needs to be ignored.
-		if capstanignore.IsIgnored(relPath) {
+		// Ignore what needs to be ignored. Paths of directories end with a
+		// slash for patterns that only match directories.
+		ignorePath := filepath.ToSlash(relPath)
+		if info.IsDir() {
+			ignorePath += "/"
+		}
+		// The project file describes the images rather than their content,
+		// while any other file of the same name is uploaded as usual.
+		if ignorePath == "/"+core.ProjectFileName && core.IsProjectFile(path) {
+			if verbose {
+				fmt.Fprintf(out, ".capstanignore: ignore %s (project file)\n", relPath)
+			}
+			return nil
+		}
+		if capstanignore.IsIgnored(ignorePath) {
 			if verbose {
 				suffix := ""
 				if info.IsDir() {
 					suffix = " (entire folder)"
 				}
-				fmt.Printf(".capstanignore: ignore %s%s\n", relPath, suffix)
+				fmt.Fprintf(out, ".capstanignore: ignore %s%s\n", relPath, suffix)
 			}
 			if info.IsDir() {
 				return filepath.SkipDir
@@ -407,30 +902,299 @@ func CollectPackage(repo *util.Repo, packageDir string, extraDependencies []stri
 			return nil
 		}
 
-		switch {
-		case info.Mode()&os.ModeSymlink == os.ModeSymlink:
-			return os.Symlink(link, filepath.Join(targetPath, relPath))
+		// Patterns of .capstanignore in a subdirectory apply to its content.
+		if info.IsDir() {
+			nestedPath := filepath.Join(path, ".capstanignore")
+			if _, err := os.Stat(nestedPath); err == nil {
+				if err := capstanignore.LoadNestedFile(nestedPath, filepath.ToSlash(relPath)); err != nil {
+					return fmt.Errorf("failed to parse %s: %s", nestedPath, err)
+				}
+			}
+		}
 
-		case info.IsDir():
-			return os.MkdirAll(filepath.Join(targetPath, relPath), info.Mode())
+		return tree.AddHostPath(filepath.ToSlash(relPath), path, info, pkg.Name)
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-		case info.Mode().IsRegular():
-			return util.CopyLocalFile(filepath.Join(targetPath, relPath), path)
+	// Files on the host mapped by meta/manifest.yaml complete the content of
+	// the package.
+	if err := addManifestFiles(tree, packageDir, pkg.Name); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := renderTemplates(tree, pkg, values); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Boot commands of all packages are stored in /run directory.
+	bootCmds, err := allCmdConfigs.BootCmds()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if tree.Lookup("/run") == nil {
+		tree.AddDir("/run", 0775, time.Time{}, "")
+	}
+	for confName, bootCmd := range bootCmds {
+		tree.AddData("/run/"+confName, []byte(bootCmd), 0700, "")
+	}
+	for _, warning := range excluded.referenced(tree, bootCmds) {
+		fmt.Fprintf(out, "WARN: %s\n", warning)
+	}
+
+	// Make sure all binary aliases point to existing files.
+	if err := addBinaryScripts(tree, binaries); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return tree, binaries, append(requiredPackages, pkg), nil
+}
+
+// addManifestFiles adds the files on the host mapped into the image by
+// meta/manifest.yaml of the package (see core.FileManifest).
+func addManifestFiles(tree *util.FileTree, packageDir string, pkgName string) error {
+	manifest, err := core.ParseFileManifest(filepath.Join(packageDir, "meta", "manifest.yaml"))
+	if err != nil {
+		return err
+	}
+	files, err := manifest.Resolve(packageDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := tree.AddHostPath(file.GuestPath, file.HostPath, file.Info, pkgName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TemplateValues returns the values that package templates are rendered with.
+// Values are read from the YAML valuesFile (if any) and then overridden by the
+// KEY=VALUE pairs of envList, as given with --env.
+func TemplateValues(valuesFile string, envList []string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	if valuesFile != "" {
+		data, err := ioutil.ReadFile(valuesFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("%s: %s", valuesFile, err)
+		}
+	}
+
+	env, err := util.ParseEnvironmentList(envList)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range env {
+		values[key] = value
+	}
+
+	return values, nil
+}
+
+// renderTemplates renders the files listed in templates of package.yaml with
+// text/template. The given values override the default values of the package.
+// Templates referring to a value that is not defined are an error.
+func renderTemplates(tree *util.FileTree, pkg core.Package, values map[string]interface{}) error {
+	if len(pkg.Templates) == 0 {
+		return nil
+	}
+
+	data := make(map[string]interface{})
+	for key, value := range pkg.Values {
+		data[key] = value
+	}
+	for key, value := range values {
+		data[key] = value
+	}
+
+	for _, templatePath := range pkg.Templates {
+		node := tree.Lookup(templatePath)
+		if node == nil || !node.IsRegular() {
+			return fmt.Errorf("template %s does not exist in the collected package", templatePath)
+		}
+
+		content, err := tree.ReadFile(templatePath)
+		if err != nil {
+			return err
+		}
+		tmpl, err := template.New(node.Path).Option("missingkey=error").Parse(string(content))
+		if err != nil {
+			return err
+		}
+		rendered := bytes.Buffer{}
+		if err := tmpl.Execute(&rendered, data); err != nil {
+			return err
+		}
+
+		tree.AddData(node.Path, rendered.Bytes(), node.Mode, node.Source)
+	}
+
+	return nil
+}
+
+// addPackageContent adds the content of the package archive to the tree and
+// returns the boot commands of the package. Package metadata and the excluded
+// files are left out.
+func addPackageContent(repo *util.Repo, tree *util.FileTree, pkgName string, excluded *exclusions,
+	out io.Writer) (*runtime.CmdConfig, error) {
+	fmt.Fprintf(out, "Adding package %s\n", pkgName)
+	var cmdConf *runtime.CmdConfig
+	open := func() (*tar.Reader, io.Closer, error) {
+		return repo.OpenPackageArchive(pkgName)
+	}
 
-		default:
-			return fmt.Errorf("File %s has unsupported mode %v", path, info.Mode())
+	err := tree.AddArchive(pkgName, open, func(header *tar.Header, data io.Reader) (bool, error) {
+		if absTarPathMatches(header.Name, "/meta/run.yaml") {
+			// Prepare files with boot commands for this package.
+			content, err := ioutil.ReadAll(data)
+			if err != nil {
+				return false, err
+			}
+			cmdConf, err = runtime.ParsePackageRunManifestData(content)
+			return false, err
+		}
+		// Skip other manifest data
+		if absTarPathMatches(header.Name, "/meta/.*") {
+			return false, nil
 		}
+		name := header.Name
+		if header.Typeflag == tar.TypeDir && !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+		return !excluded.exclude(name, pkgName), nil
 	})
+
+	return cmdConf, err
+}
+
+// exclusions are the files of the required packages that are left out of the
+// image. Excluding a directory excludes all its content.
+type exclusions struct {
+	patterns core.Capstanignore
+	// paths are the excluded paths along with the packages they come from.
+	paths   map[string]string
+	verbose bool
+	out     io.Writer
+}
+
+func newExclusions(patterns []string, verbose bool, out io.Writer) (*exclusions, error) {
+	capstanignore, err := core.NewCapstanignore(patterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude pattern: %s", err)
+	}
+	return &exclusions{patterns: capstanignore, paths: make(map[string]string), verbose: verbose, out: out}, nil
+}
+
+// exclude returns true if the file of the package is excluded, i.e. the path
+// or any of its parent directories matches one of the patterns. Paths of
+// directories end with a slash.
+func (e *exclusions) exclude(filePath string, pkgName string) bool {
+	if !e.patterns.IsIgnored("/" + filePath) {
+		return false
+	}
+	filePath = path.Clean("/" + filePath)
+	if e.verbose {
+		fmt.Fprintf(e.out, "exclude: %s of package %s\n", filePath, pkgName)
+	}
+	e.paths[filePath] = pkgName
+	return true
+}
+
+// referenced returns warnings about the excluded files the boot commands refer
+// to, unless the files have been added back, e.g. by the package itself.
+func (e *exclusions) referenced(tree *util.FileTree, bootCmds map[string]string) []string {
+	if len(e.paths) == 0 {
+		return nil
+	}
+
+	confNames := make([]string, 0, len(bootCmds))
+	for confName := range bootCmds {
+		confNames = append(confNames, confName)
+	}
+	sort.Strings(confNames)
+
+	var warnings []string
+	for _, confName := range confNames {
+		for _, match := range absolutePathPattern.FindAllStringSubmatch(bootCmds[confName], -1) {
+			filePath := path.Clean(match[1])
+			if pkgName, ok := e.paths[filePath]; ok && tree.Lookup(filePath) == nil {
+				warnings = append(warnings, fmt.Sprintf("boot command of config set '%s' refers to %s, which is excluded from package %s",
+					confName, filePath, pkgName))
+			}
+		}
+	}
+	return warnings
+}
+
+// absolutePathPattern matches absolute paths within a command line, including
+// paths that are values of options (--dir=/data) or parts of class paths.
+var absolutePathPattern = regexp.MustCompile(`(?:^|[\s:;=,'"])(/[^\s:;=,'"]*)`)
+
+// addBinaryScripts validates the binary aliases against the collected content.
+// Every alias that is not a path gets its own script in /run so that it can be
+// booted with --boot <alias>. Scripts of config sets with the same name are
+// never overwritten.
+func addBinaryScripts(tree *util.FileTree, binaries map[string]string) error {
+	for alias, target := range binaries {
+		if tree.Lookup(target) == nil {
+			return fmt.Errorf("binary '%s' points to %s which does not exist in the collected package", alias, target)
+		}
+
+		if strings.Contains(alias, "/") {
+			continue
+		}
+
+		scriptPath := "/run/" + alias
+		if tree.Lookup(scriptPath) != nil {
+			continue
+		}
+		tree.AddData(scriptPath, []byte(target), 0700, "")
+	}
+
+	return nil
+}
+
+// persistBinaries stores the binary aliases into meta/binary.yaml of the
+// collected package. The file is not uploaded to the image.
+func persistBinaries(targetPath string, binaries map[string]string) error {
+	if len(binaries) == 0 {
+		return nil
+	}
+
+	d, err := yaml.Marshal(binaries)
 	if err != nil {
 		return err
 	}
 
-	// Persist all boot commands into /run directory.
-	if err := allCmdConfigs.Persist(targetPath); err != nil {
+	if err := os.MkdirAll(filepath.Join(targetPath, "meta"), 0775); err != nil {
 		return err
 	}
 
-	return nil
+	return ioutil.WriteFile(filepath.Join(targetPath, "meta", "binary.yaml"), d, 0644)
+}
+
+// readCollectedBinaries returns binary aliases stored by CollectPackage.
+func readCollectedBinaries(targetPath string) (map[string]string, error) {
+	binaries := make(map[string]string)
+
+	data, err := ioutil.ReadFile(filepath.Join(targetPath, "meta", "binary.yaml"))
+	if os.IsNotExist(err) {
+		return binaries, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(data, &binaries); err != nil {
+		return nil, err
+	}
+
+	return binaries, nil
 }
 
 func CollectDirectoryContents(packageDir string) (map[string]string, error) {
@@ -471,79 +1235,6 @@ func ImportPackage(repo *util.Repo, packageDir string) error {
 	return repo.ImportPackage(pkg, packagePath)
 }
 
-func extractPackageContent(tarReader *tar.Reader, target, pkgName string) (*runtime.CmdConfig, error) {
-	fmt.Printf("extractPackageContent: %s\n", pkgName)
-	var cmdConf *runtime.CmdConfig
-	for {
-		header, err := tarReader.Next()
-		if err != nil {
-			if err == io.EOF {
-				// Have we reached till the end of the tar?
-				break
-			}
-			return nil, err
-		}
-
-		if absTarPathMatches(header.Name, "/meta/run.yaml") {
-			// Prepare files with boot commands for this package.
-			data, err := ioutil.ReadAll(tarReader)
-			if err != nil {
-				return nil, err
-			}
-			cmdConf, err = runtime.ParsePackageRunManifestData(data)
-			if err != nil {
-				return nil, err
-			}
-			continue
-		} else if absTarPathMatches(header.Name, "/meta/.*") {
-			// Skip other manifest data
-			continue
-		}
-
-		path := filepath.Join(target, header.Name)
-		info := header.FileInfo()
-
-		switch {
-		case info.Mode()&os.ModeSymlink == os.ModeSymlink:
-			if err := ensureDirectoryStructureForFile(path); err != nil {
-				return nil, fmt.Errorf("Could not prepare directory structure for %s: %s", path, err)
-			}
-
-			// Create symbolic link. Ignore any error that might occur locally as
-			// links can be created dynamically on the VM itself.
-			os.Symlink(header.Linkname, path)
-
-		case info.IsDir():
-			if err = os.MkdirAll(path, info.Mode()); err != nil {
-				return nil, err
-			}
-
-		case info.Mode().IsRegular():
-			if err := ensureDirectoryStructureForFile(path); err != nil {
-				return nil, fmt.Errorf("Could not prepare directory structure for %s: %s", path, err)
-			}
-
-			writer, err := os.Create(path)
-			if err != nil {
-				return nil, err
-			}
-
-			_, err = io.Copy(writer, tarReader)
-			err = os.Chmod(path, os.FileMode(header.Mode))
-			if err != nil {
-				return nil, err
-			}
-
-			writer.Close()
-
-		default:
-			return nil, fmt.Errorf("File %s has unsupported mode %v", path, info.Mode())
-		}
-	}
-
-	return cmdConf, nil
-}
-
 // PullPackage looks for the package in remote repository and tries to import
 // it into local repository.
 func PullPackage(r *util.Repo, packageName string) error {
@@ -551,19 +1242,6 @@ func PullPackage(r *util.Repo, packageName string) error {
 	return r.DownloadPackageRemote(packageName)
 }
 
-// ensureDirectoryStructureForFile creates directory path for given filepath.
-func ensureDirectoryStructureForFile(currfilepath string) error {
-	dirpath := filepath.Dir(currfilepath)
-
-	if _, err := os.Stat(dirpath); err != nil {
-		if err = os.MkdirAll(dirpath, 0775); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 // DescribePackage describes package with given name without extracting it.
 func DescribePackage(repo *util.Repo, packageName string, showContent bool) (string, error) {
 	if !repo.PackageExists(packageName) {
@@ -637,6 +1315,19 @@ func DescribePackage(repo *util.Repo, packageName string, showContent bool) (str
 				s += fmt.Sprintf("   * %s\n", r)
 			}
 		}
+
+		if len(pkg.Binary) > 0 {
+			aliases := make([]string, 0, len(pkg.Binary))
+			for alias := range pkg.Binary {
+				aliases = append(aliases, alias)
+			}
+			sort.Strings(aliases)
+
+			s += fmt.Sprintln("exported binaries:")
+			for _, alias := range aliases {
+				s += fmt.Sprintf("   * %s -> %s\n", alias, pkg.Binary[alias])
+			}
+		}
 	} else {
 		return "", fmt.Errorf("package is not valid: missing meta/package.yaml")
 	}
@@ -696,6 +1387,7 @@ type BootOptions struct {
 	Boot       []string
 	EnvList    []string
 	PackageDir string
+	Binaries   map[string]string
 }
 
 // GetCmd builds final bootcmd based on three parameters (in this order):
@@ -703,18 +1395,24 @@ type BootOptions struct {
 // * --boot <customBoot>
 // * config_set_default: <> (read from meta/run.yaml within packageDir)
 func (b *BootOptions) GetCmd() (string, error) {
+	return b.getCmd(os.Stdout)
+}
+
+// getCmd builds the boot command like GetCmd, writing the messages about
+// where the command comes from to out.
+func (b *BootOptions) getCmd(out io.Writer) (string, error) {
 	command := ""
 
 	if b.Cmd != "" { // Direct commandLine has highest priority (--run <commandLine>).
-		fmt.Println("Command line will be set based on --run parameter")
-		command = b.Cmd
+		fmt.Fprintln(out, "Command line will be set based on --run parameter")
+		command = ResolveBinaryAlias(b.Cmd, b.Binaries)
 	} else if len(b.Boot) > 0 { // Configuration name has second-highest priority (--boot <customBoot>).
-		fmt.Println("Command line will be set based on --boot parameters")
+		fmt.Fprintln(out, "Command line will be set based on --boot parameters")
 		command = runtime.BootCmdForScript(b.Boot)
 	} else if b.PackageDir != "" { // Default configuration in yaml has third-highest priority (config_set_default: <>).
 		if data, err := ioutil.ReadFile(filepath.Join(b.PackageDir, "meta", "run.yaml")); err == nil {
 			if cmdConf, err := runtime.ParsePackageRunManifestData(data); err == nil && cmdConf.ConfigSetDefault != "" {
-				fmt.Println("Command line will be set based on config_set_default attribute of meta/run.yaml")
+				fmt.Fprintln(out, "Command line will be set based on config_set_default attribute of meta/run.yaml")
 				command = runtime.BootCmdForScript(strings.Split(cmdConf.ConfigSetDefault, ","))
 			}
 		}
@@ -730,13 +1428,51 @@ func (b *BootOptions) GetCmd() (string, error) {
 	}
 
 	if command == "" { // Fallback is default boot
-		fmt.Println("Command line will be set to default boot")
+		fmt.Fprintln(out, "Command line will be set to default boot")
 		command = runtime.BootCmdForScript([]string {"default"})
 	}
 
 	return command, nil
 }
 
+// ResolveBinaryAlias replaces the program of the given command line with the
+// binary path it is mapped to in the `binary` section of package.yaml. Leading
+// options of the OSv command line (e.g. --env=KEY=VALUE or -v) are skipped. If the program is not an alias,
+// the command line is returned unchanged.
+func ResolveBinaryAlias(command string, binaries map[string]string) string {
+	if len(binaries) == 0 {
+		return command
+	}
+
+	for start := 0; start < len(command); {
+		// Skip whitespace in front of the next token.
+		if command[start] == ' ' || command[start] == '\t' {
+			start++
+			continue
+		}
+
+		end := strings.IndexAny(command[start:], " \t;")
+		if end < 0 {
+			end = len(command)
+		} else {
+			end += start
+		}
+
+		token := command[start:end]
+		if strings.HasPrefix(token, "-") {
+			start = end
+			continue
+		}
+
+		if target, ok := binaries[token]; ok {
+			return command[:start] + target + command[end:]
+		}
+		break
+	}
+
+	return command
+}
+
 // absTarPathMatches tells whether the tar header name matches the path pattern.
 // This function is needed since some tar files prefix its header names
 // with / and some not. NOTE: 'pathPattern' is always considered absolute path
@@ -8,8 +8,12 @@
 package cmd
 
 import (
+	"archive/tar"
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
@@ -17,6 +21,8 @@ import (
 	"time"
 
 	"github.com/cloudius-systems/capstan/core"
+	"github.com/cloudius-systems/capstan/cpio"
+	"github.com/cloudius-systems/capstan/image"
 	"github.com/cloudius-systems/capstan/util"
 
 	. "github.com/cloudius-systems/capstan/testing"
@@ -215,14 +221,59 @@ func (*suite) TestComposeWithNoManifestSucceeds(c *C) {
 	defer mockServer.Close()
 	repo.GithubURL = mockServer.URL
 
-	imageSize, _ := util.ParseMemSize("64M")
+	imageSize, _ := ParseImageSize("64M")
 	appName := "test-corrupt-app"
 
-	err := ComposePackage(repo, []string{}, imageSize, false, false, true, tmp, appName, &BootOptions{}, "rofs", "osv-loader")
+	err := ComposePackage(repo, []string{}, nil, imageSize, false, false, true, tmp, appName, &BootOptions{}, "rofs", "osv-loader", "", "", nil)
 
 	c.Assert(err, IsNil)
 }
 
+func (s *suite) TestComposeWithBaseImage(c *C) {
+	mockServer := MockGitHubApiServer()
+	defer mockServer.Close()
+	s.repo.GithubURL = mockServer.URL
+	PrepareFiles(s.repo.Path, map[string]string{
+		"/repository/base/index.yaml": "format_version: \"1\"\n",
+		"/repository/app/index.yaml":  "base: base\n",
+	})
+	imageSize, _ := ParseImageSize("64M")
+
+	m := []struct {
+		comment    string
+		appName    string
+		filesystem string
+		base       string
+		err        string
+	}{
+		{
+			"missing base image",
+			"demo", "zfs", "missing",
+			"missing: no such base image",
+		},
+		{
+			"base image with ROFS",
+			"demo", "rofs", "base",
+			"Base images are only supported with ZFS filesystem",
+		},
+		{
+			"recomposing base image with dependents",
+			"base", "rofs", "",
+			"base: image is the base of app, remove them first",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		err := ComposePackage(s.repo, []string{}, nil, imageSize, false, false, true, s.packageDir, args.appName,
+			&BootOptions{}, args.filesystem, "osv-loader", args.base, "", nil)
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.err)
+	}
+}
+
 func (*suite) TestComposeCorruptPackageFails(c *C) {
 	// We are going to create an empty temp directory.
 	tmp, _ := ioutil.TempDir("", "pkg")
@@ -236,10 +287,10 @@ func (*suite) TestComposeCorruptPackageFails(c *C) {
 	c.Assert(err, IsNil)
 
 	repo := util.NewRepo(util.DefaultRepositoryUrl)
-	imageSize, _ := util.ParseMemSize("64M")
+	imageSize, _ := ParseImageSize("64M")
 	appName := "test-corrupt-app"
 
-	err = ComposePackage(repo, []string{}, imageSize, false, false, false, tmp, appName, &BootOptions{}, "zfs", "osv-loader")
+	err = ComposePackage(repo, []string{}, nil, imageSize, false, false, false, tmp, appName, &BootOptions{}, "zfs", "osv-loader", "", "", nil)
 	c.Assert(err, NotNil)
 }
 
@@ -293,6 +344,413 @@ func (*suite) TestFileHashing(c *C) {
 	}
 }
 
+func (s *suite) TestHashPaths(c *C) {
+	tmp := c.MkDir()
+	c.Assert(PrepareFiles(tmp, map[string]string{
+		"/unchanged":  "unchanged",
+		"/same-stat":  "same-stat",
+		"/modified":   "modified",
+		"/touched":    "touched",
+		"/chmod":      "chmod",
+		"/new":        "new",
+		"/dir/in-dir": "in-dir",
+	}), IsNil)
+	c.Assert(os.Symlink("unchanged", filepath.Join(tmp, "link")), IsNil)
+	paths, err := CollectPathContents(tmp)
+	c.Assert(err, IsNil)
+
+	imageCache, _, err := hashPaths(paths, nil)
+	c.Assert(err, IsNil)
+	// Cached entry with the same size and modification time is trusted without
+	// reading the file.
+	sameStat := imageCache["/same-stat"]
+	sameStat.Hash = "bogus"
+	imageCache["/same-stat"] = sameStat
+	// Content differs even though the size is the same.
+	c.Assert(ioutil.WriteFile(filepath.Join(tmp, "modified"), []byte("MODIFIED"), 0644), IsNil)
+	// Content is the same, only the modification time changed.
+	later := time.Now().Add(time.Hour)
+	c.Assert(os.Chtimes(filepath.Join(tmp, "touched"), later, later), IsNil)
+	// Content and modification time are the same, only the mode changed.
+	c.Assert(os.Chmod(filepath.Join(tmp, "chmod"), 0755), IsNil)
+	delete(imageCache, "/new")
+
+	// This is what we're testing here.
+	newHashes, unchanged, err := hashPaths(paths, imageCache)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(unchanged, DeepEquals, map[string]bool{
+		"/unchanged":  true,
+		"/same-stat":  true,
+		"/touched":    true,
+		"/link":       true,
+		"/dir":        true,
+		"/dir/in-dir": true,
+	})
+	c.Check(newHashes, HasLen, len(paths))
+	c.Check(newHashes["/same-stat"].Hash, Equals, "bogus")
+	c.Check(newHashes["/touched"].ModTime, Equals, later.UnixNano())
+	c.Check(newHashes["/modified"].Hash, Not(Equals), imageCache["/modified"].Hash)
+	c.Check(newHashes["/chmod"].Mode, Equals, os.FileMode(0755))
+}
+
+func (s *suite) TestHashTreeComparesMode(c *C) {
+	tree := util.NewFileTree()
+	tree.AddData("/unchanged", []byte("unchanged"), 0644, "")
+	tree.AddData("/chmod", []byte("chmod"), 0644, "")
+	imageCache, _, err := hashTree(tree, nil)
+	c.Assert(err, IsNil)
+	tree.AddData("/chmod", []byte("chmod"), 0755, "")
+
+	// This is what we're testing here.
+	newHashes, unchanged, err := hashTree(tree, imageCache)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(unchanged, DeepEquals, map[string]bool{"/unchanged": true})
+	c.Check(newHashes["/chmod"].Mode, Equals, os.FileMode(0755))
+}
+
+func (s *suite) TestHashPathsLegacyCache(c *C) {
+	tmp := c.MkDir()
+	c.Assert(PrepareFiles(tmp, map[string]string{
+		"/unchanged": "unchanged",
+		"/modified":  "modified",
+	}), IsNil)
+	paths, err := CollectPathContents(tmp)
+	c.Assert(err, IsNil)
+	imageCache := core.NewHashCache()
+	for src, dest := range paths {
+		hash, err := hashPath(src, dest)
+		c.Assert(err, IsNil)
+		imageCache[dest] = core.HashEntry{Size: -1, LegacyHash: hash}
+	}
+	c.Assert(ioutil.WriteFile(filepath.Join(tmp, "modified"), []byte("MODIFIED"), 0644), IsNil)
+
+	// This is what we're testing here.
+	newHashes, unchanged, err := hashPaths(paths, imageCache)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(unchanged, DeepEquals, map[string]bool{"/unchanged": true})
+	c.Check(newHashes["/unchanged"].LegacyHash, Equals, "")
+	c.Check(newHashes["/unchanged"].Hash, Equals, "aaa8d3c8d74ad3e8f6b1772aa9c7e0eaa528cb42fc93599ce2f125b00d4c424c")
+}
+
+func (s *suite) TestDeletedPaths(c *C) {
+	m := []struct {
+		comment  string
+		cached   []string
+		current  []string
+		expected []string
+	}{
+		{
+			"nothing deleted",
+			[]string{"/file1", "/dir1", "/dir1/file2"},
+			[]string{"/file1", "/dir1", "/dir1/file2"},
+			nil,
+		},
+		{
+			"deleted file",
+			[]string{"/file1", "/dir1", "/dir1/file2"},
+			[]string{"/dir1", "/dir1/file2"},
+			[]string{"/file1"},
+		},
+		{
+			"renamed directory",
+			[]string{"/dir1", "/dir1/file2", "/dir1/dir3", "/dir1/dir3/file3", "/dir1-file"},
+			[]string{"/dir2", "/dir2/file2", "/dir2/dir3", "/dir2/dir3/file3"},
+			[]string{"/dir1", "/dir1-file"},
+		},
+		{
+			"deleted file in kept directory",
+			[]string{"/dir1", "/dir1/file2", "/dir1/file3"},
+			[]string{"/dir1", "/dir1/file2"},
+			[]string{"/dir1/file3"},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		imageCache := core.NewHashCache()
+		for _, p := range args.cached {
+			imageCache[p] = core.HashEntry{Hash: "hash"}
+		}
+		currentPaths := make(map[string]bool)
+		for _, p := range args.current {
+			currentPaths[p] = true
+		}
+
+		// This is what we're testing here.
+		deleted := deletedPaths(imageCache, currentPaths)
+
+		// Expectations.
+		c.Check(deleted, DeepEquals, args.expected)
+	}
+}
+
+func (s *suite) TestRemoveCmdline(c *C) {
+	m := []struct {
+		comment     string
+		paths       []string
+		expected    string
+		expectedErr string
+	}{
+		{
+			"files and directories",
+			[]string{"/dir1", "/file1"},
+			"/tools/rm.so -rf /dir1 /file1",
+			"",
+		},
+		{
+			"path with a space",
+			[]string{"/dir1", "/my file"},
+			"",
+			"/my file cannot be removed on the command line of the guest",
+		},
+		{
+			"path with a semicolon",
+			[]string{"/a;b"},
+			"",
+			"/a;b cannot be removed on the command line of the guest",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		cmdline, err := removeCmdline(args.paths)
+
+		// Expectations.
+		if args.expectedErr != "" {
+			c.Assert(err, NotNil)
+			c.Check(err.Error(), Equals, args.expectedErr)
+		} else {
+			c.Assert(err, IsNil)
+			c.Check(cmdline, Equals, args.expected)
+		}
+	}
+}
+
+func (s *suite) TestUploadFilesSendsNoRemovals(c *C) {
+	tmp := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(tmp, "file1"), []byte("file1"), 0644), IsNil)
+	uploadPaths := map[string]string{
+		filepath.Join(tmp, "file1"): "/file1",
+	}
+	imageCache := core.NewHashCache()
+	imageCache["/old-dir"] = core.HashEntry{Hash: "hash"}
+	imageCache["/old-dir/file2"] = core.HashEntry{Hash: "hash"}
+
+	// This is what we're testing here.
+	var newHashes core.HashCache
+	var err error
+	entries := receiveCpioStream(c, func(conn net.Conn) error {
+		newHashes, err = uploadFiles(conn, uploadPaths, imageCache, true)
+		return err
+	})
+
+	// Expectations.
+	// Removed paths are deleted in the guest before cpiod is started, so only
+	// the content of the package is sent and they are dropped from the cache.
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].Name, Equals, "/file1")
+	c.Check(newHashes, HasLen, 1)
+}
+
+func (s *suite) TestUploadFilesPreservesMetadata(c *C) {
+	tmp := c.MkDir()
+	c.Assert(PrepareFiles(tmp, map[string]string{
+		"/bin/tool": "#!/bin/sh",
+		"/data.txt": "data",
+	}), IsNil)
+	c.Assert(os.Chmod(filepath.Join(tmp, "bin", "tool"), 0755), IsNil)
+	c.Assert(os.Chmod(filepath.Join(tmp, "bin"), 0750), IsNil)
+	mtime := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	c.Assert(os.Chtimes(filepath.Join(tmp, "data.txt"), mtime, mtime), IsNil)
+	c.Assert(os.Symlink("tool", filepath.Join(tmp, "bin", "link")), IsNil)
+	c.Assert(os.Link(filepath.Join(tmp, "data.txt"), filepath.Join(tmp, "hardlink.txt")), IsNil)
+	uploadPaths, err := CollectPathContents(tmp)
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	entries := receiveCpioStream(c, func(conn net.Conn) error {
+		_, err := uploadFiles(conn, uploadPaths, nil, true)
+		return err
+	})
+
+	// Expectations.
+	byName := make(map[string]cpioEntry)
+	for _, entry := range entries {
+		byName[entry.Name] = entry
+	}
+	c.Assert(byName, HasLen, 5)
+	c.Check(byName["/bin"].Mode, Equals, uint64(cpio.C_ISDIR|0750))
+	c.Check(byName["/bin/tool"].Mode, Equals, uint64(cpio.C_ISREG|0755))
+	c.Check(byName["/bin/tool"].data, Equals, "#!/bin/sh")
+	c.Check(byName["/bin/link"].Mode, Equals, uint64(cpio.C_ISLNK|0777))
+	c.Check(byName["/bin/link"].data, Equals, "tool")
+	c.Check(byName["/data.txt"].Mtime, Equals, mtime.Unix())
+
+	// Hard links share the inode and only one of them carries the data.
+	data, hardlink := byName["/data.txt"], byName["/hardlink.txt"]
+	c.Check(data.Ino, Equals, hardlink.Ino)
+	c.Check(data.Nlink, Equals, uint64(2))
+	c.Check(hardlink.Nlink, Equals, uint64(2))
+	c.Check(data.data+hardlink.data, Equals, "data")
+	c.Check(byName["/bin/tool"].Ino, Not(Equals), data.Ino)
+}
+
+type cpioEntry struct {
+	cpio.Header
+	data string
+}
+
+// receiveCpioStream runs send with one end of an in-process connection and
+// returns the entries of the cpio stream received on the other end, just like
+// cpiod would.
+func receiveCpioStream(c *C, send func(conn net.Conn) error) []cpioEntry {
+	host, guest := net.Pipe()
+	received := make(chan []cpioEntry)
+	go func() {
+		var entries []cpioEntry
+		reader := cpio.NewReader(guest)
+		for {
+			header, err := reader.Next()
+			if err != nil {
+				c.Check(err, Equals, io.EOF)
+				break
+			}
+			data, err := ioutil.ReadAll(reader)
+			c.Check(err, IsNil)
+			entries = append(entries, cpioEntry{Header: *header, data: string(data)})
+		}
+		io.Copy(ioutil.Discard, guest)
+		received <- entries
+	}()
+
+	err := send(host)
+	host.Close()
+	c.Assert(err, IsNil)
+	return <-received
+}
+
+func (s *suite) TestParseImageSize(c *C) {
+	m := []struct {
+		comment  string
+		size     string
+		expected ImageSize
+		err      string
+	}{
+		{"explicit", "10G", ImageSize{MB: 10240}, ""},
+		{"auto", "auto", ImageSize{Auto: true}, ""},
+		{"auto with headroom", "auto+512M", ImageSize{Auto: true, Headroom: 512}, ""},
+		{"invalid headroom", "auto+lots", ImageSize{}, "lots: unrecognized memory size"},
+		{"missing plus", "auto512M", ImageSize{}, "auto512M: expected auto or auto\\+<headroom>.*"},
+		{"invalid", "big", ImageSize{}, "big: unrecognized memory size"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		size, err := ParseImageSize(args.size)
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+		} else {
+			c.Check(err, IsNil)
+			c.Check(size, DeepEquals, args.expected)
+		}
+	}
+}
+
+func (s *suite) TestResolveImageSize(c *C) {
+	loaderPath := s.repo.ImagePath("qemu", "osv-loader")
+	c.Assert(os.MkdirAll(filepath.Dir(loaderPath), 0775), IsNil)
+	c.Assert(ioutil.WriteFile(loaderPath, make([]byte, 1<<20), 0644), IsNil)
+	contentDir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(contentDir, "big"), make([]byte, 100<<20), 0644), IsNil)
+	paths, err := CollectPathContents(contentDir)
+	c.Assert(err, IsNil)
+	required := (2<<20 + util.EstimateZfsPartitionSize(100<<20, 1) + (1 << 20) - 1) >> 20
+
+	m := []struct {
+		comment  string
+		size     ImageSize
+		expected int64
+	}{
+		{"auto", ImageSize{Auto: true}, (required + 63) / 64 * 64},
+		{"auto with headroom", ImageSize{Auto: true, Headroom: 1024}, (required + 1024 + 63) / 64 * 64},
+		{"explicit", ImageSize{MB: 10240}, 10240},
+		{"explicit too small", ImageSize{MB: 64}, 64},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		size, err := resolveImageSize(s.repo, "osv-loader", args.size, paths)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(size, Equals, args.expected)
+		c.Check(size >= required || !args.size.Auto, Equals, true)
+	}
+}
+
+func (s *suite) TestParseComposeFormats(c *C) {
+	m := []struct {
+		comment  string
+		formats  string
+		expected []string
+		err      string
+	}{
+		{"default", "qcow2", []string{"qcow2"}, ""},
+		{"multiple", "qcow2,raw,vmdk,vdi,gce-tarball", []string{"qcow2", "raw", "vmdk", "vdi", "gce-tarball"}, ""},
+		{"spaces and duplicates", " raw , RAW,vdi,", []string{"raw", "vdi"}, ""},
+		{"unsupported", "qcow2,iso", nil, "unsupported image format 'iso'.*"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		formats, err := ParseComposeFormats(args.formats)
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+		} else {
+			c.Assert(err, IsNil)
+			c.Check(formats, DeepEquals, args.expected)
+		}
+	}
+}
+
+func (s *suite) TestExportComposedImage(c *C) {
+	imagePath := prepareRofsDiskImage(c, s.packageFiles)
+	c.Assert(util.ConvertImageToQCOW2(imagePath), IsNil)
+	os.MkdirAll(filepath.Dir(s.repo.ImagePath("qemu", "demo/app")), 0775)
+	c.Assert(os.Rename(imagePath, s.repo.ImagePath("qemu", "demo/app")), IsNil)
+
+	// This is what we're testing here.
+	err := ExportComposedImage(s.repo, "demo/app", []string{"qcow2", "raw"})
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(filepath.Dir(s.repo.ImagePath("qemu", "demo/app")), DirEquals, map[string]interface{}{
+		"app.qemu": func(string) error { return nil },
+		"app.raw":  func(string) error { return nil },
+	})
+	rawPath := filepath.Join(filepath.Dir(s.repo.ImagePath("qemu", "demo/app")), "app.raw")
+	format, err := image.Probe(rawPath)
+	c.Assert(err, IsNil)
+	c.Check(format, Equals, image.RAW)
+	out := bytes.Buffer{}
+	c.Assert(ImageCat(s.repo, rawPath, "/file.txt", &out), IsNil)
+	c.Check(out.String(), Equals, DefaultText)
+}
+
 func (s *suite) TestBuildPackage(c *C) {
 	// This is what we're testing here.
 	resultFile, err := BuildPackage(s.packageDir)
@@ -321,6 +779,386 @@ func (s *suite) TestDescribePackage(c *C) {
 	c.Check(descr, MatchesMultiline, fmt.Sprintf(".*PACKAGE DOCUMENTATION\n%s\n", DefaultText))
 }
 
+func (s *suite) TestCollectPackageIntoTemporaryDir(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+
+	// This is what we're testing here.
+	targetPath, err := CollectPackage(s.repo, s.packageDir, "", []string{}, nil, nil, false, false, false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(targetPath)
+	c.Check(strings.HasPrefix(targetPath, s.packageDir), Equals, false)
+	c.Check(filepath.Join(targetPath, "file.txt"), FileMatches, DefaultText)
+	_, err = os.Stat(filepath.Join(s.packageDir, "mpm-pkg"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *suite) TestCollectPackageIntoCollectDir(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+
+	m := []struct {
+		comment    string
+		collectDir string
+		expected   string
+	}{
+		{
+			"absolute",
+			filepath.Join(s.repo.Path, "collected"), filepath.Join(s.repo.Path, "collected"),
+		},
+		{
+			"relative to package directory",
+			"out/collected", filepath.Join(s.packageDir, "out", "collected"),
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		targetPath, err := CollectPackage(s.repo, s.packageDir, args.collectDir, []string{}, nil, nil, false, false, false)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(targetPath, Equals, args.expected)
+		c.Check(filepath.Join(targetPath, "file.txt"), FileMatches, DefaultText)
+		// The collect directory itself must not be collected.
+		_, err = os.Stat(filepath.Join(targetPath, "out", "collected"))
+		c.Check(os.IsNotExist(err), Equals, true)
+	}
+}
+
+func (s *suite) TestCollectPackageRefusesPackageDir(c *C) {
+	for _, collectDir := range []string{".", "..", s.packageDir} {
+		// This is what we're testing here.
+		_, err := CollectPackage(s.repo, s.packageDir, collectDir, []string{}, nil, nil, false, false, false)
+
+		// Expectations.
+		c.Check(err, ErrorMatches, "Collect directory .* must not contain the package directory")
+		c.Check(filepath.Join(s.packageDir, "file.txt"), FileMatches, DefaultText)
+	}
+}
+
+func (s *suite) TestCollectPackageWithManifest(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	hostDir := c.MkDir()
+	PrepareFiles(hostDir, map[string]string{
+		"/lib/libfoo.so":    "foo",
+		"/jdk/bin/java":     "java",
+		"/jdk/lib/rt.jar":   "rt",
+		"/config/file.txt":  "from host",
+		"/config/other.txt": "other",
+	})
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/manifest.yaml": FixIndent(`
+			/usr/lib/libfoo.so: ` + hostDir + `/lib/&
+			/usr/lib/jvm/java: ` + hostDir + `/jdk
+			/: ` + hostDir + `/config/*.txt
+		`),
+	})
+
+	// This is what we're testing here.
+	targetPath, err := CollectPackage(s.repo, s.packageDir, "", []string{}, nil, nil, false, false, false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(targetPath)
+	c.Check(filepath.Join(targetPath, "usr", "lib", "libfoo.so"), FileMatches, "foo")
+	c.Check(filepath.Join(targetPath, "usr", "lib", "jvm", "java", "bin", "java"), FileMatches, "java")
+	c.Check(filepath.Join(targetPath, "usr", "lib", "jvm", "java", "lib", "rt.jar"), FileMatches, "rt")
+	c.Check(filepath.Join(targetPath, "other.txt"), FileMatches, "other")
+	// Files mapped by the manifest override the files of the package.
+	c.Check(filepath.Join(targetPath, "file.txt"), FileMatches, "from host")
+}
+
+func (s *suite) TestCollectPackageRendersTemplates(c *C) {
+	m := []struct {
+		comment  string
+		values   map[string]interface{}
+		expected string
+	}{
+		{
+			"package defaults",
+			nil,
+			"host=localhost port=8000 heap=512m",
+		},
+		{
+			"values override defaults",
+			map[string]interface{}{"host": "example.com", "port": "9000"},
+			"host=example.com port=9000 heap=512m",
+		},
+		{
+			"nested values",
+			map[string]interface{}{"jvm": map[interface{}]interface{}{"heap": "2g"}},
+			"host=localhost port=8000 heap=2g",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare.
+		s.SetUpTest(c)
+		s.importFakeOSvBootstrapPkg(c)
+		PrepareFiles(s.packageDir, map[string]string{
+			"/meta/package.yaml": FixIndent(`
+				name: package-name
+				title: PackageTitle
+				author: package-author
+				templates:
+				  - /etc/app.conf
+				values:
+				  host: localhost
+				  port: 8000
+				  jvm:
+				    heap: 512m
+			`),
+			"/etc/app.conf": "host={{.host}} port={{.port}} heap={{.jvm.heap}}",
+		})
+
+		// This is what we're testing here.
+		targetPath, err := CollectPackage(s.repo, s.packageDir, "", []string{}, nil, args.values, false, false, false)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(filepath.Join(targetPath, "etc", "app.conf"), FileMatches, "^"+args.expected+"$")
+		c.Check(filepath.Join(s.packageDir, "etc", "app.conf"), FileMatches, "host=\\{\\{\\.host\\}\\}.*")
+		os.RemoveAll(targetPath)
+	}
+}
+
+func (s *suite) TestCollectPackageTemplateErrors(c *C) {
+	m := []struct {
+		comment   string
+		templates string
+		err       string
+	}{
+		{"undefined value", "/etc/app.conf", ".*/etc/app.conf.*map has no entry for key \"port\""},
+		{"missing template", "/etc/missing.conf", "template /etc/missing.conf does not exist in the collected package"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare.
+		s.SetUpTest(c)
+		s.importFakeOSvBootstrapPkg(c)
+		PrepareFiles(s.packageDir, map[string]string{
+			"/meta/package.yaml": FixIndent(`
+				name: package-name
+				title: PackageTitle
+				author: package-author
+				templates:
+				  - ` + args.templates + `
+			`),
+			"/etc/app.conf": "port={{.port}}",
+		})
+
+		// This is what we're testing here.
+		_, err := CollectPackage(s.repo, s.packageDir, "", []string{}, nil, map[string]interface{}{"host": "localhost"},
+			false, false, false)
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.err)
+	}
+}
+
+func (s *suite) TestCollectPackageExcludesDependencyFiles(c *C) {
+	m := []struct {
+		comment  string
+		exclude  string
+		flag     []string
+		excluded []string
+		kept     []string
+	}{
+		{
+			"exclude list of the package",
+			"exclude: [/data]",
+			nil,
+			[]string{"/data/osv-bootstrap-data-file.txt", "/data/fake-demo-data-file.txt"},
+			[]string{"/data/data-file.txt", "/osv-bootstrap-file.txt", "/fake-demo-file.txt"},
+		},
+		{
+			"exclude flag",
+			"",
+			[]string{"/*-file.txt"},
+			[]string{"/osv-bootstrap-file.txt", "/fake-demo-file.txt"},
+			[]string{"/file.txt", "/data/osv-bootstrap-data-file.txt", "/data/fake-demo-data-file.txt"},
+		},
+		{
+			"pattern matching at all levels",
+			"exclude: ['/**/fake-*']",
+			nil,
+			[]string{"/data/fake-demo-data-file.txt", "/fake-demo-file.txt"},
+			[]string{"/data/osv-bootstrap-data-file.txt", "/data/data-file.txt"},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare.
+		s.SetUpTest(c)
+		s.importFakeOSvBootstrapPkg(c)
+		s.importFakeDemoPkg(c)
+		PrepareFiles(s.packageDir, map[string]string{
+			"/meta/package.yaml": "name: package-name\ntitle: PackageTitle\nauthor: package-author\n" +
+				"require: [fake.demo]\n" + args.exclude + "\n",
+		})
+
+		// This is what we're testing here.
+		targetPath, err := CollectPackage(s.repo, s.packageDir, "", []string{}, args.flag, nil, false, false, false)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		for _, filePath := range args.excluded {
+			_, err := os.Stat(filepath.Join(targetPath, filePath))
+			c.Check(os.IsNotExist(err), Equals, true, Commentf(filePath))
+		}
+		for _, filePath := range args.kept {
+			_, err := os.Stat(filepath.Join(targetPath, filePath))
+			c.Check(err, IsNil, Commentf(filePath))
+		}
+		os.RemoveAll(targetPath)
+	}
+}
+
+func (s *suite) TestCollectPackageExcludesHardLinkTarget(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importFakeDemoPkg(c)
+	s.requireFakeDemoPkg(c)
+	// Replace the archive of fake.demo with one holding a hard-linked library.
+	buf := bytes.Buffer{}
+	w := tar.NewWriter(&buf)
+	c.Assert(w.WriteHeader(&tar.Header{Name: "lib/libdemo.so.1", Mode: 0644, Typeflag: tar.TypeReg,
+		Size: int64(len(DefaultText))}), IsNil)
+	_, err := w.Write([]byte(DefaultText))
+	c.Assert(err, IsNil)
+	c.Assert(w.WriteHeader(&tar.Header{Name: "lib/libdemo.so", Mode: 0644, Typeflag: tar.TypeLink,
+		Linkname: "lib/libdemo.so.1"}), IsNil)
+	c.Assert(w.Close(), IsNil)
+	c.Assert(ioutil.WriteFile(s.repo.PackagePath("fake.demo"), buf.Bytes(), 0644), IsNil)
+
+	// This is what we're testing here.
+	targetPath, err := CollectPackage(s.repo, s.packageDir, "", []string{}, []string{"/lib/libdemo.so.1"}, nil,
+		false, false, false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(targetPath)
+	_, err = os.Stat(filepath.Join(targetPath, "lib", "libdemo.so.1"))
+	c.Check(os.IsNotExist(err), Equals, true)
+	c.Check(filepath.Join(targetPath, "lib", "libdemo.so"), FileMatches, DefaultText)
+}
+
+func (s *suite) TestCollectPackageNestedCapstanignore(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/.capstanignore":      "*.log\nbuild/\n",
+		"/logs/.capstanignore": "!keep.log\n",
+		"/logs/keep.log":       DefaultText,
+		"/logs/other.log":      DefaultText,
+		"/app.log":             DefaultText,
+		"/build/out.o":         DefaultText,
+		"/src/build":           DefaultText,
+		"/src/.capstanignore":  "/main.c\n",
+		"/src/main.c":          DefaultText,
+		"/src/util/main.c":     DefaultText,
+	})
+
+	// This is what we're testing here.
+	targetPath, err := CollectPackage(s.repo, s.packageDir, "", []string{}, nil, nil, false, false, false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(targetPath)
+	for _, filePath := range []string{"/app.log", "/logs/other.log", "/build", "/src/main.c",
+		"/.capstanignore", "/logs/.capstanignore", "/src/.capstanignore"} {
+		_, err := os.Stat(filepath.Join(targetPath, filePath))
+		c.Check(os.IsNotExist(err), Equals, true, Commentf(filePath))
+	}
+	for _, filePath := range []string{"/logs/keep.log", "/src/build", "/src/util/main.c"} {
+		c.Check(filepath.Join(targetPath, filePath), FileMatches, DefaultText, Commentf(filePath))
+	}
+}
+
+func (s *suite) TestCollectPackageIgnoresProjectFile(c *C) {
+	m := []struct {
+		comment         string
+		content         string
+		expectedIgnored bool
+	}{
+		{
+			"project file",
+			"images:\n  - name: demo\n",
+			true,
+		},
+		{
+			"other file of the same name",
+			"key: value\n",
+			false,
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare
+		s.SetUpTest(c)
+		s.importFakeOSvBootstrapPkg(c)
+		PrepareFiles(s.packageDir, map[string]string{
+			"/capstan.yaml": args.content,
+		})
+
+		// This is what we're testing here.
+		targetPath, err := CollectPackage(s.repo, s.packageDir, "", []string{}, nil, nil, false, false, false)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		_, err = os.Stat(filepath.Join(targetPath, "capstan.yaml"))
+		c.Check(os.IsNotExist(err), Equals, args.expectedIgnored)
+		os.RemoveAll(targetPath)
+	}
+}
+
+func (s *suite) TestExclusionsReferencedByBootCommands(c *C) {
+	tree := util.NewFileTree()
+	tree.AddData("/usr/lib/app.jar", []byte("app"), 0644, "package-name")
+	excluded, err := newExclusions([]string{"/usr/lib/*", "/docs"}, false, os.Stdout)
+	c.Assert(err, IsNil)
+	for _, filePath := range []string{"usr/lib/app.jar", "usr/lib/tool.so", "docs/index.html", "bin/run.so"} {
+		excluded.exclude(filePath, "fake.demo")
+	}
+
+	// This is what we're testing here.
+	warnings := excluded.referenced(tree, map[string]string{
+		"tool":  "/usr/lib/tool.so --docs=/docs/index.html",
+		"app":   "java.so -cp /usr/lib/app.jar:/usr/lib/tool.so Main",
+		"other": "/bin/run.so",
+	})
+
+	// Expectations.
+	c.Check(warnings, DeepEquals, []string{
+		"boot command of config set 'app' refers to /usr/lib/tool.so, which is excluded from package fake.demo",
+		"boot command of config set 'tool' refers to /usr/lib/tool.so, which is excluded from package fake.demo",
+		"boot command of config set 'tool' refers to /docs/index.html, which is excluded from package fake.demo",
+	})
+}
+
+func (s *suite) TestTemplateValues(c *C) {
+	valuesFile := filepath.Join(c.MkDir(), "values.yaml")
+	PrepareFiles(filepath.Dir(valuesFile), map[string]string{
+		"/values.yaml": "host: example.com\nport: 9000\n",
+	})
+
+	// This is what we're testing here.
+	values, err := TemplateValues(valuesFile, []string{"port=9001", "debug=true"})
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(values, DeepEquals, map[string]interface{}{"host": "example.com", "port": "9001", "debug": "true"})
+}
+
 func (s *suite) TestRecursiveRunYamls(c *C) {
 	// Prepare.
 	s.importFakeOSvBootstrapPkg(c)
@@ -328,7 +1166,7 @@ func (s *suite) TestRecursiveRunYamls(c *C) {
 	s.requireFakeDemoPkg(c)
 
 	// This is what we're testing here.
-	err := CollectPackage(s.repo, s.packageDir, []string{}, false, false, false)
+	_, err := CollectPackage(s.repo, s.packageDir, "mpm-pkg", []string{}, nil, nil, false, false, false)
 
 	// Expectations.
 	c.Assert(err, IsNil)
@@ -352,7 +1190,7 @@ func (s *suite) TestRecursiveRunYamlsWithOwnRunYaml(c *C) {
 	`, c)
 
 	// This is what we're testing here.
-	err := CollectPackage(s.repo, s.packageDir, []string{}, false, false, false)
+	_, err := CollectPackage(s.repo, s.packageDir, "mpm-pkg", []string{}, nil, nil, false, false, false)
 
 	// Expectations.
 	c.Assert(err, IsNil)
@@ -377,7 +1215,7 @@ func (s *suite) TestRecursiveRunYamlsWithOwnRunYamlOverwrite(c *C) {
 	`, c)
 
 	// This is what we're testing here.
-	err := CollectPackage(s.repo, s.packageDir, []string{}, false, false, false)
+	_, err := CollectPackage(s.repo, s.packageDir, "mpm-pkg", []string{}, nil, nil, false, false, false)
 
 	// Expectations.
 	c.Assert(err, IsNil)
@@ -408,7 +1246,7 @@ func (s *suite) TestRecursiveRunYamlsWithOwnRunYamlEnv(c *C) {
 	`, c)
 
 	// This is what we're testing here.
-	err := CollectPackage(s.repo, s.packageDir, []string{}, false, false, false)
+	_, err := CollectPackage(s.repo, s.packageDir, "mpm-pkg", []string{}, nil, nil, false, false, false)
 
 	// Expectations.
 	c.Assert(err, IsNil)
@@ -594,7 +1432,7 @@ func (s *suite) TestRuntimeInheritance(c *C) {
 		s.setRunYaml(args.runYamlText, c)
 
 		// This is what we're testing here.
-		err := CollectPackage(s.repo, s.packageDir, []string{}, false, false, false)
+		_, err := CollectPackage(s.repo, s.packageDir, "mpm-pkg", []string{}, nil, nil, false, false, false)
 
 		// Expectations.
 		c.Assert(err, IsNil)
@@ -671,7 +1509,7 @@ func (s *suite) TestRuntimeInheritInvalid(c *C) {
 		s.setRunYaml(args.runYamlText, c)
 
 		// This is what we're testing here.
-		err := CollectPackage(s.repo, s.packageDir, []string{}, false, false, false)
+		_, err := CollectPackage(s.repo, s.packageDir, "mpm-pkg", []string{}, nil, nil, false, false, false)
 
 		// Expectations.
 		c.Assert(err, NotNil)
@@ -854,7 +1692,7 @@ func (s *suite) TestRuntimeInheritanceTwoLevels(c *C) {
 		s.setRunYaml(args.runYamlText, c)
 
 		// This is what we're testing here.
-		err := CollectPackage(s.repo, s.packageDir, []string{}, false, false, false)
+		_, err := CollectPackage(s.repo, s.packageDir, "mpm-pkg", []string{}, nil, nil, false, false, false)
 
 		// Expectations.
 		c.Assert(err, IsNil)
@@ -994,7 +1832,7 @@ func (s *suite) TestImplicitlyRequiredPackages(c *C) {
 		// Prepare
 
 		// This is what we're testing here.
-		err := CollectPackage(s.repo, s.packageDir, []string{}, false, args.remote, false)
+		_, err := CollectPackage(s.repo, s.packageDir, "mpm-pkg", []string{}, nil, nil, false, args.remote, false)
 
 		// Expectations.
 		c.Assert(err, IsNil)
@@ -1002,6 +1840,210 @@ func (s *suite) TestImplicitlyRequiredPackages(c *C) {
 	}
 }
 
+func (s *suite) TestCollectPackageBinaries(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importFakeToolsPkg(c)
+	packageYamlText := FixIndent(`
+		name: package-name
+		title: PackageTitle
+		author: package-author
+		require:
+		  - fake.tools
+		binary:
+		  mytool: /file.txt
+	`)
+	ioutil.WriteFile(filepath.Join(s.packageDir, "meta", "package.yaml"), []byte(packageYamlText), 0700)
+	s.setRunYaml(`
+		runtime: native
+		config_set:
+		  othertool:
+		    bootcmd: echo other
+	`, c)
+
+	// This is what we're testing here.
+	_, err := CollectPackage(s.repo, s.packageDir, "mpm-pkg", []string{}, nil, nil, false, false, false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	expectedBoots := map[string]interface{}{
+		"tool":      "/usr/lib/tool.so",
+		"mytool":    "/file.txt",
+		"othertool": "echo other",
+	}
+	c.Check(filepath.Join(s.packageDir, "mpm-pkg", "run"), DirEquals, expectedBoots)
+
+	binaries, err := readCollectedBinaries(filepath.Join(s.packageDir, "mpm-pkg"))
+	c.Assert(err, IsNil)
+	c.Check(binaries, DeepEquals, map[string]string{
+		"tool":          "/usr/lib/tool.so",
+		"othertool":     "/usr/lib/other.so",
+		"/usr/bin/tool": "/usr/lib/tool.so",
+		"mytool":        "/file.txt",
+	})
+}
+
+func (s *suite) TestSaveImageBinariesClearsRemovedAliases(c *C) {
+	// Prepare.
+	c.Assert(os.MkdirAll(filepath.Dir(s.repo.ImageIndexPath("demo")), 0775), IsNil)
+	err := s.repo.WriteImageInfo("demo", &util.ImageInfo{Binary: map[string]string{"mytool": "/file.txt"}})
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	err = saveImageBinaries(s.repo, "demo", map[string]string{})
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	info, err := s.repo.ReadImageInfo("demo")
+	c.Assert(err, IsNil)
+	c.Check(info.Binary, IsNil)
+	data, _ := ioutil.ReadFile(s.repo.ImageIndexPath("demo"))
+	c.Check(string(data), Not(Matches), "(?s).*binary.*")
+}
+
+func (s *suite) TestCollectPackageBinaryMissingTarget(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	packageYamlText := FixIndent(`
+		name: package-name
+		title: PackageTitle
+		author: package-author
+		binary:
+		  mytool: /usr/lib/missing.so
+	`)
+	ioutil.WriteFile(filepath.Join(s.packageDir, "meta", "package.yaml"), []byte(packageYamlText), 0700)
+
+	// This is what we're testing here.
+	_, err := CollectPackage(s.repo, s.packageDir, "mpm-pkg", []string{}, nil, nil, false, false, false)
+
+	// Expectations.
+	c.Assert(err, ErrorMatches, "binary 'mytool' points to /usr/lib/missing.so which does not exist.*")
+}
+
+func (s *suite) TestComposeRofsFromPackageArchives(c *C) {
+	// Prepare.
+	mockServer := MockGitHubApiServer()
+	defer mockServer.Close()
+	s.repo.GithubURL = mockServer.URL
+	s.importFakeOSvBootstrapPkg(c)
+	s.importFakeDemoPkg(c)
+	s.requireFakeDemoPkg(c)
+	s.setRunYaml(`
+		runtime: native
+		config_set:
+		  demoBoot1:
+		    bootcmd: echo MyBoot
+	`, c)
+	PrepareFiles(s.packageDir, map[string]string{"/data/fake-demo-data-file.txt": "overridden"})
+	imageSize, _ := ParseImageSize("64M")
+
+	for _, update := range []bool{false, true} {
+		c.Logf("update: %t", update)
+
+		// This is what we're testing here.
+		err := ComposePackage(s.repo, []string{}, nil, imageSize, update, false, false, s.packageDir, "demo",
+			&BootOptions{}, "rofs", "osv-loader", "", "", nil)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		for filePath, expected := range map[string]string{
+			"/fake-demo-file.txt":           DefaultText,
+			"/data/fake-demo-data-file.txt": "overridden",
+			"/run/demoBoot1":                "echo MyBoot",
+			"/run/demoBoot2":                "echo Demo2",
+		} {
+			out := bytes.Buffer{}
+			c.Assert(ImageCat(s.repo, "demo", filePath, &out), IsNil)
+			c.Check(out.String(), Equals, expected, Commentf(filePath))
+		}
+		out := bytes.Buffer{}
+		c.Check(ImageCat(s.repo, "demo", "/meta/run.yaml", &out), NotNil)
+
+		cache, err := core.ParseHashCache(s.repo.ImageRofsCachePath("qemu", "demo"))
+		c.Assert(err, IsNil)
+		c.Check(cache["/fake-demo-file.txt"].Hash, Not(Equals), "")
+	}
+	_, err := os.Stat(filepath.Join(s.packageDir, "mpm-pkg"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *suite) TestComposeRofsUpdateIgnoresZfsCache(c *C) {
+	// Prepare.
+	mockServer := MockGitHubApiServer()
+	defer mockServer.Close()
+	s.repo.GithubURL = mockServer.URL
+	s.importFakeOSvBootstrapPkg(c)
+	imageSize, _ := ParseImageSize("64M")
+	err := ComposePackage(s.repo, []string{}, nil, imageSize, false, false, false, s.packageDir, "demo",
+		&BootOptions{}, "rofs", "osv-loader", "", "", nil)
+	c.Assert(err, IsNil)
+	// Simulate ZFS compose of the changed content that overwrites the cache
+	// of the ZFS image, but leaves the ROFS partition of the previous compose.
+	PrepareFiles(s.packageDir, map[string]string{"/file.txt": "changed"})
+	err = ComposePackage(s.repo, []string{}, nil, imageSize, false, false, false, s.packageDir, "other",
+		&BootOptions{}, "rofs", "osv-loader", "", "", nil)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(s.repo.ImageRofsCachePath("qemu", "other"))
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(s.repo.ImageCachePath("qemu", "demo"), data, 0644), IsNil)
+
+	// This is what we're testing here.
+	err = ComposePackage(s.repo, []string{}, nil, imageSize, true, false, false, s.packageDir, "demo",
+		&BootOptions{}, "rofs", "osv-loader", "", "", nil)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	out := bytes.Buffer{}
+	c.Assert(ImageCat(s.repo, "demo", "/file.txt", &out), IsNil)
+	c.Check(out.String(), Equals, "changed")
+}
+
+func (s *suite) TestResolveBinaryAlias(c *C) {
+	binaries := map[string]string{
+		"tool":          "/usr/lib/tool.so",
+		"/usr/bin/tool": "/usr/lib/tool.so",
+	}
+
+	m := []struct {
+		comment  string
+		command  string
+		expected string
+	}{
+		{"no alias", "/other.so --arg", "/other.so --arg"},
+		{"alias", "tool", "/usr/lib/tool.so"},
+		{"alias with args", "tool --verbose tool", "/usr/lib/tool.so --verbose tool"},
+		{"path alias", "/usr/bin/tool -x", "/usr/lib/tool.so -x"},
+		{"alias after env", "--env=A=tool --env=B=1 tool -x", "--env=A=tool --env=B=1 /usr/lib/tool.so -x"},
+		{"alias after single-dash option", "-v tool -x", "-v /usr/lib/tool.so -x"},
+		{"alias followed by another command", "tool;/other.so", "/usr/lib/tool.so;/other.so"},
+		{"alias only as argument", "/other.so tool", "/other.so tool"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		cmd := ResolveBinaryAlias(args.command, binaries)
+
+		// Expectations.
+		c.Check(cmd, Equals, args.expected)
+	}
+}
+
+func (s *suite) TestDescribePackageBinaries(c *C) {
+	// Prepare
+	s.importFakeToolsPkg(c)
+
+	// This is what we're testing here.
+	descr, err := DescribePackage(s.repo, "fake.tools", false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(descr, MatchesMultiline, "(?s).*exported binaries:\n"+
+		"   \\* /usr/bin/tool -> /usr/lib/tool.so\n"+
+		"   \\* othertool -> /usr/lib/other.so\n"+
+		"   \\* tool -> /usr/lib/tool.so\n.*")
+}
+
 //
 // Utility
 //
@@ -1064,6 +2106,24 @@ func (s *suite) importFakeDemoPkg(c *C) {
 	s.importPkg(files, c)
 }
 
+func (s *suite) importFakeToolsPkg(c *C) {
+	packageYamlText := FixIndent(`
+		name: fake.tools
+		title: Fake Tools
+		author: Tools Author
+		binary:
+		  tool: /usr/lib/tool.so
+		  othertool: /usr/lib/other.so
+		  /usr/bin/tool: /usr/lib/tool.so
+	`)
+	files := map[string]string{
+		"/meta/package.yaml": packageYamlText,
+		"/usr/lib/tool.so":   DefaultText,
+		"/usr/lib/other.so":  DefaultText,
+	}
+	s.importPkg(files, c)
+}
+
 func (s *suite) importFakeDemoPkgWithRunYaml(runYamlText string, c *C) {
 	packageYamlText := FixIndent(`
 		name: fake.demo
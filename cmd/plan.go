@@ -0,0 +1,234 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/cloudius-systems/capstan/core"
+	"github.com/cloudius-systems/capstan/util"
+)
+
+// Actions of the files in the compose plan.
+const (
+	PlanUpload = "upload"
+	PlanUpdate = "update"
+	PlanSkip   = "skip"
+	PlanDelete = "delete"
+)
+
+// ComposePlan describes what `capstan package compose` would do, without
+// doing any of it (see PlanCompose).
+type ComposePlan struct {
+	Image       string           `json:"image"`
+	ImagePath   string           `json:"image_path"`
+	Filesystem  string           `json:"filesystem"`
+	LoaderImage string           `json:"loader_image"`
+	BaseImage   string           `json:"base_image,omitempty"`
+	Update      bool             `json:"update"`
+	CommandLine string           `json:"command_line"`
+	Packages    []PlannedPackage `json:"packages"`
+	Files       []PlannedFile    `json:"files"`
+	// TotalSize is the size of all regular files in the image, while
+	// UploadSize only counts the files that are uploaded or updated.
+	TotalSize  int64 `json:"total_size"`
+	UploadSize int64 `json:"upload_size"`
+}
+
+// PlannedPackage is a package the image is composed of.
+type PlannedPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+// PlannedFile is a path in the image along with the action compose would take
+// for it. Paths in the hash cache of the image that are no longer part of the
+// content are deleted.
+type PlannedFile struct {
+	Path    string `json:"path"`
+	Action  string `json:"action"`
+	Size    int64  `json:"size"`
+	Package string `json:"package,omitempty"`
+}
+
+// PlanCompose resolves the package just like ComposePackage, but only returns
+// the plan of the compose instead of creating the image. Files are compared
+// against the hash cache the compose would use, so the plan tells which of
+// them would be uploaded, updated or skipped. Nothing is written and packages
+// missing from the local repository are not pulled. Progress messages are
+// written to out, so that they can be kept apart from the plan itself.
+func PlanCompose(repo *util.Repo, extraDependencies []string, exclude []string, updatePackage, verbose bool, packageDir, appName string,
+	bootOpts *BootOptions, filesystem string, loaderImage string, baseImage string,
+	values map[string]interface{}, out io.Writer) (*ComposePlan, error) {
+
+	if err := repo.CheckNoDependents(appName); err != nil {
+		return nil, err
+	}
+	if baseImage != "" && filesystem != "zfs" {
+		return nil, fmt.Errorf("Base images are only supported with ZFS filesystem")
+	}
+
+	extraDependencies, err := withBasePackages(repo, baseImage, extraDependencies)
+	if err != nil {
+		return nil, err
+	}
+	tree, binaries, packages, err := collectPackageTree(repo, packageDir, "", extraDependencies, exclude, values, false, false, verbose, out)
+	if err != nil {
+		return nil, err
+	}
+
+	bootOpts.Binaries = binaries
+	commandLine, err := bootOpts.getCmd(out)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &ComposePlan{
+		Image:       appName,
+		ImagePath:   repo.ImagePath("qemu", appName),
+		Filesystem:  filesystem,
+		LoaderImage: loaderImage,
+		BaseImage:   baseImage,
+		CommandLine: commandLine,
+	}
+	for _, pkg := range packages {
+		plan.Packages = append(plan.Packages, PlannedPackage{Name: pkg.Name, Version: pkg.Version})
+	}
+
+	imageCache, err := planImageCache(repo, plan, updatePackage)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hashes of the files in package archives are only known once their data
+	// is read, which is needed to tell whether they have changed.
+	if len(imageCache) > 0 {
+		err := tree.StreamData(func(node *util.FileNode) bool {
+			_, cached := imageCache[node.Path]
+			return cached && node.HostPath() == "" && node.Hash == ""
+		}, func(nodes []*util.FileNode, data io.Reader) error {
+			_, err := io.Copy(ioutil.Discard, data)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, unchanged, err := hashTree(tree, imageCache)
+	if err != nil {
+		return nil, err
+	}
+
+	currentPaths := make(map[string]bool)
+	tree.Walk(func(node *util.FileNode) error {
+		currentPaths[node.Path] = true
+		file := PlannedFile{Path: node.Path, Action: PlanUpload, Package: node.Source}
+		if node.IsRegular() {
+			file.Size = node.Size
+			plan.TotalSize += node.Size
+		}
+		if unchanged[node.Path] {
+			file.Action = PlanSkip
+		} else if _, cached := imageCache[node.Path]; cached {
+			file.Action = PlanUpdate
+		}
+		if file.Action != PlanSkip {
+			plan.UploadSize += file.Size
+		}
+		plan.Files = append(plan.Files, file)
+		return nil
+	})
+	// Only paths of the image being updated are removed, an overlay image
+	// keeps the content of its base image.
+	if plan.Update {
+		for _, deleted := range deletedPaths(imageCache, currentPaths) {
+			plan.Files = append(plan.Files, PlannedFile{Path: deleted, Action: PlanDelete})
+		}
+	}
+
+	return plan, nil
+}
+
+// planImageCache returns the hash cache the files would be compared against
+// and sets whether the existing image would be updated. It follows the same
+// rules as composeContent.
+func planImageCache(repo *util.Repo, plan *ComposePlan, updatePackage bool) (core.HashCache, error) {
+	imageExists := false
+	if _, err := os.Stat(plan.ImagePath); err == nil {
+		imageExists = true
+	}
+
+	if plan.Filesystem != "zfs" {
+		if !updatePackage || !imageExists {
+			return nil, nil
+		}
+		// Without the cache nothing would be reused from the image.
+		imageCache, err := core.ParseHashCache(repo.ImageRofsCachePath("qemu", plan.Image))
+		if err != nil {
+			return nil, nil
+		}
+		plan.Update = true
+		return imageCache, nil
+	}
+
+	if plan.BaseImage != "" && !(updatePackage && imageExists && isOverlayOf(repo, plan.Image, plan.BaseImage)) {
+		imageCache, err := core.ParseHashCache(repo.ImageCachePath("qemu", plan.BaseImage))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read file cache of base image %s.\nError was: %s", plan.BaseImage, err)
+		}
+		return imageCache, nil
+	} else if !updatePackage || !imageExists {
+		return nil, nil
+	}
+
+	plan.Update = true
+	imageCache, _ := core.ParseHashCache(repo.ImageCachePath("qemu", plan.Image))
+	return imageCache, nil
+}
+
+// String returns the plan in a human readable form.
+func (p *ComposePlan) String() string {
+	b := bytes.Buffer{}
+	fmt.Fprintf(&b, "%-16s %s\n", "Image:", p.Image)
+	fmt.Fprintf(&b, "%-16s %s\n", "Target path:", p.ImagePath)
+	fmt.Fprintf(&b, "%-16s %s\n", "Filesystem:", p.Filesystem)
+	fmt.Fprintf(&b, "%-16s %s\n", "Loader image:", p.LoaderImage)
+	if p.BaseImage != "" {
+		fmt.Fprintf(&b, "%-16s %s\n", "Base image:", p.BaseImage)
+	}
+	fmt.Fprintf(&b, "%-16s %t\n", "Update:", p.Update)
+	fmt.Fprintf(&b, "%-16s %s\n", "Command line:", p.CommandLine)
+
+	fmt.Fprintln(&b, "Packages:")
+	for _, pkg := range p.Packages {
+		version := pkg.Version
+		if version == "" {
+			version = "-"
+		}
+		fmt.Fprintf(&b, "  %-40s %s\n", pkg.Name, version)
+	}
+
+	fmt.Fprintln(&b, "Files:")
+	counts := make(map[string]int)
+	for _, file := range p.Files {
+		counts[file.Action]++
+		fmt.Fprintf(&b, "  %-7s %12d %s\n", file.Action, file.Size, file.Path)
+	}
+
+	fmt.Fprintf(&b, "%-16s %s\n", "Total size:", formatSize(p.TotalSize))
+	fmt.Fprintf(&b, "%-16s %s\n", "Upload size:", formatSize(p.UploadSize))
+	fmt.Fprintf(&b, "%-16s %d to upload, %d to update, %d unchanged, %d to delete\n", "Summary:",
+		counts[PlanUpload], counts[PlanUpdate], counts[PlanSkip], counts[PlanDelete])
+
+	return b.String()
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudius-systems/capstan/core"
+	. "github.com/cloudius-systems/capstan/testing"
+	. "gopkg.in/check.v1"
+)
+
+// plannedActions returns the planned action of every path.
+func plannedActions(plan *ComposePlan) map[string]string {
+	actions := make(map[string]string)
+	for _, file := range plan.Files {
+		actions[file.Path] = file.Action
+	}
+	return actions
+}
+
+func (s *suite) TestPlanComposeNewImage(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importFakeDemoPkg(c)
+	s.requireFakeDemoPkg(c)
+
+	var progress bytes.Buffer
+
+	// This is what we're testing here.
+	plan, err := PlanCompose(s.repo, []string{}, nil, false, false, s.packageDir, "demo",
+		&BootOptions{Cmd: "/file.txt"}, "rofs", "osv-loader", "", nil, &progress)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(plan.ImagePath, Equals, s.repo.ImagePath("qemu", "demo"))
+	c.Check(plan.Filesystem, Equals, "rofs")
+	c.Check(plan.LoaderImage, Equals, "osv-loader")
+	c.Check(plan.Update, Equals, false)
+	c.Check(plan.CommandLine, Equals, "/file.txt")
+	c.Check(plan.Packages, DeepEquals, []PlannedPackage{{Name: "osv.bootstrap"}, {Name: "fake.demo"}, {Name: "package-name"}})
+
+	actions := plannedActions(plan)
+	c.Check(actions["/file.txt"], Equals, PlanUpload)
+	c.Check(actions["/fake-demo-file.txt"], Equals, PlanUpload)
+	c.Check(actions["/run/demoBoot1"], Equals, PlanUpload)
+	for _, file := range plan.Files {
+		if file.Path == "/fake-demo-file.txt" {
+			c.Check(file.Package, Equals, "fake.demo")
+			c.Check(file.Size, Equals, int64(len(DefaultText)))
+		}
+	}
+	c.Check(plan.UploadSize, Equals, plan.TotalSize)
+	c.Check(progress.String(), Matches, "(?s).*Adding package fake.demo\n.*")
+
+	// Nothing must have been written.
+	_, err = os.Stat(filepath.Dir(plan.ImagePath))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *suite) TestPlanComposeUpdate(c *C) {
+	// Prepare.
+	mockServer := MockGitHubApiServer()
+	defer mockServer.Close()
+	s.repo.GithubURL = mockServer.URL
+	s.importFakeOSvBootstrapPkg(c)
+	s.importFakeDemoPkg(c)
+	s.requireFakeDemoPkg(c)
+	imageSize, _ := ParseImageSize("64M")
+	err := ComposePackage(s.repo, []string{}, nil, imageSize, false, false, false, s.packageDir, "demo",
+		&BootOptions{}, "rofs", "osv-loader", "", "", nil)
+	c.Assert(err, IsNil)
+	PrepareFiles(s.packageDir, map[string]string{"/file.txt": "changed"})
+	c.Assert(os.RemoveAll(filepath.Join(s.packageDir, "data")), IsNil)
+
+	// This is what we're testing here.
+	plan, err := PlanCompose(s.repo, []string{}, nil, true, false, s.packageDir, "demo",
+		&BootOptions{}, "rofs", "osv-loader", "", nil, ioutil.Discard)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(plan.Update, Equals, true)
+	actions := plannedActions(plan)
+	c.Check(actions["/file.txt"], Equals, PlanUpdate)
+	c.Check(actions["/fake-demo-file.txt"], Equals, PlanSkip)
+	c.Check(actions["/data/data-file.txt"], Equals, PlanDelete)
+	c.Check(plan.UploadSize < plan.TotalSize, Equals, true)
+}
+
+func (s *suite) TestPlanComposeZfsUpdateWithRemovedFiles(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importFakeDemoPkg(c)
+	s.requireFakeDemoPkg(c)
+	// Pretend the image has been composed before with a file that is not
+	// part of the package anymore.
+	imagePath := s.repo.ImagePath("qemu", "demo")
+	c.Assert(os.MkdirAll(filepath.Dir(imagePath), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(imagePath, []byte("image"), 0644), IsNil)
+	imageCache := core.NewHashCache()
+	imageCache["/file.txt"] = core.HashEntry{Hash: "hash"}
+	imageCache["/removed.txt"] = core.HashEntry{Hash: "hash"}
+	c.Assert(imageCache.WriteToFile(s.repo.ImageCachePath("qemu", "demo")), IsNil)
+
+	// This is what we're testing here.
+	plan, err := PlanCompose(s.repo, []string{}, nil, true, false, s.packageDir, "demo",
+		&BootOptions{Cmd: "/file.txt"}, "zfs", "osv-loader", "", nil, ioutil.Discard)
+
+	// Expectations.
+	// The image is updated and the removed file is deleted in the guest.
+	c.Assert(err, IsNil)
+	c.Check(plan.Update, Equals, true)
+	actions := plannedActions(plan)
+	c.Check(actions["/file.txt"], Equals, PlanUpdate)
+	c.Check(actions["/removed.txt"], Equals, PlanDelete)
+}
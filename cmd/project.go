@@ -0,0 +1,201 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloudius-systems/capstan/core"
+	"github.com/cloudius-systems/capstan/util"
+)
+
+// projectImage is an image of the project along with its parsed options.
+type projectImage struct {
+	core.ProjectImage
+	size    ImageSize
+	formats []string
+	group   *collectGroup
+}
+
+// collectGroup is a set of images sharing the same package and requirements,
+// so that their content only has to be collected once. Images of a package
+// with templates must also share the values the templates are rendered with.
+type collectGroup struct {
+	packageDir string
+	require    []string
+	values     map[string]interface{}
+	targetPath string
+	images     []string
+}
+
+// BuildAll builds all images listed in the project file. Package content is
+// collected once for all images sharing the package and its requirements,
+// then at most jobs images are composed concurrently.
+func BuildAll(repo *util.Repo, projectFile string, jobs int, updatePackage, verbose, pullMissing bool) error {
+	project, err := core.ParseProjectFile(projectFile)
+	if err != nil {
+		return err
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	images, groups, err := planProject(project)
+	if err != nil {
+		return err
+	}
+
+	// Base images might have to be downloaded, which must not happen
+	// concurrently.
+	if err := prepareBaseImages(repo, images, updatePackage); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir("", "capstan-build-all")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	for i, group := range groups {
+		fmt.Printf("Collecting package %s for %s\n", group.packageDir, strings.Join(group.images, ", "))
+		group.targetPath = filepath.Join(tmp, fmt.Sprintf("mpm-pkg-%d", i))
+		if err := collectPackageInto(repo, group.packageDir, group.targetPath, group.require, nil, group.values, pullMissing, false, verbose); err != nil {
+			return fmt.Errorf("Failed to collect package %s.\nError was: %s", group.packageDir, err)
+		}
+	}
+
+	errs := make([]error, len(images))
+	slots := make(chan bool, jobs)
+	wg := sync.WaitGroup{}
+	for i := range images {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			slots <- true
+			defer func() { <-slots }()
+
+			errs[i] = buildProjectImage(repo, &images[i], updatePackage, verbose)
+		}(i)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", images[i].Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to build %d out of %d images:\n%s", len(failed), len(images), strings.Join(failed, "\n"))
+	}
+
+	fmt.Printf("Successfully built %d images\n", len(images))
+	return nil
+}
+
+// planProject validates options of all images and groups the images by the
+// content they are composed of.
+func planProject(project *core.Project) ([]projectImage, []*collectGroup, error) {
+	var images []projectImage
+	var groups []*collectGroup
+	groupsByKey := make(map[string]*collectGroup)
+
+	for _, image := range project.Images {
+		size, err := ParseImageSize(image.Size)
+		if err != nil {
+			return nil, nil, fmt.Errorf("image '%s': %s", image.Name, err)
+		}
+		formats, err := ParseComposeFormats(strings.Join(image.Format, ","))
+		if err != nil {
+			return nil, nil, fmt.Errorf("image '%s': %s", image.Name, err)
+		}
+
+		require := append(append([]string{}, project.Require...), image.Require...)
+		sortedRequire := append([]string{}, require...)
+		sort.Strings(sortedRequire)
+		key := image.Package + "\n" + strings.Join(sortedRequire, ",")
+
+		values, err := TemplateValues("", image.Env)
+		if err != nil {
+			return nil, nil, fmt.Errorf("image '%s': %s", image.Name, err)
+		}
+		if hasTemplates(image.Package) {
+			env := append([]string{}, image.Env...)
+			sort.Strings(env)
+			key += "\n" + strings.Join(env, ",")
+		}
+
+		group, ok := groupsByKey[key]
+		if !ok {
+			group = &collectGroup{packageDir: image.Package, require: require, values: values}
+			groupsByKey[key] = group
+			groups = append(groups, group)
+		}
+		group.images = append(group.images, image.Name)
+
+		images = append(images, projectImage{ProjectImage: image, size: size, formats: formats, group: group})
+	}
+
+	return images, groups, nil
+}
+
+// hasTemplates returns true if package.yaml of the package lists templates.
+func hasTemplates(packageDir string) bool {
+	pkg, err := core.ParsePackageManifest(filepath.Join(packageDir, "meta", "package.yaml"))
+	return err == nil && len(pkg.Templates) > 0
+}
+
+// prepareBaseImages makes sure the loader images and (if needed) the ZFS
+// builder image are present in the repository.
+func prepareBaseImages(repo *util.Repo, images []projectImage, updatePackage bool) error {
+	loaders := make(map[string]bool)
+	zfsBuilderNeeded := false
+	for _, image := range images {
+		loaders[image.LoaderImage] = true
+		if image.Fs == "zfs" && (!updatePackage || !repo.ImageExists("qemu", image.Name)) {
+			zfsBuilderNeeded = true
+		}
+	}
+
+	for loader := range loaders {
+		if _, err := repo.UserPartitionStart(loader); err != nil {
+			return fmt.Errorf("Loader image %s could not be found or downloaded.\nError was: %s", loader, err)
+		}
+	}
+	if zfsBuilderNeeded {
+		if _, err := repo.GetZfsBuilderImagePath(); err != nil {
+			return fmt.Errorf("Failed to find ZFS builder path.\nError was: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func buildProjectImage(repo *util.Repo, image *projectImage, updatePackage, verbose bool) error {
+	fmt.Printf("Composing image %s\n", image.Name)
+
+	bootOpts := BootOptions{
+		Cmd:        image.Run,
+		Boot:       image.Boot,
+		EnvList:    image.Env,
+		PackageDir: image.group.packageDir,
+	}
+	if err := composeCollectedPackage(repo, image.group.targetPath, image.size, updatePackage, verbose,
+		image.Name, &bootOpts, image.Fs, image.LoaderImage, ""); err != nil {
+		return err
+	}
+
+	return ExportComposedImage(repo, image.Name, image.formats)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/cloudius-systems/capstan/core"
+
+	. "github.com/cloudius-systems/capstan/testing"
+	. "gopkg.in/check.v1"
+)
+
+func (s *suite) TestPlanProjectGroupsImages(c *C) {
+	project := &core.Project{
+		Require: []string{"common"},
+		Images: []core.ProjectImage{
+			{Name: "a", Package: "/pkg", Require: []string{"x", "y"}, Size: "10G", Format: []string{"qcow2"}},
+			{Name: "b", Package: "/pkg", Require: []string{"y", "x"}, Size: "auto", Format: []string{"raw"}},
+			{Name: "c", Package: "/pkg", Size: "10G", Format: []string{"qcow2"}},
+			{Name: "d", Package: "/other", Require: []string{"x", "y"}, Size: "10G", Format: []string{"qcow2"}},
+		},
+	}
+
+	// This is what we're testing here.
+	images, groups, err := planProject(project)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Assert(images, HasLen, 4)
+	c.Assert(groups, HasLen, 3)
+	c.Check(groups[0].images, DeepEquals, []string{"a", "b"})
+	c.Check(groups[0].require, DeepEquals, []string{"common", "x", "y"})
+	c.Check(groups[1].images, DeepEquals, []string{"c"})
+	c.Check(groups[1].require, DeepEquals, []string{"common"})
+	c.Check(groups[2].images, DeepEquals, []string{"d"})
+	c.Check(images[1].size, Equals, ImageSize{Auto: true})
+	c.Check(images[1].formats, DeepEquals, []string{"raw"})
+	c.Check(images[3].group, Equals, groups[2])
+}
+
+func (s *suite) TestPlanProjectGroupsImagesByTemplateValues(c *C) {
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/package.yaml": "name: app\ntitle: App\nauthor: Author\ntemplates: [/file.txt]\n",
+	})
+	project := &core.Project{
+		Images: []core.ProjectImage{
+			{Name: "a", Package: s.packageDir, Env: []string{"PORT=8000", "HOST=a"}, Size: "10G", Format: []string{"qcow2"}},
+			{Name: "b", Package: s.packageDir, Env: []string{"HOST=a", "PORT=8000"}, Size: "10G", Format: []string{"qcow2"}},
+			{Name: "c", Package: s.packageDir, Env: []string{"PORT=9000"}, Size: "10G", Format: []string{"qcow2"}},
+		},
+	}
+
+	// This is what we're testing here.
+	_, groups, err := planProject(project)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 2)
+	c.Check(groups[0].images, DeepEquals, []string{"a", "b"})
+	c.Check(groups[0].values, DeepEquals, map[string]interface{}{"PORT": "8000", "HOST": "a"})
+	c.Check(groups[1].images, DeepEquals, []string{"c"})
+}
+
+func (s *suite) TestPlanProjectInvalidOptions(c *C) {
+	m := []struct {
+		comment string
+		image   core.ProjectImage
+		err     string
+	}{
+		{
+			"invalid size",
+			core.ProjectImage{Name: "a", Size: "huge", Format: []string{"qcow2"}},
+			"image 'a': .*",
+		},
+		{
+			"invalid format",
+			core.ProjectImage{Name: "a", Size: "10G", Format: []string{"iso"}},
+			"image 'a': .*iso.*",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		_, _, err := planProject(&core.Project{Images: []core.ProjectImage{args.image}})
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.err)
+	}
+}
+
+func (s *suite) TestBuildAll(c *C) {
+	mockServer := MockGitHubApiServer()
+	defer mockServer.Close()
+	s.repo.GithubURL = mockServer.URL
+
+	projectFile := filepath.Join(s.packageDir, core.ProjectFileName)
+	project := FixIndent(`
+		images:
+		  - name: demo/first
+		    fs: rofs
+		    size: 64M
+		    run: /file.txt
+		  - name: demo/second
+		    fs: rofs
+		    size: 64M
+		    format: [raw]
+	`)
+	c.Assert(ioutil.WriteFile(projectFile, []byte(project), 0644), IsNil)
+
+	// This is what we're testing here.
+	err := BuildAll(s.repo, projectFile, 2, false, false, true)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	rawPath := filepath.Join(filepath.Dir(s.repo.ImagePath("qemu", "demo/second")), "second.raw")
+	for _, imagePath := range []string{s.repo.ImagePath("qemu", "demo/first"), rawPath} {
+		out := bytes.Buffer{}
+		c.Assert(ImageCat(s.repo, imagePath, "/file.txt", &out), IsNil)
+		c.Check(out.String(), Equals, DefaultText)
+	}
+	cmdLine, err := ImageGetCmdLine(s.repo, "demo/first")
+	c.Assert(err, IsNil)
+	c.Check(cmdLine, Equals, "/file.txt")
+}
+
+func (s *suite) TestBuildAllMissingProjectFile(c *C) {
+	// This is what we're testing here.
+	err := BuildAll(s.repo, filepath.Join(s.packageDir, "missing.yaml"), 1, false, false, false)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "Project file .*missing.yaml does not exist")
+}
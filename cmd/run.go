@@ -167,13 +167,13 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 			config.InstanceName = pkg.Name
 
 			// Try to compose the package.
-			sz, _ := util.ParseMemSize("10G")
+			sz, _ := ParseImageSize("10G")
 			wd, err := os.Getwd()
 			if err != nil {
 				return err
 			}
 			bootOpts := BootOptions{Cmd: config.Cmd}
-			err = ComposePackage(repo, []string {}, sz, true, false, true, wd, pkg.Name, &bootOpts, "zfs", "")
+			err = ComposePackage(repo, []string {}, nil, sz, true, false, true, wd, pkg.Name, &bootOpts, "zfs", "", "", "", nil)
 			if err != nil {
 				return err
 			}
@@ -188,6 +188,13 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 		return nil
 	}
 
+	// Resolve binary aliases exported by packages the image was composed from.
+	if config.Cmd != "" && repo.ImageExists(config.Hypervisor, config.ImageName) {
+		if info, err := repo.ReadImageInfo(config.ImageName); err == nil {
+			config.Cmd = ResolveBinaryAlias(config.Cmd, info.Binary)
+		}
+	}
+
 	format, err := image.Probe(path)
 	if err != nil {
 		return err
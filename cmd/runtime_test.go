@@ -27,6 +27,7 @@ func (s *suite) TestRuntimeList(c *C) {
 		node    {13}Run JavaScript NodeJS 4.4.5 application {11}\[node-4.4.5          \]
 		java    {13}Run Java application                    {11}\[openjdk8-zulu-compact1\]
 		python  {13}Run Python 2.7 application              {11}\[python-2.7          \]
+		python3 {13}Run Python 3 application                {11}\[osv.python3x        \]
 	`
 	c.Check(txt, MatchesMultiline, FixIndent(expected))
 }
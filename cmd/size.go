@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/cloudius-systems/capstan/core"
+	"github.com/cloudius-systems/capstan/util"
+)
+
+// generatedSource is the package reported for files generated by Capstan
+// itself, e.g. the boot commands in /run.
+const generatedSource = "(generated)"
+
+// sizeReportEntries is the number of the largest files and directories kept
+// in the size report.
+const sizeReportEntries = 10
+
+// ImageSizeReport returns the size report of the image with the given name or
+// of the package content in the given directory. The directory is either the
+// content collected with `capstan package collect` or a package directory
+// whose content is resolved without collecting it.
+func ImageSizeReport(repo *util.Repo, imageOrDir string) (*core.SizeReport, error) {
+	if info, err := os.Stat(imageOrDir); err == nil && info.IsDir() {
+		reportPath := filepath.Join(imageOrDir, "meta", "size.yaml")
+		if _, err := os.Stat(reportPath); err == nil {
+			return core.ParseSizeReport(reportPath)
+		}
+
+		tree, _, packages, err := collectPackageTree(repo, imageOrDir, "", []string{}, nil, nil, false, false, false, os.Stdout)
+		if err != nil {
+			return nil, err
+		}
+		return newSizeReport(tree, packages[len(packages)-1].Name), nil
+	}
+
+	report, err := core.ParseSizeReport(repo.ImageSizeReportPath(imageOrDir))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: no size report, compose the image again to create it", imageOrDir)
+	}
+	return report, err
+}
+
+// newSizeReport breaks down the size of the regular files in the tree by the
+// packages they come from. Data of hard links is only counted once.
+func newSizeReport(tree *util.FileTree, pkgName string) *core.SizeReport {
+	report := &core.SizeReport{Package: pkgName}
+	packages := make(map[string]*core.PackageSize)
+	dirs := make(map[string]int64)
+	counted := make(map[*util.FileNode]bool)
+
+	tree.Walk(func(node *util.FileNode) error {
+		if !node.IsRegular() || counted[node.LinkOrigin()] {
+			return nil
+		}
+		counted[node.LinkOrigin()] = true
+
+		source := node.Source
+		if source == "" {
+			source = generatedSource
+		}
+		if packages[source] == nil {
+			packages[source] = &core.PackageSize{Name: source}
+		}
+		packages[source].Size += node.Size
+		packages[source].Files++
+		report.TotalSize += node.Size
+
+		report.LargestFiles = append(report.LargestFiles, core.PathSize{Path: node.Path, Size: node.Size, Package: source})
+		for dir := path.Dir(node.Path); dir != "/"; dir = path.Dir(dir) {
+			dirs[dir] += node.Size
+		}
+
+		if node.Shadows != "" {
+			report.Shadowed = append(report.Shadowed, core.ShadowedFile{Path: node.Path, Size: node.Size,
+				Package: source, Shadows: node.Shadows})
+		}
+		return nil
+	})
+
+	for _, pkg := range packages {
+		report.Packages = append(report.Packages, *pkg)
+	}
+	sort.Slice(report.Packages, func(i, j int) bool {
+		a, b := report.Packages[i], report.Packages[j]
+		return a.Size > b.Size || (a.Size == b.Size && a.Name < b.Name)
+	})
+
+	for dir, size := range dirs {
+		report.LargestDirectories = append(report.LargestDirectories, core.PathSize{Path: dir, Size: size})
+	}
+	report.LargestFiles = largestPaths(report.LargestFiles)
+	report.LargestDirectories = largestPaths(report.LargestDirectories)
+
+	return report
+}
+
+// largestPaths returns at most sizeReportEntries of the largest paths.
+func largestPaths(paths []core.PathSize) []core.PathSize {
+	sort.Slice(paths, func(i, j int) bool {
+		return paths[i].Size > paths[j].Size || (paths[i].Size == paths[j].Size && paths[i].Path < paths[j].Path)
+	})
+	if len(paths) > sizeReportEntries {
+		paths = paths[:sizeReportEntries]
+	}
+	return paths
+}
+
+// saveSizeReport stores the size report next to index.yaml of the image.
+func saveSizeReport(repo *util.Repo, appName string, report *core.SizeReport) error {
+	if report == nil {
+		return nil
+	}
+	return report.WriteToFile(repo.ImageSizeReportPath(appName))
+}
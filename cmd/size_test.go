@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/cloudius-systems/capstan/core"
+
+	. "github.com/cloudius-systems/capstan/testing"
+	. "gopkg.in/check.v1"
+)
+
+func (s *suite) TestImageSizeReportOfCollectedPackage(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importFakeDemoPkg(c)
+	s.requireFakeDemoPkg(c)
+	PrepareFiles(s.packageDir, map[string]string{"/data/fake-demo-data-file.txt": "overridden"})
+	targetPath, err := CollectPackage(s.repo, s.packageDir, "", []string{}, nil, nil, false, false, false)
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(targetPath)
+
+	// This is what we're testing here.
+	report, err := ImageSizeReport(s.repo, targetPath)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(report.Package, Equals, "package-name")
+	sizes := make(map[string]core.PackageSize)
+	var total int64
+	for _, pkg := range report.Packages {
+		sizes[pkg.Name] = pkg
+		total += pkg.Size
+	}
+	c.Check(total, Equals, report.TotalSize)
+	c.Check(sizes["osv.bootstrap"], DeepEquals, core.PackageSize{Name: "osv.bootstrap", Size: 2 * int64(len(DefaultText)), Files: 2})
+	c.Check(sizes["fake.demo"], DeepEquals, core.PackageSize{Name: "fake.demo", Size: int64(len(DefaultText)), Files: 1})
+	c.Check(sizes["package-name"].Files, Equals, 3)
+	c.Check(sizes[generatedSource].Files, Equals, 2)
+	c.Check(report.Shadowed, DeepEquals, []core.ShadowedFile{
+		{Path: "/data/fake-demo-data-file.txt", Size: 10, Package: "package-name", Shadows: "fake.demo"},
+	})
+	c.Check(report.LargestDirectories[0], DeepEquals, core.PathSize{Path: "/data", Size: 10 + 2*int64(len(DefaultText))})
+	c.Check(report.String(), Matches, "(?s).*! +10 /data/fake-demo-data-file.txt \\(package-name shadows fake.demo\\).*")
+}
+
+func (s *suite) TestImageSizeReportOfPackageDir(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+
+	// This is what we're testing here.
+	report, err := ImageSizeReport(s.repo, s.packageDir)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(report.Packages, HasLen, 2)
+	c.Check(report.TotalSize, Equals, 4*int64(len(DefaultText)))
+	c.Check(report.Shadowed, HasLen, 0)
+}
+
+func (s *suite) TestImageSizeReportOfComposedImage(c *C) {
+	// Prepare.
+	mockServer := MockGitHubApiServer()
+	defer mockServer.Close()
+	s.repo.GithubURL = mockServer.URL
+	s.importFakeOSvBootstrapPkg(c)
+	imageSize, _ := ParseImageSize("64M")
+
+	for _, collectDir := range []string{"", "mpm-pkg"} {
+		c.Logf("collect dir: '%s'", collectDir)
+		os.Remove(s.repo.ImageSizeReportPath("demo"))
+		err := ComposePackage(s.repo, []string{}, nil, imageSize, false, false, false, s.packageDir, "demo",
+			&BootOptions{}, "rofs", "osv-loader", "", collectDir, nil)
+		c.Assert(err, IsNil)
+
+		// This is what we're testing here.
+		report, err := ImageSizeReport(s.repo, "demo")
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(report.Package, Equals, "package-name")
+		c.Check(report.TotalSize, Equals, 4*int64(len(DefaultText)))
+	}
+}
+
+func (s *suite) TestImageSizeReportMissing(c *C) {
+	// This is what we're testing here.
+	_, err := ImageSizeReport(s.repo, "missing/image")
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "missing/image: no size report, compose the image again to create it")
+}
@@ -70,9 +70,15 @@ func OpenStackPush(c *cli.Context) error {
 		PackageDir: packageDir,
 	}
 
+	// Environment variables are available to the package templates as well.
+	values, err := TemplateValues("", bootOpts.EnvList)
+	if err != nil {
+		return err
+	}
+
 	// Compose image locally.
 	fmt.Printf("Creating image of user-usable size %d MB.\n", sizeMB)
-	err = ComposePackage(repo, []string{}, sizeMB, false, verbose, pullMissing, packageDir, appName, &bootOpts, "zfs", "")
+	err = ComposePackage(repo, []string{}, nil, ImageSize{MB: sizeMB}, false, verbose, pullMissing, packageDir, appName, &bootOpts, "zfs", "", "", "", values)
 	if err != nil {
 		return err
 	}
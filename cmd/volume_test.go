@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 
 	"github.com/cloudius-systems/capstan/hypervisor"
+	"github.com/cloudius-systems/capstan/image"
 	"github.com/cloudius-systems/capstan/util"
 
 	. "github.com/cloudius-systems/capstan/testing"
@@ -35,10 +36,10 @@ var _ = Suite(&volumesSuite{})
 
 func (s *volumesSuite) TestCreateVolume(c *C) {
 	m := []struct {
-		comment      string
-		volume       Volume
-		expectedMeta string
-		expectedInfo string
+		comment        string
+		volume         Volume
+		expectedMeta   string
+		expectedFormat image.ImageFormat
 	}{
 		{
 			"create default format",
@@ -49,10 +50,7 @@ func (s *volumesSuite) TestCreateVolume(c *C) {
 			`
 				format: raw
 			`,
-			`
-				file format: raw
-				virtual size: 128M \(134217728 bytes\)
-			`,
+			image.RAW,
 		},
 		{
 			"create qcow2",
@@ -66,10 +64,7 @@ func (s *volumesSuite) TestCreateVolume(c *C) {
 			`
 				format: qcow2
 			`,
-			`
-				file format: qcow2
-				virtual size: 128M \(134217728 bytes\)
-			`,
+			image.QCOW2,
 		},
 		{
 			"create raw",
@@ -83,10 +78,7 @@ func (s *volumesSuite) TestCreateVolume(c *C) {
 			`
 				format: raw
 			`,
-			`
-				file format: raw
-				virtual size: 128M \(134217728 bytes\)
-			`,
+			image.RAW,
 		},
 	}
 	for i, args := range m {
@@ -105,7 +97,13 @@ func (s *volumesSuite) TestCreateVolume(c *C) {
 		// Expectations.
 		c.Assert(err, IsNil)
 		c.Check(metaFile, FileMatches, FixIndent(args.expectedMeta))
-		c.Check([]string{"qemu-img", "info", volumeFile}, CmdOutputMatches, FixIndent(args.expectedInfo))
+		format, err := image.Probe(volumeFile)
+		c.Assert(err, IsNil)
+		c.Check(format, Equals, args.expectedFormat)
+		disk, err := image.OpenDisk(volumeFile)
+		c.Assert(err, IsNil)
+		c.Check(disk.Size(), Equals, int64(134217728))
+		disk.Close()
 	}
 }
 
@@ -9,21 +9,24 @@ package core
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"os"
+	"path"
 	"regexp"
 	"strings"
 )
 
 type Capstanignore interface {
 	LoadFile(path string) error
+	LoadNestedFile(path string, dir string) error
 	AddPattern(pattern string) error
 	PrintPatterns()
 	IsIgnored(path string) bool
 }
 
 var CAPSTANIGNORE_ALWAYS []string = []string{
-	"/meta/*", "/mpm-pkg", "/.git", "/.capstanignore", "/.gitignore", "/volumes",
+	"/meta/*", "/mpm-pkg", "/.git", ".capstanignore", "/.gitignore", "/volumes",
 }
 
 // CapstanignoreInit creates a new Capstanignore struct that is
@@ -50,97 +53,256 @@ func CapstanignoreInit(path string) (Capstanignore, error) {
 	return &c, nil
 }
 
+// NewCapstanignore creates a Capstanignore struct with the given patterns
+// only, without the paths that CapstanignoreInit always ignores. It is used
+// for patterns that are not applied to the package directory, e.g. the files
+// excluded from the required packages.
+func NewCapstanignore(patterns []string) (Capstanignore, error) {
+	c := capstanignore{}
+	for _, pattern := range patterns {
+		if err := c.AddPattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
 type capstanignore struct {
-	patterns         []string         // list of all ignored patterns
-	compiledPatterns []*regexp.Regexp // list of compiled patterns
+	rules []capstanignoreRule // rules in the order they were added
+}
+
+// capstanignoreRule is a single compiled pattern. Later rules take precedence
+// over the earlier ones, just like in .gitignore.
+type capstanignoreRule struct {
+	pattern string         // pattern as it was given
+	dir     string         // directory the pattern is relative to
+	negate  bool           // pattern starts with `!` and re-includes paths
+	dirOnly bool           // pattern ends with `/` and only matches directories
+	regex   *regexp.Regexp // compiled pattern matching the path relative to dir
 }
 
 // LoadFile attempts to parse .capstanignore file on given path.
 // If success, it remembers all patterns and closes file.
 func (c *capstanignore) LoadFile(path string) error {
-	if file, err := os.Open(path); err == nil {
-		defer file.Close()
+	return c.LoadNestedFile(path, "/")
+}
 
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-			if line == "" || strings.HasPrefix(line, "#") {
-				continue
-			}
-			if errPattern := c.AddPattern(line); errPattern != nil {
-				return errPattern
-			}
-		}
-	} else {
+// LoadNestedFile parses the .capstanignore file on given path whose patterns
+// are relative to the directory dir of the package, e.g. `/myfolder` for
+// the `myfolder/.capstanignore` file. Its patterns take precedence over the
+// patterns loaded before.
+func (c *capstanignore) LoadNestedFile(path string, dir string) error {
+	file, err := os.Open(path)
+	if err != nil {
 		return err
 	}
-	return nil
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := trimCapstanignoreLine(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := c.addPattern(line, dir); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
 }
 
 // AddPattern adds a pattern to be ignored.
 func (c *capstanignore) AddPattern(pattern string) error {
+	return c.addPattern(pattern, "/")
+}
+
+func (c *capstanignore) addPattern(pattern string, dir string) error {
 	// Protect user from strange behavior when ignoring whole /meta folder.
 	// (runscript files don't get created if ignored)
-	if pattern == "/meta" {
+	if dir == "/" && (pattern == "/meta" || pattern == "/meta/") {
 		return fmt.Errorf("please remove '/meta' from .capstanignore")
 	}
 
-	safePattern := transformCapstanignoreToRegex(pattern)
-	if compiled, err := regexp.Compile(safePattern); err == nil {
-		c.patterns = append(c.patterns, pattern)
-		c.compiledPatterns = append(c.compiledPatterns, compiled)
-	} else {
-		return err
+	rule, err := compileCapstanignorePattern(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern '%s': %s", pattern, err)
 	}
-
+	rule.dir = path.Clean("/" + dir)
+	c.rules = append(c.rules, rule)
 	return nil
 }
 
-// IsIgnored returns true if path given is on ignore list.
-// But notice that if a folder is ignored, it is up to caller
-// to ignore all files beneath as well. E.g. if pattern `/myfolder`
-// is used, then IsIgnored will return false for all subfolders and
-// files inside the `/myfolder` directory.
-func (c *capstanignore) IsIgnored(path string) bool {
-	for _, pattern := range c.compiledPatterns {
-		if pattern.MatchString(path) {
+// IsIgnored returns true if path given is on ignore list. Paths of
+// directories must end with a slash, otherwise patterns that only match
+// directories (e.g. `build/`) don't apply to them. A path inside of an
+// ignored directory is ignored as well and, like with .gitignore, can not be
+// re-included by a negated pattern.
+func (c *capstanignore) IsIgnored(filePath string) bool {
+	isDir := strings.HasSuffix(filePath, "/")
+	filePath = path.Clean("/" + filePath)
+	if filePath == "/" {
+		return false
+	}
+
+	for i := 1; i < len(filePath); i++ {
+		if filePath[i] == '/' && c.matches(filePath[:i], true) {
 			return true
 		}
 	}
-	return false
+	return c.matches(filePath, isDir)
+}
+
+// matches returns true if the last rule matching the path ignores it.
+func (c *capstanignore) matches(filePath string, isDir bool) bool {
+	ignored := false
+	for _, rule := range c.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		relPath := strings.TrimPrefix(filePath, "/")
+		if rule.dir != "/" {
+			if !strings.HasPrefix(filePath, rule.dir+"/") {
+				continue
+			}
+			relPath = filePath[len(rule.dir)+1:]
+		}
+		if rule.regex.MatchString(relPath) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
 }
 
 func (c *capstanignore) PrintPatterns() {
-	for _, pattern := range c.patterns {
-		fmt.Println(pattern)
+	for _, rule := range c.rules {
+		if rule.dir != "/" {
+			fmt.Printf("%s/.capstanignore: %s\n", rule.dir, rule.pattern)
+		} else {
+			fmt.Println(rule.pattern)
+		}
 	}
 }
 
-// transformCapstanignoreToRegex transforms capstanignore synstax to regex systax.
-func transformCapstanignoreToRegex(pattern string) string {
-	// preprocess
-	pattern = strings.Replace(pattern, "/**/", "{two-stars}", -1)
-	if strings.HasSuffix(pattern, "/*") {
-		pattern = strings.TrimSuffix(pattern, "/*")
-		pattern = pattern + "{all-beneath}"
+// trimCapstanignoreLine removes trailing whitespace of the line in the
+// .capstanignore file unless it is escaped with a backslash.
+func trimCapstanignoreLine(line string) string {
+	trimmed := strings.TrimRight(line, " \t\r")
+	if len(trimmed) < len(line) && strings.HasSuffix(trimmed, "\\") {
+		trimmed += line[len(trimmed) : len(trimmed)+1]
+	}
+	return strings.TrimLeft(trimmed, " \t")
+}
+
+// compileCapstanignorePattern transforms .gitignore pattern syntax to a rule
+// with regex matching paths relative to the directory of the pattern.
+func compileCapstanignorePattern(pattern string) (capstanignoreRule, error) {
+	rule := capstanignoreRule{pattern: pattern}
+
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, "\\!") || strings.HasPrefix(pattern, "\\#") {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") && !strings.HasSuffix(pattern, "\\/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return rule, fmt.Errorf("empty pattern")
+	}
+
+	// Pattern with a slash at the beginning or in the middle is relative to
+	// its directory, otherwise it matches at any depth.
+	regex := bytes.Buffer{}
+	regex.WriteString("^")
+	if strings.HasPrefix(pattern, "/") {
+		pattern = pattern[1:]
+	} else if !strings.Contains(pattern, "/") {
+		regex.WriteString("(?:.*/)?")
 	}
 
-	// Implicit ^ at the beginning
-	if !strings.HasPrefix(pattern, "^") {
-		pattern = "^" + pattern
+	for i := 0; i < len(pattern); i++ {
+		switch ch := pattern[i]; ch {
+		case '*':
+			atStart := i == 0 || pattern[i-1] == '/'
+			if atStart && strings.HasPrefix(pattern[i:], "**/") {
+				// Leading `**/` and `/**/` match any number of directories.
+				regex.WriteString("(?:.*/)?")
+				i += 2
+			} else if atStart && pattern[i:] == "**" {
+				// Trailing `/**` matches everything inside.
+				regex.WriteString(".*")
+				i++
+			} else {
+				for i+1 < len(pattern) && pattern[i+1] == '*' {
+					i++
+				}
+				regex.WriteString("[^/]*")
+			}
+		case '?':
+			regex.WriteString("[^/]")
+		case '[':
+			class, n, ok := capstanignoreClass(pattern[i:])
+			if !ok {
+				regex.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			regex.WriteString(class)
+			i += n - 1
+		case '\\':
+			if i+1 == len(pattern) {
+				return rule, fmt.Errorf("trailing backslash")
+			}
+			i++
+			regex.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			regex.WriteString(regexp.QuoteMeta(string(ch)))
+		}
 	}
-	// Star * means only one folder level
-	pattern = strings.Replace(pattern, "*", "[^/]*", -1)
-	// Dot . means actual dot
-	pattern = strings.Replace(pattern, ".", "\\.", -1)
-	// Two stars between two slashes /**/ mean all folder levels
-	pattern = strings.Replace(pattern, "{two-stars}", ".*", -1)
-	// /* at the end means also all subfolders
-	pattern = strings.Replace(pattern, "{all-beneath}", "/.*", 1)
-	// Implicit $ at the end
-	if !strings.HasSuffix(pattern, "$") {
-		pattern = pattern + "$"
+	regex.WriteString("$")
+
+	compiled, err := regexp.Compile(regex.String())
+	if err != nil {
+		return rule, err
 	}
+	rule.regex = compiled
+	return rule, nil
+}
 
-	return pattern
+// capstanignoreClass transforms the character class at the beginning of the
+// pattern, e.g. `[a-z]` or `[!0-9]`, to regex. It returns the regex and the
+// length of the class in the pattern, or false if the class is not closed.
+func capstanignoreClass(pattern string) (string, int, bool) {
+	class := bytes.Buffer{}
+	class.WriteString("[")
+	i := 1
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		// Slash is never matched by a character class.
+		class.WriteString("^/")
+		i++
+	}
+	for start := i; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch {
+		case ch == ']' && i > start:
+			class.WriteString("]")
+			return class.String(), i + 1, true
+		case ch == '[' && strings.HasPrefix(pattern[i:], "[:"):
+			end := strings.Index(pattern[i+2:], ":]")
+			if end < 0 {
+				return "", 0, false
+			}
+			class.WriteString(pattern[i : i+end+4])
+			i += end + 3
+		case ch == '\\' && i+1 < len(pattern):
+			i++
+			class.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case ch == '-':
+			class.WriteString("-")
+		default:
+			class.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return "", 0, false
 }
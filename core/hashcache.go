@@ -13,10 +13,24 @@ import (
 	"os"
 )
 
-type HashCache map[string]string
+// HashEntry describes a path as it was uploaded into the image. Size and
+// modification time allow detecting unchanged files without reading them.
+// Permission bits are kept as well, since they are uploaded along with the
+// content.
+type HashEntry struct {
+	Size    int64       `yaml:"size"`
+	ModTime int64       `yaml:"mtime"`
+	Mode    os.FileMode `yaml:"mode"`
+	Hash    string      `yaml:"sha256,omitempty"`
+	// MD5 hash of the content kept from caches written by older versions of
+	// Capstan. Such entries are compared once and replaced with SHA256 hashes.
+	LegacyHash string `yaml:"md5,omitempty"`
+}
+
+type HashCache map[string]HashEntry
 
 func NewHashCache() HashCache {
-	return make(map[string]string)
+	return make(map[string]HashEntry)
 }
 
 // ParseHashCache looks for a file at given location and tries to
@@ -45,10 +59,21 @@ func ParseHashCache(cachePath string) (HashCache, error) {
 }
 
 func (h *HashCache) parse(data []byte) error {
-	if err := yaml.Unmarshal(data, h); err != nil {
+	if err := yaml.Unmarshal(data, h); err == nil {
+		return nil
+	}
+
+	// Older versions of Capstan stored only the MD5 hash of each path.
+	var legacy map[string]string
+	if err := yaml.Unmarshal(data, &legacy); err != nil {
 		return err
 	}
 
+	*h = NewHashCache()
+	for path, hash := range legacy {
+		(*h)[path] = HashEntry{Size: -1, LegacyHash: hash}
+	}
+
 	return nil
 }
 
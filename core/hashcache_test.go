@@ -0,0 +1,50 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package core
+
+import (
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type hashCacheSuite struct {
+}
+
+var _ = Suite(&hashCacheSuite{})
+
+func (*hashCacheSuite) TestParseLegacyFormat(c *C) {
+	data := "/file1: 5235be9b9e4ae0c8f4a7037b122cdec4\n/dir1: fd4470862b13f32bfcc3659aa8dc4082\n"
+
+	// This is what we're testing here.
+	var hc HashCache
+	err := hc.parse([]byte(data))
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(hc, DeepEquals, HashCache{
+		"/file1": HashEntry{Size: -1, LegacyHash: "5235be9b9e4ae0c8f4a7037b122cdec4"},
+		"/dir1":  HashEntry{Size: -1, LegacyHash: "fd4470862b13f32bfcc3659aa8dc4082"},
+	})
+}
+
+func (*hashCacheSuite) TestWriteAndParse(c *C) {
+	cachePath := filepath.Join(c.MkDir(), "image.cache")
+	hc := HashCache{
+		"/file1": HashEntry{Size: 5, ModTime: 1500000000000000000, Hash: "aaa8d3c8"},
+		"/dir1":  HashEntry{Hash: "fd447086"},
+	}
+	c.Assert(hc.WriteToFile(cachePath), IsNil)
+
+	// This is what we're testing here.
+	parsed, err := ParseHashCache(cachePath)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(parsed, DeepEquals, hc)
+}
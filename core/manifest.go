@@ -0,0 +1,147 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// FileManifest maps paths in the image to files on the host, in the spirit of
+// usr.manifest of OSv. It is stored in meta/manifest.yaml of the package, so
+// that large host files do not have to be copied into the package directory:
+//
+//	/usr/lib/libz.so.1: /lib/x86_64-linux-gnu/&
+//	/usr/lib/jvm/java: /usr/lib/jvm/java-8-openjdk-amd64
+//	/usr/lib/: /opt/app/lib/*.so
+//
+// Any & in the host path is replaced with the base name of the path in the
+// image, just like in the files of a Capstanfile. Directories are added with
+// all their content. Paths in the image ending with / are directories the host
+// file is added into. A host path with wildcards is a glob whose matches are
+// always added into the directory given by the path in the image. Relative
+// host paths are relative to the package directory.
+type FileManifest map[string]string
+
+// ManifestFile is a file on the host along with its path in the image.
+type ManifestFile struct {
+	GuestPath string
+	HostPath  string
+	Info      os.FileInfo
+}
+
+// ParseFileManifest parses the manifest file. Missing manifest is the same as
+// an empty one.
+func ParseFileManifest(manifestPath string) (FileManifest, error) {
+	data, err := ioutil.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		return FileManifest{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	m := FileManifest{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %s", manifestPath, err)
+	}
+	for guestPath := range m {
+		if !strings.HasPrefix(guestPath, "/") {
+			return nil, fmt.Errorf("%s: %s: path in the image must be absolute", manifestPath, guestPath)
+		}
+	}
+	return m, nil
+}
+
+// Resolve returns all files on the host the manifest maps into the image.
+// Directories are followed by their content. Entries are resolved in the order
+// of their paths in the image, so that a more specific entry overrides the
+// content of a directory added before it.
+func (m FileManifest) Resolve(baseDir string) ([]ManifestFile, error) {
+	guestPaths := make([]string, 0, len(m))
+	for guestPath := range m {
+		guestPaths = append(guestPaths, guestPath)
+	}
+	sort.Strings(guestPaths)
+
+	var files []ManifestFile
+	for _, guestPath := range guestPaths {
+		hostPath := strings.Replace(m[guestPath], "&", filepath.Base(guestPath), -1)
+		if !filepath.IsAbs(hostPath) {
+			hostPath = filepath.Join(baseDir, hostPath)
+		}
+
+		if !strings.ContainsAny(hostPath, "*?[") {
+			target := path.Clean(guestPath)
+			if strings.HasSuffix(guestPath, "/") {
+				target = path.Join(target, filepath.Base(hostPath))
+			}
+			resolved, err := resolveManifestPath(target, hostPath)
+			if err != nil {
+				return nil, fmt.Errorf("manifest: %s: %s", guestPath, err)
+			}
+			files = append(files, resolved...)
+			continue
+		}
+
+		matches, err := filepath.Glob(hostPath)
+		if err != nil {
+			return nil, fmt.Errorf("manifest: %s: %s", guestPath, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("manifest: %s: %s matches no files", guestPath, hostPath)
+		}
+		for _, match := range matches {
+			resolved, err := resolveManifestPath(path.Join(guestPath, filepath.Base(match)), match)
+			if err != nil {
+				return nil, fmt.Errorf("manifest: %s: %s", guestPath, err)
+			}
+			files = append(files, resolved...)
+		}
+	}
+
+	return files, nil
+}
+
+// resolveManifestPath lists the host path along with its content in case of
+// a directory. The host path itself is followed if it is a symbolic link,
+// while links inside of directories are kept.
+func resolveManifestPath(guestPath, hostPath string) ([]ManifestFile, error) {
+	info, err := os.Stat(hostPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []ManifestFile{{GuestPath: guestPath, HostPath: hostPath, Info: info}}, nil
+	}
+
+	root, err := filepath.EvalSymlinks(hostPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []ManifestFile
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, ManifestFile{GuestPath: path.Join(guestPath, filepath.ToSlash(rel)), HostPath: p, Info: info})
+		return nil
+	})
+	return files, err
+}
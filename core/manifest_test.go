@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type manifestSuite struct {
+	hostDir string
+}
+
+var _ = Suite(&manifestSuite{})
+
+func (s *manifestSuite) SetUpTest(c *C) {
+	s.hostDir = c.MkDir()
+	for _, name := range []string{"lib/libz.so.1", "lib/liba.so", "lib/libb.so", "jvm/bin/java", "jvm/release"} {
+		c.Assert(os.MkdirAll(filepath.Dir(filepath.Join(s.hostDir, name)), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(s.hostDir, name), []byte(name), 0644), IsNil)
+	}
+}
+
+func (s *manifestSuite) TestParseFileManifest(c *C) {
+	manifestPath := filepath.Join(c.MkDir(), "manifest.yaml")
+	c.Assert(ioutil.WriteFile(manifestPath, []byte("/usr/lib/&: /lib/&\n"), 0644), IsNil)
+
+	// This is what we're testing here.
+	m, err := ParseFileManifest(manifestPath)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(m, DeepEquals, FileManifest{"/usr/lib/&": "/lib/&"})
+}
+
+func (s *manifestSuite) TestParseFileManifestRelativeGuestPath(c *C) {
+	manifestPath := filepath.Join(c.MkDir(), "manifest.yaml")
+	c.Assert(ioutil.WriteFile(manifestPath, []byte("usr/lib/x: /lib/x\n"), 0644), IsNil)
+
+	// This is what we're testing here.
+	_, err := ParseFileManifest(manifestPath)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, ".*usr/lib/x: path in the image must be absolute")
+}
+
+func (s *manifestSuite) TestParseMissingFileManifest(c *C) {
+	// This is what we're testing here.
+	m, err := ParseFileManifest(filepath.Join(c.MkDir(), "manifest.yaml"))
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(m, HasLen, 0)
+}
+
+func (s *manifestSuite) TestResolve(c *C) {
+	m := []struct {
+		comment  string
+		manifest FileManifest
+		expected map[string]string
+	}{
+		{
+			"single file with substitution",
+			FileManifest{"/usr/lib/libz.so.1": filepath.Join(s.hostDir, "lib", "&")},
+			map[string]string{"/usr/lib/libz.so.1": "lib/libz.so.1"},
+		},
+		{
+			"relative host path",
+			FileManifest{"/libz.so": "lib/libz.so.1"},
+			map[string]string{"/libz.so": "lib/libz.so.1"},
+		},
+		{
+			"file into directory",
+			FileManifest{"/usr/lib/": "lib/liba.so"},
+			map[string]string{"/usr/lib/liba.so": "lib/liba.so"},
+		},
+		{
+			"directory",
+			FileManifest{"/usr/lib/jvm/java": "jvm"},
+			map[string]string{
+				"/usr/lib/jvm/java":          "jvm",
+				"/usr/lib/jvm/java/bin":      "jvm/bin",
+				"/usr/lib/jvm/java/bin/java": "jvm/bin/java",
+				"/usr/lib/jvm/java/release":  "jvm/release",
+			},
+		},
+		{
+			"glob",
+			FileManifest{"/usr/lib": "lib/lib?.so"},
+			map[string]string{"/usr/lib/liba.so": "lib/liba.so", "/usr/lib/libb.so": "lib/libb.so"},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		files, err := args.manifest.Resolve(s.hostDir)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		resolved := make(map[string]string)
+		for _, file := range files {
+			rel, _ := filepath.Rel(s.hostDir, file.HostPath)
+			resolved[file.GuestPath] = filepath.ToSlash(rel)
+		}
+		c.Check(resolved, DeepEquals, args.expected)
+	}
+}
+
+func (s *manifestSuite) TestResolveMissingFiles(c *C) {
+	m := []struct {
+		comment  string
+		manifest FileManifest
+		err      string
+	}{
+		{"missing file", FileManifest{"/x": "missing"}, "manifest: /x: .*no such file or directory"},
+		{"glob without matches", FileManifest{"/x": "lib/*.a"}, "manifest: /x: .*lib/\\*.a matches no files"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		_, err := args.manifest.Resolve(s.hostDir)
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.err)
+	}
+}
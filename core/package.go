@@ -18,14 +18,17 @@ import (
 )
 
 type Package struct {
-	Name     string
-	Title    string
-	Author   string            `yaml:"author,omitempty"`
-	Version  string            `yaml:"version,omitempty"`
-	Require  []string          `yaml:"require,omitempty"`
-	Binary   map[string]string `yaml:"binary,omitempty"`
-	Created  YamlTime          `yaml:"created"`
-	Platform string            `yaml:"platform,omitempty"`
+	Name      string
+	Title     string
+	Author    string                 `yaml:"author,omitempty"`
+	Version   string                 `yaml:"version,omitempty"`
+	Require   []string               `yaml:"require,omitempty"`
+	Binary    map[string]string      `yaml:"binary,omitempty"`
+	Created   YamlTime               `yaml:"created"`
+	Platform  string                 `yaml:"platform,omitempty"`
+	Templates []string               `yaml:"templates,omitempty"`
+	Exclude   []string               `yaml:"exclude,omitempty"`
+	Values    map[string]interface{} `yaml:"values,omitempty"`
 }
 
 func (p *Package) Parse(data []byte) error {
@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ProjectFileName is the name of the file describing images of a project.
+const ProjectFileName = "capstan.yaml"
+
+// Project lists images built together with `capstan build-all`. Packages
+// listed in the project-level Require are required by all images.
+type Project struct {
+	Require []string       `yaml:"require,omitempty"`
+	Images  []ProjectImage `yaml:"images"`
+}
+
+// ProjectImage describes how a single image of the project is composed. The
+// fields correspond to the options of `capstan package compose`.
+type ProjectImage struct {
+	Name        string   `yaml:"name"`
+	Package     string   `yaml:"package,omitempty"`
+	Require     []string `yaml:"require,omitempty"`
+	Run         string   `yaml:"run,omitempty"`
+	Boot        []string `yaml:"boot,omitempty"`
+	Env         []string `yaml:"env,omitempty"`
+	Fs          string   `yaml:"fs,omitempty"`
+	Size        string   `yaml:"size,omitempty"`
+	LoaderImage string   `yaml:"loader_image,omitempty"`
+	Format      []string `yaml:"format,omitempty"`
+}
+
+func (p *Project) Parse(data []byte) error {
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return err
+	}
+
+	if len(p.Images) == 0 {
+		return fmt.Errorf("'images' must list at least one image")
+	}
+
+	names := make(map[string]bool)
+	for i := range p.Images {
+		image := &p.Images[i]
+		if image.Name == "" {
+			return fmt.Errorf("'name' must be provided for image #%d", i+1)
+		}
+		if names[image.Name] {
+			return fmt.Errorf("image '%s' is listed more than once", image.Name)
+		}
+		names[image.Name] = true
+
+		if image.Package == "" {
+			image.Package = "."
+		}
+		if image.Fs == "" {
+			image.Fs = "zfs"
+		}
+		if image.Fs != "zfs" && image.Fs != "rofs" {
+			return fmt.Errorf("image '%s': unsupported filesystem '%s', use zfs or rofs", image.Name, image.Fs)
+		}
+		if image.Size == "" {
+			image.Size = "10G"
+		}
+		if image.LoaderImage == "" {
+			image.LoaderImage = "osv-loader"
+		}
+		if len(image.Format) == 0 {
+			image.Format = []string{"qcow2"}
+		}
+	}
+
+	return nil
+}
+
+// IsProjectFile returns true if the file at the given path is a valid project
+// file. Such a file is not part of the package in the same directory.
+func IsProjectFile(projectFile string) bool {
+	data, err := ioutil.ReadFile(projectFile)
+	if err != nil {
+		return false
+	}
+	var project Project
+	return project.Parse(data) == nil
+}
+
+// ParseProjectFile reads the project file. Package directories of the images
+// are resolved relative to the directory of the project file.
+func ParseProjectFile(projectFile string) (*Project, error) {
+	if _, err := os.Stat(projectFile); os.IsNotExist(err) {
+		return nil, fmt.Errorf("Project file %s does not exist", projectFile)
+	}
+
+	data, err := ioutil.ReadFile(projectFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var project Project
+	if err := project.Parse(data); err != nil {
+		return nil, fmt.Errorf("%s: %s", projectFile, err)
+	}
+
+	projectDir, err := filepath.Abs(filepath.Dir(projectFile))
+	if err != nil {
+		return nil, err
+	}
+	for i := range project.Images {
+		if !filepath.IsAbs(project.Images[i].Package) {
+			project.Images[i].Package = filepath.Join(projectDir, project.Images[i].Package)
+		}
+	}
+
+	return &project, nil
+}
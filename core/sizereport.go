@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SizeReport breaks down the content of an image by the packages it comes
+// from. It is stored next to index.yaml of the image, so that images can be
+// compared after they have been composed.
+type SizeReport struct {
+	// Package is the name of the package the image is composed of.
+	Package   string `yaml:"package"`
+	TotalSize int64  `yaml:"total_size"`
+	// Packages are sorted by their size, largest first.
+	Packages []PackageSize `yaml:"packages"`
+	// LargestFiles and LargestDirectories are sorted by size, largest first.
+	LargestFiles       []PathSize `yaml:"largest_files"`
+	LargestDirectories []PathSize `yaml:"largest_directories"`
+	// Shadowed are the files overriding files of other packages at the same
+	// path, sorted by path.
+	Shadowed []ShadowedFile `yaml:"shadowed,omitempty"`
+}
+
+// PackageSize is the size of the files a package contributes to the image.
+type PackageSize struct {
+	Name  string `yaml:"name"`
+	Size  int64  `yaml:"size"`
+	Files int    `yaml:"files"`
+}
+
+// PathSize is the size of a file or of all files within a directory.
+type PathSize struct {
+	Path    string `yaml:"path"`
+	Size    int64  `yaml:"size"`
+	Package string `yaml:"package,omitempty"`
+}
+
+// ShadowedFile is a file of Package that overrides the file of Shadows.
+type ShadowedFile struct {
+	Path    string `yaml:"path"`
+	Size    int64  `yaml:"size"`
+	Package string `yaml:"package"`
+	Shadows string `yaml:"shadows"`
+}
+
+// ParseSizeReport reads the size report stored at the given path.
+func ParseSizeReport(reportPath string) (*SizeReport, error) {
+	data, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &SizeReport{}
+	if err := yaml.Unmarshal(data, report); err != nil {
+		return nil, fmt.Errorf("%s: %s", reportPath, err)
+	}
+	return report, nil
+}
+
+// WriteToFile stores the size report at the given path.
+func (r *SizeReport) WriteToFile(reportPath string) error {
+	data, err := yaml.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(reportPath, data, 0644)
+}
+
+// String returns the report in a human readable form. Files of the package
+// that shadow files of the required packages are highlighted.
+func (r *SizeReport) String() string {
+	b := bytes.Buffer{}
+	fmt.Fprintf(&b, "%-16s %d\n", "Total size:", r.TotalSize)
+
+	fmt.Fprintln(&b, "Packages:")
+	for _, pkg := range r.Packages {
+		percent := 0.0
+		if r.TotalSize > 0 {
+			percent = 100 * float64(pkg.Size) / float64(r.TotalSize)
+		}
+		fmt.Fprintf(&b, "  %-40s %12d %5.1f%% %6d files\n", pkg.Name, pkg.Size, percent, pkg.Files)
+	}
+
+	fmt.Fprintln(&b, "Largest files:")
+	for _, file := range r.LargestFiles {
+		fmt.Fprintf(&b, "  %12d %s (%s)\n", file.Size, file.Path, file.Package)
+	}
+
+	fmt.Fprintln(&b, "Largest directories:")
+	for _, dir := range r.LargestDirectories {
+		fmt.Fprintf(&b, "  %12d %s\n", dir.Size, dir.Path)
+	}
+
+	if len(r.Shadowed) > 0 {
+		fmt.Fprintln(&b, "Shadowed files:")
+		for _, file := range r.Shadowed {
+			marker := " "
+			if file.Package == r.Package {
+				marker = "!"
+			}
+			fmt.Fprintf(&b, "%s %12d %s (%s shadows %s)\n", marker, file.Size, file.Path, file.Package, file.Shadows)
+		}
+	}
+
+	return b.String()
+}
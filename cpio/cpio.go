@@ -10,40 +10,144 @@ package cpio
 
 import (
 	"fmt"
-	"net"
+	"io"
 )
 
 const (
 	C_ISREG = 0100000
 	C_ISLNK = 0120000
 	C_ISDIR = 0040000
+
+	C_ISUID = 0004000
+	C_ISGID = 0002000
+	C_ISVTX = 0001000
+
+	// Mask of the file type bits of the mode.
+	C_IFMT = 0170000
+
+	MAGIC   = "070701"
+	TRAILER = "TRAILER!!!"
 )
 
-func WritePadded(c net.Conn, data []byte) {
-	c.Write(data)
-	partial := len(data) % 4
+// Header describes a single entry of the cpio archive in the "newc" format.
+// Hard links share the same inode number and only the first of them carries
+// the data.
+type Header struct {
+	Name  string
+	Mode  uint64
+	Ino   uint64
+	Nlink uint64
+	Mtime int64
+	Size  int64
+}
+
+// Bytes returns the header in the wire format, without padding.
+func (h *Header) Bytes() []byte {
+	hdr := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%s\u0000",
+		MAGIC,         // magic
+		h.Ino,         // inode
+		h.Mode,        // mode
+		0,             // uid
+		0,             // gid
+		h.Nlink,       // nlink
+		h.Mtime,       // mtime
+		h.Size,        // filesize
+		0,             // devmajor
+		0,             // devminor
+		0,             // rdevmajor
+		0,             // rdevminor
+		len(h.Name)+1, // namesize
+		0,             // check
+		h.Name)
+	return []byte(hdr)
+}
+
+func WritePadded(w io.Writer, data []byte) error {
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return writePadding(w, int64(len(data)))
+}
+
+func writePadding(w io.Writer, length int64) error {
+	partial := length % 4
 	if partial != 0 {
 		padding := make([]byte, 4-partial)
-		c.Write(padding)
+		if _, err := w.Write(padding); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func ToWireFormat(filename string, mode uint64, filesize int64) []byte {
-	hdr := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%s\u0000",
-		"070701",        // magic
-		0,               // inode
-		mode,            // mode
-		0,               // uid
-		0,               // gid
-		0,               // nlink
-		0,               // mtime
-		filesize,        // filesize
-		0,               // devmajor
-		0,               // devminor
-		0,               // rdevmajor
-		0,               // rdevminor
-		len(filename)+1, // namesize
-		0,               // check
-		filename)
-	return []byte(hdr)
+	h := Header{Name: filename, Mode: mode, Size: filesize}
+	return h.Bytes()
+}
+
+// Writer writes entries of a cpio archive to the underlying stream.
+type Writer struct {
+	w       io.Writer
+	nextIno uint64
+	links   map[interface{}]uint64
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, nextIno: 1, links: make(map[interface{}]uint64)}
+}
+
+// WriteEntry writes the header followed by exactly h.Size bytes read from
+// data. Entries without an inode number get a unique one.
+func (w *Writer) WriteEntry(h *Header, data io.Reader) error {
+	if h.Ino == 0 {
+		h.Ino = w.allocateIno()
+	}
+	if h.Nlink == 0 {
+		h.Nlink = 1
+	}
+
+	if err := WritePadded(w.w, h.Bytes()); err != nil {
+		return err
+	}
+	if h.Size == 0 {
+		return nil
+	}
+	if data == nil {
+		return fmt.Errorf("%s: missing %d bytes of data", h.Name, h.Size)
+	}
+
+	n, err := io.Copy(w.w, io.LimitReader(data, h.Size))
+	if err != nil {
+		return err
+	}
+	if n != h.Size {
+		return fmt.Errorf("%s: expected %d bytes of data, got %d", h.Name, h.Size, n)
+	}
+	return writePadding(w.w, n)
+}
+
+// WriteHardLink writes the entry of a file that might have several hard links.
+// The key identifies the file on the host. The first entry with a given key
+// carries the data, the following ones only refer to the same inode.
+func (w *Writer) WriteHardLink(h *Header, key interface{}, data io.Reader) error {
+	if ino, ok := w.links[key]; ok {
+		h.Ino = ino
+		h.Size = 0
+		return w.WriteEntry(h, nil)
+	}
+
+	h.Ino = w.allocateIno()
+	w.links[key] = h.Ino
+	return w.WriteEntry(h, data)
+}
+
+// Close writes the trailer of the archive. The underlying stream is left open.
+func (w *Writer) Close() error {
+	return WritePadded(w.w, ToWireFormat(TRAILER, 0, 0))
+}
+
+func (w *Writer) allocateIno() uint64 {
+	ino := w.nextIno
+	w.nextIno++
+	return ino
 }
@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cpio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type cpioSuite struct{}
+
+var _ = Suite(&cpioSuite{})
+
+func (*cpioSuite) TestWriteAndRead(c *C) {
+	buf := bytes.Buffer{}
+	w := NewWriter(&buf)
+	c.Assert(w.WriteEntry(&Header{Name: "/dir", Mode: C_ISDIR | 0755, Mtime: 1500000000}, nil), IsNil)
+	c.Assert(w.WriteEntry(&Header{Name: "/dir/file", Mode: C_ISREG | 0644, Size: 5}, strings.NewReader("hello")), IsNil)
+	c.Assert(w.WriteEntry(&Header{Name: "/dir/link", Mode: C_ISLNK | 0777, Size: 4}, strings.NewReader("file")), IsNil)
+	c.Assert(w.WriteHardLink(&Header{Name: "/a", Mode: C_ISREG | 0644, Nlink: 2, Size: 3}, "key", strings.NewReader("abc")), IsNil)
+	c.Assert(w.WriteHardLink(&Header{Name: "/b", Mode: C_ISREG | 0644, Nlink: 2, Size: 3}, "key", strings.NewReader("abc")), IsNil)
+	c.Assert(w.Close(), IsNil)
+	c.Check(buf.Len()%4, Equals, 0)
+
+	// This is what we're testing here.
+	r := NewReader(&buf)
+	var headers []Header
+	var contents []string
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(r)
+		c.Assert(err, IsNil)
+		headers = append(headers, *h)
+		contents = append(contents, string(data))
+	}
+
+	// Expectations.
+	c.Check(headers, DeepEquals, []Header{
+		{Name: "/dir", Mode: C_ISDIR | 0755, Ino: 1, Nlink: 1, Mtime: 1500000000},
+		{Name: "/dir/file", Mode: C_ISREG | 0644, Ino: 2, Nlink: 1, Size: 5},
+		{Name: "/dir/link", Mode: C_ISLNK | 0777, Ino: 3, Nlink: 1, Size: 4},
+		{Name: "/a", Mode: C_ISREG | 0644, Ino: 4, Nlink: 2, Size: 3},
+		{Name: "/b", Mode: C_ISREG | 0644, Ino: 4, Nlink: 2},
+	})
+	c.Check(contents, DeepEquals, []string{"", "hello", "file", "abc", ""})
+}
+
+func (*cpioSuite) TestWriteEntryShortData(c *C) {
+	w := NewWriter(&bytes.Buffer{})
+
+	// This is what we're testing here.
+	err := w.WriteEntry(&Header{Name: "/file", Mode: C_ISREG, Size: 10}, strings.NewReader("short"))
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "/file: expected 10 bytes of data, got 5")
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func (*cpioSuite) TestWriteErrorsAreReturned(c *C) {
+	// This is what we're testing here.
+	err := WritePadded(failingWriter{}, []byte("data"))
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "connection reset")
+	c.Check(NewWriter(failingWriter{}).Close(), ErrorMatches, "connection reset")
+}
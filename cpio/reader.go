@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cpio
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+const headerLength = 110
+
+// Reader reads entries of a cpio archive in the "newc" format, the same way
+// cpiod does in the guest.
+type Reader struct {
+	r         *bufio.Reader
+	remaining int64
+	padding   int64
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next skips the rest of the current entry and returns the header of the next
+// one. io.EOF is returned once the trailer is reached.
+func (r *Reader) Next() (*Header, error) {
+	if _, err := io.CopyN(ioutil.Discard, r.r, r.remaining+r.padding); err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, headerLength)
+	if _, err := io.ReadFull(r.r, raw); err != nil {
+		return nil, err
+	}
+	if string(raw[:6]) != MAGIC {
+		return nil, fmt.Errorf("invalid cpio header magic %q", raw[:6])
+	}
+
+	var fields [13]uint64
+	for i := range fields {
+		value, err := strconv.ParseUint(string(raw[6+i*8:14+i*8]), 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpio header: %s", err)
+		}
+		fields[i] = value
+	}
+
+	name := make([]byte, fields[11])
+	if _, err := io.ReadFull(r.r, name); err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, r.r, padding(headerLength+int64(len(name)))); err != nil {
+		return nil, err
+	}
+
+	h := &Header{
+		Name:  string(name[:len(name)-1]),
+		Ino:   fields[0],
+		Mode:  fields[1],
+		Nlink: fields[4],
+		Mtime: int64(fields[5]),
+		Size:  int64(fields[6]),
+	}
+	if h.Name == TRAILER {
+		return nil, io.EOF
+	}
+
+	r.remaining = h.Size
+	r.padding = padding(h.Size)
+	return h, nil
+}
+
+// Read reads data of the current entry.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.r.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+func padding(length int64) int64 {
+	return (4 - length%4) % 4
+}
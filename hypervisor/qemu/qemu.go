@@ -12,6 +12,7 @@ import (
 	"bufio"
 	"fmt"
 	"github.com/cloudius-systems/capstan/hypervisor"
+	"github.com/cloudius-systems/capstan/image/qcow2"
 	"github.com/cloudius-systems/capstan/nat"
 	"github.com/cloudius-systems/capstan/util"
 	"gopkg.in/yaml.v2"
@@ -161,13 +162,11 @@ func VMCommand(c *VMConfig, verbose bool, extra ...string) (*exec.Cmd, error) {
 			fmt.Printf("Failed to open image %s\n", c.Image)
 			return nil, err
 		}
-		backingFile := "backing_file=" + image
 		newDisk := dir + "/disk.qcow2"
 
 		if _, err := os.Stat(newDisk); os.IsNotExist(err) {
-			cmd := exec.Command("qemu-img", "create", "-f", "qcow2", "-F", "qcow2", "-o", backingFile, newDisk)
-			if stdout, err := cmd.CombinedOutput(); err != nil {
-				return nil, fmt.Errorf("qemu-img failed: %s\n%s", stdout, err)
+			if err := qcow2.Create(newDisk, 0, image); err != nil {
+				return nil, fmt.Errorf("Failed to create disk %s backed by %s: %s", newDisk, image, err)
 			}
 		}
 		c.Image = newDisk
@@ -177,7 +176,9 @@ func VMCommand(c *VMConfig, verbose bool, extra ...string) (*exec.Cmd, error) {
 
 	if c.Cmd != "" {
 		fmt.Printf("Setting cmdline: %s\n", c.Cmd)
-		util.SetCmdLine(c.Image, c.Cmd)
+		if err := util.SetCmdLine(c.Image, c.Cmd); err != nil {
+			return nil, err
+		}
 	}
 
 	if c.Persist {
@@ -471,6 +472,19 @@ func CreateVolume(path, format string, sizeMB int64) error {
 	if _, err := os.Stat(path); err == nil {
 		return fmt.Errorf("Volume already exists")
 	}
+	size := sizeMB * 1024 * 1024
+	switch format {
+	case "raw":
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return f.Truncate(size)
+	case "qcow2":
+		return qcow2.Create(path, size, "")
+	}
+
 	cmd := exec.Command("qemu-img", "create", "-f", format, path, fmt.Sprintf("%dM", sizeMB))
 	if stdout, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("%s\n%s", stdout, err)
@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cloudius-systems/capstan/image/mbr"
+	"github.com/cloudius-systems/capstan/image/qcow2"
+	"github.com/cloudius-systems/capstan/image/rofs"
+)
+
+const (
+	// The boot command line is stored in the sectors following the boot
+	// sector, up to the sector where the loader starts.
+	CMDLINE_OFFSET   = 512
+	CMDLINE_MAX_SIZE = 63 * 512
+
+	// ZFS uberblocks are stored in the second half of the first 256kB label
+	// of a vdev.
+	ZFS_UBERBLOCK_OFFSET = 128 * 1024
+	ZFS_UBERBLOCK_SIZE   = 1024
+	ZFS_UBERBLOCK_MAGIC  = 0x00bab10c
+)
+
+// Disk gives read access to the virtual disk content of an image regardless
+// of its format.
+type Disk interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+type rawDisk struct {
+	*os.File
+	size int64
+}
+
+func (d *rawDisk) Size() int64 {
+	return d.size
+}
+
+// OpenDisk opens the QCOW2 or raw image at the given path for reading.
+func OpenDisk(path string) (Disk, error) {
+	format, err := Probe(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case QCOW2:
+		return qcow2.Open(path)
+	case RAW:
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &rawDisk{File: f, size: info.Size()}, nil
+	default:
+		return nil, fmt.Errorf("%s: only QCOW2 and raw images can be read", path)
+	}
+}
+
+// RofsPartition locates the ROFS partition through the MBR partition table of
+// the disk. The number of the partition (counted from 1) is returned along
+// with its entry.
+func RofsPartition(disk Disk) (int, mbr.Partition, error) {
+	partitions, err := mbr.ReadPartitions(disk)
+	if err != nil {
+		return 0, mbr.Partition{}, fmt.Errorf("failed to read partition table: %s", err)
+	}
+
+	for i, partition := range partitions {
+		if partition.IsEmpty() || partition.Start() >= disk.Size() {
+			continue
+		}
+		if rofs.Probe(rofsSection(disk, partition)) {
+			return i + 1, partition, nil
+		}
+	}
+
+	return 0, mbr.Partition{}, fmt.Errorf("no ROFS partition found")
+}
+
+// OpenRofs locates the ROFS partition of the disk and reads its filesystem
+// structure.
+func OpenRofs(disk Disk) (*rofs.Filesystem, error) {
+	_, partition, err := RofsPartition(disk)
+	if err != nil {
+		return nil, err
+	}
+	return rofs.Open(rofsSection(disk, partition))
+}
+
+// rofsSection returns the content of the partition. The filesystem structure
+// may extend past the last full sector of the partition, so the filesystem is
+// read up to the end of the disk.
+func rofsSection(disk Disk, partition mbr.Partition) *io.SectionReader {
+	return io.NewSectionReader(disk, partition.Start(), disk.Size()-partition.Start())
+}
+
+// ReadCmdLine reads the boot command line stored in the image.
+func ReadCmdLine(disk Disk) (string, error) {
+	data := make([]byte, CMDLINE_MAX_SIZE)
+	n, err := disk.ReadAt(data, CMDLINE_OFFSET)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	data = data[:n]
+	if end := bytes.IndexByte(data, 0); end >= 0 {
+		data = data[:end]
+	}
+	return string(data), nil
+}
+
+// ProbeFilesystem returns type of the filesystem stored in the partition
+// (ROFS or ZFS) or an empty string if the filesystem is not recognized.
+func ProbeFilesystem(disk Disk, partition mbr.Partition) string {
+	if partition.Start() >= disk.Size() {
+		return ""
+	}
+	section := io.NewSectionReader(disk, partition.Start(), disk.Size()-partition.Start())
+
+	if rofs.Probe(section) {
+		return "ROFS"
+	}
+
+	uberblocks := make([]byte, ZFS_UBERBLOCK_OFFSET)
+	if _, err := section.ReadAt(uberblocks, ZFS_UBERBLOCK_OFFSET); err != nil && err != io.EOF {
+		return ""
+	}
+	for offset := 0; offset+8 <= len(uberblocks); offset += ZFS_UBERBLOCK_SIZE {
+		magic := uberblocks[offset : offset+8]
+		// Uberblock is stored in the native byte order of the host that wrote it.
+		if binary.LittleEndian.Uint64(magic) == ZFS_UBERBLOCK_MAGIC || binary.BigEndian.Uint64(magic) == ZFS_UBERBLOCK_MAGIC {
+			return "ZFS"
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package mbr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	SECTOR_SIZE = 512
+
+	LINUX_SYSTEM_ID = 0x83
+
+	PARTITION_TABLE_OFFSET = 0x1be
+	PARTITION_ENTRY_SIZE   = 0x10
+	PARTITIONS_COUNT       = 4
+)
+
+// Partition is a primary partition entry of the MBR partition table.
+type Partition struct {
+	Status      uint8
+	FirstCHS    [3]byte
+	SystemId    uint8
+	LastCHS     [3]byte
+	FirstSector uint32
+	Sectors     uint32
+}
+
+// Start returns the offset of the partition in bytes.
+func (p *Partition) Start() int64 {
+	return int64(p.FirstSector) * SECTOR_SIZE
+}
+
+// Size returns the size of the partition in bytes.
+func (p *Partition) Size() int64 {
+	return int64(p.Sectors) * SECTOR_SIZE
+}
+
+// IsEmpty tells whether the partition entry is unused.
+func (p *Partition) IsEmpty() bool {
+	return p.SystemId == 0 && p.Sectors == 0
+}
+
+// ReadPartitions reads all four primary partition entries from the
+// first sector of the disk.
+func ReadPartitions(r io.ReaderAt) ([PARTITIONS_COUNT]Partition, error) {
+	var partitions [PARTITIONS_COUNT]Partition
+
+	table := make([]byte, PARTITIONS_COUNT*PARTITION_ENTRY_SIZE)
+	if _, err := r.ReadAt(table, PARTITION_TABLE_OFFSET); err != nil {
+		return partitions, err
+	}
+
+	err := binary.Read(bytes.NewReader(table), binary.LittleEndian, &partitions)
+	return partitions, err
+}
+
+// NewPartition creates partition entry of the given start and size in bytes.
+func NewPartition(start uint64, size uint64, systemId uint8) Partition {
+	return Partition{
+		FirstCHS:    chsAddress(start / SECTOR_SIZE),
+		SystemId:    systemId,
+		LastCHS:     chsAddress((start + size) / SECTOR_SIZE),
+		FirstSector: uint32(start / SECTOR_SIZE),
+		Sectors:     uint32(size / SECTOR_SIZE),
+	}
+}
+
+// Bytes returns the on-disk representation of the partition entry.
+func (p *Partition) Bytes() []byte {
+	buf := bytes.Buffer{}
+	binary.Write(&buf, binary.LittleEndian, p)
+	return buf.Bytes()
+}
+
+// PartitionOffset returns the offset of the entry of the given partition
+// (numbered from 1) within the first sector.
+func PartitionOffset(partition int) int64 {
+	return PARTITION_TABLE_OFFSET + int64(partition-1)*PARTITION_ENTRY_SIZE
+}
+
+func chsAddress(x uint64) [3]byte {
+	c, h, s := chs(x)
+	cs := uint16(c<<6 | s)
+	return [3]byte{byte(h), byte(cs), byte(cs >> 8)}
+}
+
+func chs(x uint64) (uint64, uint64, uint64) {
+	sectorsPerTrack := uint64(63)
+	heads := uint64(255)
+
+	c := (x / sectorsPerTrack) / heads
+	h := (x / sectorsPerTrack) % heads
+	s := (x % sectorsPerTrack) + 1
+
+	if c > 1023 {
+		c = 1023
+		h = 254
+		s = 63
+	}
+
+	return c, h, s
+}
@@ -27,6 +27,25 @@ const (
 	Unknown
 )
 
+func (f ImageFormat) String() string {
+	switch f {
+	case QCOW2:
+		return "QCOW2"
+	case VDI:
+		return "VDI"
+	case VMDK:
+		return "VMDK"
+	case GCE_TARBALL:
+		return "GCE tarball"
+	case GCE_GS:
+		return "GCE image"
+	case RAW:
+		return "raw"
+	default:
+		return "unknown"
+	}
+}
+
 func Probe(path string) (ImageFormat, error) {
 	if gce.ProbeGS(path) {
 		return GCE_GS, nil
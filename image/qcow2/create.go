@@ -0,0 +1,406 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	DEFAULT_CLUSTER_BITS = 16
+
+	// Version 3 header length (without header extensions).
+	HEADER_V3_LENGTH = 104
+
+	// Header extension holding format of the backing file.
+	BACKING_FORMAT_EXTENSION = 0xE2792ACA
+)
+
+// Create creates an empty QCOW2 image of the given virtual size. If backingFile
+// is set, the image is an overlay of that file and size of zero means the
+// size of the backing file.
+func Create(path string, size int64, backingFile string) error {
+	backingFormat := ""
+	if backingFile != "" {
+		var backingSize int64
+		var err error
+		backingPath := backingFile
+		if !filepath.IsAbs(backingPath) {
+			backingPath = filepath.Join(filepath.Dir(path), backingPath)
+		}
+		if backingFormat, backingSize, err = probeBackingFile(backingPath); err != nil {
+			return err
+		}
+		if size == 0 {
+			size = backingSize
+		}
+	}
+
+	b, err := newBuilder(path, size, backingFile, backingFormat)
+	if err != nil {
+		return err
+	}
+	defer b.file.Close()
+
+	return b.finish()
+}
+
+// ConvertFromRaw converts the raw image to QCOW2 image. Clusters that contain
+// only zeros are not allocated in the resulting image.
+func ConvertFromRaw(rawPath string, path string) error {
+	raw, err := os.Open(rawPath)
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+
+	info, err := raw.Stat()
+	if err != nil {
+		return err
+	}
+	// Virtual size is always a multiple of the sector size.
+	size := (info.Size() + 511) / 512 * 512
+
+	b, err := newBuilder(path, size, "", "")
+	if err != nil {
+		return err
+	}
+	defer b.file.Close()
+
+	data := make([]byte, b.clusterSize)
+	for cluster := int64(0); ; cluster++ {
+		n, err := io.ReadFull(raw, data)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		zero(data[n:])
+
+		if !isZero(data) {
+			if err := b.writeCluster(cluster, data); err != nil {
+				return err
+			}
+		}
+		if n < len(data) {
+			break
+		}
+	}
+
+	return b.finish()
+}
+
+// Resize changes the virtual size of the image. Only growing is supported.
+func Resize(path string, size int64) error {
+	img, err := OpenForUpdate(path)
+	if err != nil {
+		return err
+	}
+
+	if err := img.resize(size); err != nil {
+		img.Close()
+		return err
+	}
+
+	return img.Close()
+}
+
+func (img *Image) resize(size int64) error {
+	if size < img.Size() {
+		return fmt.Errorf("shrinking of QCOW2 images is not supported")
+	}
+
+	l1Size := l1SizeFor(size, img.clusterSize)
+	if l1Size > int64(len(img.l1Table)) {
+		l1Table := make([]uint64, l1Size)
+		copy(l1Table, img.l1Table)
+
+		l1Offset := int64(img.Header.L1TableOffset)
+		oldClusters := clustersFor(int64(len(img.l1Table))*8, img.clusterSize)
+		newClusters := clustersFor(l1Size*8, img.clusterSize)
+		if newClusters > oldClusters {
+			// L1 table has to be contiguous, so it is moved to the end of the file.
+			var err error
+			if l1Offset, err = img.allocateClusters(newClusters); err != nil {
+				return err
+			}
+		}
+		if err := writeTable(img.file, l1Offset, l1Table); err != nil {
+			return err
+		}
+
+		oldL1Offset := int64(img.Header.L1TableOffset)
+		img.l1Table = l1Table
+		img.Header.L1TableOffset = uint64(l1Offset)
+		img.Header.L1Size = uint32(l1Size)
+		img.Header.Size = uint64(size)
+		if err := img.writeHeader(); err != nil {
+			return err
+		}
+
+		if l1Offset != oldL1Offset {
+			for i := int64(0); i < oldClusters; i++ {
+				if err := img.setRefcount(oldL1Offset+i*img.clusterSize, 0); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	img.Header.Size = uint64(size)
+	return img.writeHeader()
+}
+
+func (img *Image) writeHeader() error {
+	buf := bytes.Buffer{}
+	if err := binary.Write(&buf, binary.BigEndian, &img.Header); err != nil {
+		return err
+	}
+	_, err := img.file.WriteAt(buf.Bytes(), 0)
+	return err
+}
+
+func writeTable(w io.WriterAt, offset int64, table []uint64) error {
+	buf := bytes.Buffer{}
+	if err := binary.Write(&buf, binary.BigEndian, table); err != nil {
+		return err
+	}
+	_, err := w.WriteAt(buf.Bytes(), offset)
+	return err
+}
+
+func probeBackingFile(backingFile string) (string, int64, error) {
+	f, err := os.Open(backingFile)
+	if err != nil {
+		return "", 0, err
+	}
+	isQcow2 := Probe(f)
+	f.Close()
+
+	if isQcow2 {
+		backing, err := Open(backingFile)
+		if err != nil {
+			return "", 0, err
+		}
+		defer backing.Close()
+		return "qcow2", backing.Size(), nil
+	}
+
+	info, err := os.Stat(backingFile)
+	if err != nil {
+		return "", 0, err
+	}
+	return "raw", info.Size(), nil
+}
+
+// builder writes a new image sequentially: the header cluster and the L1 table
+// come first, followed by the data clusters, L2 tables and finally the
+// refcount table and refcount blocks. Every cluster is used exactly once.
+type builder struct {
+	file          *os.File
+	clusterSize   int64
+	size          int64
+	backingFile   string
+	backingFormat string
+	l1Table       []uint64
+	l2Tables      map[int64][]uint64
+	nextCluster   int64
+}
+
+func newBuilder(path string, size int64, backingFile string, backingFormat string) (*builder, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid QCOW2 image size %d", size)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	clusterSize := int64(1) << DEFAULT_CLUSTER_BITS
+	l1Size := l1SizeFor(size, clusterSize)
+	l1Clusters := clustersFor(l1Size*8, clusterSize)
+	if l1Clusters == 0 {
+		l1Clusters = 1
+	}
+
+	return &builder{
+		file:          f,
+		clusterSize:   clusterSize,
+		size:          size,
+		backingFile:   backingFile,
+		backingFormat: backingFormat,
+		l1Table:       make([]uint64, l1Size),
+		l2Tables:      make(map[int64][]uint64),
+		nextCluster:   1 + l1Clusters,
+	}, nil
+}
+
+func (b *builder) l2Entries() int64 {
+	return b.clusterSize / 8
+}
+
+func (b *builder) allocate() int64 {
+	offset := b.nextCluster * b.clusterSize
+	b.nextCluster++
+	return offset
+}
+
+// writeCluster stores data of the given virtual cluster.
+func (b *builder) writeCluster(cluster int64, data []byte) error {
+	offset := b.allocate()
+	if _, err := b.file.WriteAt(data, offset); err != nil {
+		return err
+	}
+
+	l1Index := cluster / b.l2Entries()
+	l2Table, ok := b.l2Tables[l1Index]
+	if !ok {
+		l2Table = make([]uint64, b.l2Entries())
+		b.l2Tables[l1Index] = l2Table
+	}
+	l2Table[cluster%b.l2Entries()] = uint64(offset) | OFLAG_COPIED
+	return nil
+}
+
+func (b *builder) finish() error {
+	//
+	// Write L2 tables and L1 table
+	var l1Indices []int64
+	for l1Index := range b.l2Tables {
+		l1Indices = append(l1Indices, l1Index)
+	}
+	sort.Slice(l1Indices, func(i, j int) bool { return l1Indices[i] < l1Indices[j] })
+	for _, l1Index := range l1Indices {
+		offset := b.allocate()
+		if err := writeTable(b.file, offset, b.l2Tables[l1Index]); err != nil {
+			return err
+		}
+		b.l1Table[l1Index] = uint64(offset) | OFLAG_COPIED
+	}
+	if err := writeTable(b.file, b.clusterSize, b.l1Table); err != nil {
+		return err
+	}
+	//
+	// Refcount table and blocks have to account for themselves as well
+	refcountsPerBlock := b.clusterSize / 2
+	usedClusters := b.nextCluster
+	tableClusters, blocks := int64(1), int64(1)
+	for {
+		total := usedClusters + tableClusters + blocks
+		newBlocks := clustersFor(total, refcountsPerBlock)
+		newTableClusters := clustersFor(newBlocks*8, b.clusterSize)
+		if newBlocks == blocks && newTableClusters == tableClusters {
+			break
+		}
+		blocks, tableClusters = newBlocks, newTableClusters
+	}
+	totalClusters := usedClusters + tableClusters + blocks
+
+	refcountTable := make([]uint64, tableClusters*b.clusterSize/8)
+	for i := int64(0); i < blocks; i++ {
+		refcountTable[i] = uint64((usedClusters + tableClusters + i) * b.clusterSize)
+	}
+	if err := writeTable(b.file, usedClusters*b.clusterSize, refcountTable); err != nil {
+		return err
+	}
+
+	refcounts := make([]uint16, blocks*refcountsPerBlock)
+	for i := int64(0); i < totalClusters; i++ {
+		refcounts[i] = 1
+	}
+	buf := bytes.Buffer{}
+	if err := binary.Write(&buf, binary.BigEndian, refcounts); err != nil {
+		return err
+	}
+	if _, err := b.file.WriteAt(buf.Bytes(), (usedClusters+tableClusters)*b.clusterSize); err != nil {
+		return err
+	}
+	//
+	// Write header
+	header := Header{
+		Magic:                 QCOW2_MAGIC,
+		Version:               3,
+		ClusterBits:           DEFAULT_CLUSTER_BITS,
+		Size:                  uint64(b.size),
+		L1Size:                uint32(len(b.l1Table)),
+		L1TableOffset:         uint64(b.clusterSize),
+		RefcountTableOffset:   uint64(usedClusters * b.clusterSize),
+		RefcountTableClusters: uint32(tableClusters),
+	}
+	headerV3 := HeaderV3{
+		RefcountOrder: 4,
+		HeaderLength:  HEADER_V3_LENGTH,
+	}
+
+	headerCluster := bytes.Buffer{}
+	binary.Write(&headerCluster, binary.BigEndian, &header)
+	binary.Write(&headerCluster, binary.BigEndian, &headerV3)
+	if b.backingFormat != "" {
+		writeHeaderExtension(&headerCluster, BACKING_FORMAT_EXTENSION, []byte(b.backingFormat))
+	}
+	// End of header extensions
+	writeHeaderExtension(&headerCluster, 0, nil)
+	if b.backingFile != "" {
+		header.BackingFileOffset = uint64(headerCluster.Len())
+		header.BackingFileSize = uint32(len(b.backingFile))
+		headerCluster.WriteString(b.backingFile)
+
+		// Header has to be written again with the backing file information.
+		fixedHeader := bytes.Buffer{}
+		binary.Write(&fixedHeader, binary.BigEndian, &header)
+		copy(headerCluster.Bytes(), fixedHeader.Bytes())
+	}
+	if int64(headerCluster.Len()) > b.clusterSize {
+		return fmt.Errorf("QCOW2 header does not fit into a single cluster")
+	}
+	if _, err := b.file.WriteAt(headerCluster.Bytes(), 0); err != nil {
+		return err
+	}
+
+	if err := b.file.Truncate(totalClusters * b.clusterSize); err != nil {
+		return err
+	}
+	return b.file.Sync()
+}
+
+func writeHeaderExtension(buf *bytes.Buffer, extensionType uint32, data []byte) {
+	binary.Write(buf, binary.BigEndian, extensionType)
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+	// Extension data is padded to a multiple of 8 bytes.
+	for buf.Len()%8 != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+// l1SizeFor returns number of L1 table entries needed for a disk of given size.
+func l1SizeFor(size int64, clusterSize int64) int64 {
+	return clustersFor(size, clusterSize*clusterSize/8)
+}
+
+func clustersFor(size int64, clusterSize int64) int64 {
+	return (size + clusterSize - 1) / clusterSize
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,363 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type suite struct{}
+
+var _ = Suite(&suite{})
+
+func (*suite) TestReadEmptyImage(c *C) {
+	imagePath := createTestImage(c, 1<<20, "")
+	img, err := Open(imagePath)
+	c.Assert(err, IsNil)
+	defer img.Close()
+
+	// This is what we're testing here.
+	data := make([]byte, 4096)
+	n, err := img.ReadAt(data, 1<<19)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, len(data))
+	c.Check(data, DeepEquals, make([]byte, len(data)))
+	c.Check(img.Size(), Equals, int64(1<<20))
+}
+
+func (*suite) TestWriteAllocatesClusters(c *C) {
+	imagePath := createTestImage(c, 1<<20, "")
+	img, err := OpenForUpdate(imagePath)
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here. Second write spans two clusters.
+	_, err = img.WriteAt([]byte("hello"), 512)
+	c.Assert(err, IsNil)
+	_, err = img.WriteAt(bytes.Repeat([]byte{'x'}, 100), 65536-50)
+	c.Assert(err, IsNil)
+	c.Assert(img.Close(), IsNil)
+
+	// Expectations.
+	img, err = Open(imagePath)
+	c.Assert(err, IsNil)
+	defer img.Close()
+	data := make([]byte, 65536+100)
+	_, err = img.ReadAt(data, 0)
+	c.Assert(err, IsNil)
+	c.Check(string(data[512:517]), Equals, "hello")
+	c.Check(data[65536-50:65536+50], DeepEquals, bytes.Repeat([]byte{'x'}, 100))
+	c.Check(data[0:512], DeepEquals, make([]byte, 512))
+	checkRefcounts(c, imagePath)
+}
+
+func (*suite) TestWriteInPlace(c *C) {
+	imagePath := createTestImage(c, 1<<20, "")
+	img, err := OpenForUpdate(imagePath)
+	c.Assert(err, IsNil)
+	_, err = img.WriteAt([]byte("first"), 512)
+	c.Assert(err, IsNil)
+	c.Assert(img.Close(), IsNil)
+	info, err := os.Stat(imagePath)
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	img, err = OpenForUpdate(imagePath)
+	c.Assert(err, IsNil)
+	_, err = img.WriteAt([]byte("second"), 1024)
+	c.Assert(err, IsNil)
+	c.Assert(img.Close(), IsNil)
+
+	// Expectations.
+	updated, err := os.Stat(imagePath)
+	c.Assert(err, IsNil)
+	c.Check(updated.Size(), Equals, info.Size())
+	img, err = Open(imagePath)
+	c.Assert(err, IsNil)
+	defer img.Close()
+	data := make([]byte, 1030)
+	_, err = img.ReadAt(data, 0)
+	c.Assert(err, IsNil)
+	c.Check(string(data[512:517]), Equals, "first")
+	c.Check(string(data[1024:1030]), Equals, "second")
+	checkRefcounts(c, imagePath)
+}
+
+func (*suite) TestWriteCopiesBackingFile(c *C) {
+	tmp := c.MkDir()
+	backing := bytes.Repeat([]byte("0123456789abcdef"), 8192)
+	c.Assert(ioutil.WriteFile(filepath.Join(tmp, "base.raw"), backing, 0644), IsNil)
+	imagePath := createTestImage(c, int64(len(backing)), filepath.Join(tmp, "base.raw"))
+
+	img, err := OpenForUpdate(imagePath)
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	_, err = img.WriteAt([]byte("cmdline"), 512)
+	c.Assert(err, IsNil)
+	c.Assert(img.Close(), IsNil)
+
+	// Expectations.
+	img, err = Open(imagePath)
+	c.Assert(err, IsNil)
+	defer img.Close()
+	data := make([]byte, len(backing))
+	_, err = img.ReadAt(data, 0)
+	c.Assert(err, IsNil)
+	expected := append([]byte{}, backing...)
+	copy(expected[512:], "cmdline")
+	c.Check(data, DeepEquals, expected)
+	checkRefcounts(c, imagePath)
+
+	// Backing file must be left intact.
+	base, err := ioutil.ReadFile(filepath.Join(tmp, "base.raw"))
+	c.Assert(err, IsNil)
+	c.Check(base, DeepEquals, backing)
+}
+
+func (*suite) TestWriteBeyondDiskSize(c *C) {
+	imagePath := createTestImage(c, 1<<20, "")
+	img, err := OpenForUpdate(imagePath)
+	c.Assert(err, IsNil)
+	defer img.Close()
+
+	// This is what we're testing here.
+	_, err = img.WriteAt([]byte("x"), 1<<20)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "write of 1 bytes at 1048576 is beyond the disk size 1048576")
+}
+
+func (*suite) TestCreate(c *C) {
+	imagePath := filepath.Join(c.MkDir(), "disk.qcow2")
+
+	// This is what we're testing here.
+	err := Create(imagePath, 10<<30, "")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	img, err := Open(imagePath)
+	c.Assert(err, IsNil)
+	defer img.Close()
+	c.Check(img.Header.Version, Equals, uint32(3))
+	c.Check(img.Size(), Equals, int64(10<<30))
+	c.Check(img.BackingFile, Equals, "")
+	info, err := os.Stat(imagePath)
+	c.Assert(err, IsNil)
+	c.Check(info.Size(), Equals, int64(4*65536))
+	checkRefcounts(c, imagePath)
+}
+
+func (*suite) TestCreateWithBackingFile(c *C) {
+	tmp := c.MkDir()
+	backingPath := filepath.Join(tmp, "base.qcow2")
+	rawPath := filepath.Join(tmp, "base.raw")
+	c.Assert(ioutil.WriteFile(rawPath, bytes.Repeat([]byte("osv"), 100000), 0644), IsNil)
+	c.Assert(ConvertFromRaw(rawPath, backingPath), IsNil)
+	imagePath := filepath.Join(tmp, "disk.qcow2")
+
+	// This is what we're testing here.
+	err := Create(imagePath, 0, backingPath)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	img, err := Open(imagePath)
+	c.Assert(err, IsNil)
+	defer img.Close()
+	c.Check(img.BackingFile, Equals, backingPath)
+	c.Check(img.Size(), Equals, int64(300032))
+	data := make([]byte, 300000)
+	_, err = img.ReadAt(data, 0)
+	c.Assert(err, IsNil)
+	c.Check(data, DeepEquals, bytes.Repeat([]byte("osv"), 100000))
+	checkRefcounts(c, imagePath)
+}
+
+func (*suite) TestConvertFromRaw(c *C) {
+	tmp := c.MkDir()
+	rawPath := filepath.Join(tmp, "disk.raw")
+	raw := make([]byte, 8<<20)
+	copy(raw, "boot sector")
+	copy(raw[5<<20:], "data in the middle")
+	copy(raw[len(raw)-3:], "end")
+	c.Assert(ioutil.WriteFile(rawPath, raw, 0644), IsNil)
+	imagePath := filepath.Join(tmp, "disk.qcow2")
+
+	// This is what we're testing here.
+	err := ConvertFromRaw(rawPath, imagePath)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	img, err := Open(imagePath)
+	c.Assert(err, IsNil)
+	defer img.Close()
+	c.Check(img.Size(), Equals, int64(len(raw)))
+	data := make([]byte, len(raw))
+	_, err = img.ReadAt(data, 0)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(data, raw), Equals, true)
+	// Only three data clusters and a single L2 table are allocated.
+	info, err := os.Stat(imagePath)
+	c.Assert(err, IsNil)
+	c.Check(info.Size(), Equals, int64((4+3+1)*65536))
+	checkRefcounts(c, imagePath)
+}
+
+func (*suite) TestResize(c *C) {
+	m := []struct {
+		comment string
+		size    int64
+	}{
+		{"within the same L1 table entry", 100 << 20},
+		{"within the same L1 table cluster", 100 << 30},
+		{"with relocation of L1 table", 5 << 40},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare.
+		imagePath := filepath.Join(c.MkDir(), "disk.qcow2")
+		c.Assert(Create(imagePath, 1<<20, ""), IsNil)
+		img, err := OpenForUpdate(imagePath)
+		c.Assert(err, IsNil)
+		_, err = img.WriteAt([]byte("hello"), 512)
+		c.Assert(err, IsNil)
+		c.Assert(img.Close(), IsNil)
+
+		// This is what we're testing here.
+		err = Resize(imagePath, args.size)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		img, err = OpenForUpdate(imagePath)
+		c.Assert(err, IsNil)
+		c.Check(img.Size(), Equals, args.size)
+		_, err = img.WriteAt([]byte("world"), args.size-5)
+		c.Assert(err, IsNil)
+		data := make([]byte, 5)
+		_, err = img.ReadAt(data, 512)
+		c.Assert(err, IsNil)
+		c.Check(string(data), Equals, "hello")
+		_, err = img.ReadAt(data, args.size-5)
+		c.Assert(err, IsNil)
+		c.Check(string(data), Equals, "world")
+		c.Assert(img.Close(), IsNil)
+		checkRefcounts(c, imagePath)
+	}
+}
+
+func (*suite) TestResizeShrink(c *C) {
+	imagePath := filepath.Join(c.MkDir(), "disk.qcow2")
+	c.Assert(Create(imagePath, 1<<20, ""), IsNil)
+
+	// This is what we're testing here.
+	err := Resize(imagePath, 1<<19)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "shrinking of QCOW2 images is not supported")
+}
+
+// createTestImage creates an empty version 2 image with 64kB clusters: header
+// in the first cluster followed by L1 table, refcount table and refcount block.
+func createTestImage(c *C, size int64, backingFile string) string {
+	const clusterBits = 16
+	const clusterSize = 1 << clusterBits
+
+	header := Header{
+		Magic:                 QCOW2_MAGIC,
+		Version:               2,
+		ClusterBits:           clusterBits,
+		Size:                  uint64(size),
+		L1Size:                uint32((size + clusterSize*clusterSize/8 - 1) / (clusterSize * clusterSize / 8)),
+		L1TableOffset:         clusterSize,
+		RefcountTableOffset:   2 * clusterSize,
+		RefcountTableClusters: 1,
+	}
+	if backingFile != "" {
+		header.BackingFileOffset = 72
+		header.BackingFileSize = uint32(len(backingFile))
+	}
+
+	image := make([]byte, 4*clusterSize)
+	buf := bytes.Buffer{}
+	c.Assert(binary.Write(&buf, binary.BigEndian, &header), IsNil)
+	copy(image, buf.Bytes())
+	copy(image[72:], backingFile)
+	binary.BigEndian.PutUint64(image[2*clusterSize:], 3*clusterSize)
+	for i := 0; i < 4; i++ {
+		binary.BigEndian.PutUint16(image[3*clusterSize+2*i:], 1)
+	}
+
+	imagePath := filepath.Join(c.MkDir(), "disk.qcow2")
+	c.Assert(ioutil.WriteFile(imagePath, image, 0644), IsNil)
+	return imagePath
+}
+
+// checkRefcounts verifies that every cluster of the image file is referenced
+// exactly as many times as its refcount says, similarly to qemu-img check.
+func checkRefcounts(c *C, imagePath string) {
+	img, err := OpenForUpdate(imagePath)
+	c.Assert(err, IsNil)
+	defer img.Close()
+
+	info, err := os.Stat(imagePath)
+	c.Assert(err, IsNil)
+	c.Assert(info.Size()%img.clusterSize, Equals, int64(0), Commentf("image file is not cluster aligned"))
+
+	references := make(map[int64]uint64)
+	reference := func(offset uint64, clusters int64) {
+		for i := int64(0); i < clusters; i++ {
+			references[int64(offset)/img.clusterSize+i]++
+		}
+	}
+	reference(0, 1)
+	reference(img.Header.L1TableOffset, (int64(img.Header.L1Size)*8+img.clusterSize-1)/img.clusterSize)
+	reference(img.Header.RefcountTableOffset, int64(img.Header.RefcountTableClusters))
+	for _, block := range img.refcountTable {
+		if block != 0 {
+			reference(block, 1)
+		}
+	}
+	for _, l1Entry := range img.l1Table {
+		l2Offset := l1Entry & L1E_OFFSET_MASK
+		if l2Offset == 0 {
+			continue
+		}
+		reference(l2Offset, 1)
+		l2Table, err := img.readTable(int64(l2Offset), img.l2Entries)
+		c.Assert(err, IsNil)
+		for _, entry := range l2Table {
+			if entry&L2E_OFFSET_MASK != 0 {
+				reference(entry&L2E_OFFSET_MASK, 1)
+			}
+		}
+	}
+
+	refcountsPerBlock := img.clusterSize / img.refcountBytes
+	for cluster := int64(0); cluster < info.Size()/img.clusterSize; cluster++ {
+		refcount := uint64(0)
+		if block := img.refcountTable[cluster/refcountsPerBlock]; block != 0 {
+			entry := make([]byte, 2)
+			_, err := img.file.ReadAt(entry, int64(block)+cluster%refcountsPerBlock*2)
+			c.Assert(err, IsNil)
+			refcount = uint64(binary.BigEndian.Uint16(entry))
+		}
+		c.Check(refcount, Equals, references[cluster], Commentf("refcount of cluster %d", cluster))
+	}
+}
@@ -0,0 +1,345 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Offsets within L1 and L2 table entries.
+	L1E_OFFSET_MASK = 0x00fffffffffffe00
+	L2E_OFFSET_MASK = 0x00fffffffffffe00
+
+	L2E_COMPRESSED = uint64(1) << 62
+	L2E_ZERO       = uint64(1) << 0
+
+	// Incompatible feature bits that can be safely ignored when reading.
+	INCOMPAT_DIRTY = uint64(1) << 0
+)
+
+// HeaderV3 holds the additional header fields of version 3 images.
+type HeaderV3 struct {
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+}
+
+// Image provides read access to the virtual disk of a QCOW2 image.
+type Image struct {
+	Header      Header
+	HeaderV3    HeaderV3
+	BackingFile string
+
+	file        *os.File
+	clusterSize int64
+	l2Entries   int64
+	l1Table     []uint64
+	l2Cache     map[uint64][]uint64
+	backing     io.ReaderAt
+	backingSize int64
+	closers     []io.Closer
+
+	// Only set for images opened with OpenForUpdate.
+	writable      bool
+	refcountTable []uint64
+	refcountBytes int64
+}
+
+// Open opens the QCOW2 image at the given path for reading. Backing files are
+// opened as well and relative backing file names are resolved against the
+// directory of the image.
+func Open(path string) (*Image, error) {
+	return openImage(path, os.O_RDONLY)
+}
+
+func openImage(path string, flag int) (*Image, error) {
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := newImage(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if img.BackingFile != "" {
+		backingPath := img.BackingFile
+		if !filepath.IsAbs(backingPath) {
+			backingPath = filepath.Join(filepath.Dir(path), backingPath)
+		}
+		if err := img.openBackingFile(backingPath); err != nil {
+			img.Close()
+			return nil, err
+		}
+	}
+
+	return img, nil
+}
+
+func newImage(f *os.File) (*Image, error) {
+	header, err := readHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	if header.Magic != QCOW2_MAGIC {
+		return nil, fmt.Errorf("not a QCOW2 image")
+	}
+	if header.Version != 2 && header.Version != 3 {
+		return nil, fmt.Errorf("unsupported QCOW2 version %d", header.Version)
+	}
+	if header.CryptMethod != 0 {
+		return nil, fmt.Errorf("encrypted QCOW2 images are not supported")
+	}
+	if header.ClusterBits < 9 || header.ClusterBits > 21 {
+		return nil, fmt.Errorf("invalid cluster bits %d", header.ClusterBits)
+	}
+
+	img := &Image{
+		Header:      *header,
+		file:        f,
+		clusterSize: int64(1) << header.ClusterBits,
+		l2Cache:     make(map[uint64][]uint64),
+		closers:     []io.Closer{f},
+	}
+	img.l2Entries = img.clusterSize / 8
+
+	if header.Version >= 3 {
+		if err := binary.Read(f, binary.BigEndian, &img.HeaderV3); err != nil {
+			return nil, err
+		}
+		if img.HeaderV3.IncompatibleFeatures & ^INCOMPAT_DIRTY != 0 {
+			return nil, fmt.Errorf("unsupported QCOW2 incompatible features %x", img.HeaderV3.IncompatibleFeatures)
+		}
+	}
+
+	if header.BackingFileOffset != 0 {
+		name := make([]byte, header.BackingFileSize)
+		if _, err := f.ReadAt(name, int64(header.BackingFileOffset)); err != nil {
+			return nil, err
+		}
+		img.BackingFile = string(name)
+	}
+
+	img.l1Table, err = img.readTable(int64(header.L1TableOffset), int64(header.L1Size))
+	if err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+func (img *Image) openBackingFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	isQcow2 := Probe(f)
+	f.Close()
+
+	if isQcow2 {
+		backing, err := Open(path)
+		if err != nil {
+			return err
+		}
+		img.backing = backing
+		img.backingSize = backing.Size()
+		img.closers = append(img.closers, backing)
+		return nil
+	}
+
+	// Backing files of other formats are treated as raw images.
+	raw, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	info, err := raw.Stat()
+	if err != nil {
+		raw.Close()
+		return err
+	}
+	img.backing = raw
+	img.backingSize = info.Size()
+	img.closers = append(img.closers, raw)
+	return nil
+}
+
+func (img *Image) readTable(offset int64, entries int64) ([]uint64, error) {
+	table := make([]uint64, entries)
+	data := make([]byte, entries*8)
+	if _, err := img.file.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, table); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// Size returns the virtual size of the disk in bytes.
+func (img *Image) Size() int64 {
+	return int64(img.Header.Size)
+}
+
+// ClusterSize returns the size of the cluster in bytes.
+func (img *Image) ClusterSize() int64 {
+	return img.clusterSize
+}
+
+// Close closes the image and all its backing files.
+func (img *Image) Close() error {
+	var firstErr error
+	if img.writable && img.file != nil {
+		firstErr = img.file.Sync()
+		img.writable = false
+	}
+	for _, c := range img.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	img.closers = nil
+	return firstErr
+}
+
+// l2Entry returns the L2 table entry describing the given virtual cluster
+// or 0 if the cluster is not allocated in this image.
+func (img *Image) l2Entry(cluster int64) (uint64, error) {
+	l1Index := cluster / img.l2Entries
+	if l1Index >= int64(len(img.l1Table)) {
+		return 0, nil
+	}
+	l2Offset := img.l1Table[l1Index] & L1E_OFFSET_MASK
+	if l2Offset == 0 {
+		return 0, nil
+	}
+
+	l2Table, ok := img.l2Cache[l2Offset]
+	if !ok {
+		var err error
+		if l2Table, err = img.readTable(int64(l2Offset), img.l2Entries); err != nil {
+			return 0, err
+		}
+		img.l2Cache[l2Offset] = l2Table
+	}
+	return l2Table[cluster%img.l2Entries], nil
+}
+
+// readCluster reads part of the given virtual cluster into p.
+func (img *Image) readCluster(p []byte, cluster int64, offsetInCluster int64) error {
+	entry, err := img.l2Entry(cluster)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case entry&L2E_COMPRESSED != 0:
+		data, err := img.readCompressedCluster(entry)
+		if err != nil {
+			return err
+		}
+		copy(p, data[offsetInCluster:])
+		return nil
+
+	case entry&L2E_ZERO != 0 && img.Header.Version >= 3:
+		zero(p)
+		return nil
+
+	case entry&L2E_OFFSET_MASK != 0:
+		n, err := img.file.ReadAt(p, int64(entry&L2E_OFFSET_MASK)+offsetInCluster)
+		if err == io.EOF {
+			// Clusters at the end of the image file may be truncated.
+			zero(p[n:])
+			err = nil
+		}
+		return err
+	}
+
+	// Unallocated cluster is read from the backing file if there is one.
+	zero(p)
+	offset := cluster*img.clusterSize + offsetInCluster
+	if img.backing == nil || offset >= img.backingSize {
+		return nil
+	}
+	if remaining := img.backingSize - offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	_, err = img.backing.ReadAt(p, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+func (img *Image) readCompressedCluster(entry uint64) ([]byte, error) {
+	// See "Compressed Clusters Descriptor" in QCOW2 specification.
+	x := 62 - (img.Header.ClusterBits - 8)
+	hostOffset := entry & (uint64(1)<<x - 1)
+	sectors := (entry>>x)&(uint64(1)<<(img.Header.ClusterBits-8)-1) + 1
+	compressedSize := int64(sectors)*512 - int64(hostOffset&511)
+
+	compressed := make([]byte, compressedSize)
+	n, err := img.file.ReadAt(compressed, int64(hostOffset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(compressed[:n])), img.clusterSize))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("failed to decompress cluster at %d: %s", hostOffset, err)
+	}
+	if int64(len(data)) < img.clusterSize {
+		data = append(data, make([]byte, img.clusterSize-int64(len(data)))...)
+	}
+	return data, nil
+}
+
+// ReadAt reads the virtual disk content at the given offset.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off >= img.Size() {
+		return 0, io.EOF
+	}
+
+	var err error
+	if remaining := img.Size() - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		err = io.EOF
+	}
+
+	for done := 0; done < len(p); {
+		position := off + int64(done)
+		offsetInCluster := position % img.clusterSize
+		count := img.clusterSize - offsetInCluster
+		if rest := int64(len(p) - done); count > rest {
+			count = rest
+		}
+		if readErr := img.readCluster(p[done:done+int(count)], position/img.clusterSize, offsetInCluster); readErr != nil {
+			return done, readErr
+		}
+		done += int(count)
+	}
+
+	return len(p), err
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
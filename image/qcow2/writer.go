@@ -0,0 +1,248 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	// Set in L1 and L2 table entries whose cluster has refcount exactly one.
+	OFLAG_COPIED = uint64(1) << 63
+
+	// Offsets within refcount table entries.
+	REFT_OFFSET_MASK = 0xfffffffffffffe00
+)
+
+// ErrUnsupported is returned when an image uses features the in-process
+// writer does not handle, e.g. internal snapshots sharing clusters. Callers
+// are expected to fall back to qemu tools in that case.
+var ErrUnsupported = errors.New("QCOW2 image layout not supported by the in-process writer")
+
+// OpenForUpdate opens the QCOW2 image at the given path for reading and
+// writing. Writes only change this image and never its backing files. Clusters
+// that are not yet allocated in this image are allocated at the end of the
+// file and their refcounts are updated accordingly.
+func OpenForUpdate(path string) (*Image, error) {
+	img, err := openImage(path, os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := img.prepareForWriting(); err != nil {
+		img.Close()
+		return nil, err
+	}
+
+	return img, nil
+}
+
+func (img *Image) prepareForWriting() error {
+	if img.HeaderV3.IncompatibleFeatures&INCOMPAT_DIRTY != 0 {
+		// Refcounts of dirty images are not reliable.
+		return ErrUnsupported
+	}
+
+	refcountOrder := uint32(4)
+	if img.Header.Version >= 3 {
+		refcountOrder = img.HeaderV3.RefcountOrder
+	}
+	if refcountOrder < 3 || refcountOrder > 6 {
+		return ErrUnsupported
+	}
+	img.refcountBytes = int64(1) << refcountOrder / 8
+
+	entries := int64(img.Header.RefcountTableClusters) * img.clusterSize / 8
+	refcountTable, err := img.readTable(int64(img.Header.RefcountTableOffset), entries)
+	if err != nil {
+		return err
+	}
+	img.refcountTable = refcountTable
+	img.writable = true
+
+	return nil
+}
+
+// WriteAt writes to the virtual disk at the given offset.
+func (img *Image) WriteAt(p []byte, off int64) (int, error) {
+	if !img.writable {
+		return 0, fmt.Errorf("QCOW2 image is opened read-only")
+	}
+	if off < 0 || off+int64(len(p)) > img.Size() {
+		return 0, fmt.Errorf("write of %d bytes at %d is beyond the disk size %d", len(p), off, img.Size())
+	}
+
+	for done := 0; done < len(p); {
+		position := off + int64(done)
+		offsetInCluster := position % img.clusterSize
+		count := img.clusterSize - offsetInCluster
+		if rest := int64(len(p) - done); count > rest {
+			count = rest
+		}
+
+		hostOffset, err := img.clusterForWriting(position / img.clusterSize)
+		if err != nil {
+			return done, err
+		}
+		if _, err := img.file.WriteAt(p[done:done+int(count)], hostOffset+offsetInCluster); err != nil {
+			return done, err
+		}
+		done += int(count)
+	}
+
+	return len(p), nil
+}
+
+// clusterForWriting returns the host offset of the given virtual cluster
+// making sure it is allocated in this image and not shared.
+func (img *Image) clusterForWriting(cluster int64) (int64, error) {
+	l1Index := cluster / img.l2Entries
+	l2Index := cluster % img.l2Entries
+	if l1Index >= int64(len(img.l1Table)) {
+		return 0, ErrUnsupported
+	}
+
+	l1Entry := img.l1Table[l1Index]
+	if l1Entry&L1E_OFFSET_MASK != 0 && l1Entry&OFLAG_COPIED == 0 {
+		// L2 table is shared with a snapshot.
+		return 0, ErrUnsupported
+	}
+
+	entry, err := img.l2Entry(cluster)
+	if err != nil {
+		return 0, err
+	}
+	hostOffset := int64(entry & L2E_OFFSET_MASK)
+
+	switch {
+	case entry&L2E_COMPRESSED != 0:
+		return 0, ErrUnsupported
+	case hostOffset != 0 && entry&OFLAG_COPIED == 0:
+		// Data cluster is shared with a snapshot.
+		return 0, ErrUnsupported
+	case hostOffset != 0 && entry&L2E_ZERO == 0:
+		return hostOffset, nil
+	case hostOffset != 0:
+		// Preallocated cluster that reads as zeros.
+		if _, err := img.file.WriteAt(make([]byte, img.clusterSize), hostOffset); err != nil {
+			return 0, err
+		}
+		return hostOffset, img.setL2Entry(l1Index, l2Index, uint64(hostOffset)|OFLAG_COPIED)
+	}
+
+	// Copy the current content of the cluster (backing file or zeros) into a
+	// newly allocated one.
+	data := make([]byte, img.clusterSize)
+	if err := img.readCluster(data, cluster, 0); err != nil {
+		return 0, err
+	}
+	if hostOffset, err = img.allocateCluster(); err != nil {
+		return 0, err
+	}
+	if _, err := img.file.WriteAt(data, hostOffset); err != nil {
+		return 0, err
+	}
+
+	return hostOffset, img.setL2Entry(l1Index, l2Index, uint64(hostOffset)|OFLAG_COPIED)
+}
+
+func (img *Image) setL2Entry(l1Index int64, l2Index int64, entry uint64) error {
+	l2Offset := img.l1Table[l1Index] & L1E_OFFSET_MASK
+	if l2Offset == 0 {
+		newL2Offset, err := img.allocateCluster()
+		if err != nil {
+			return err
+		}
+		l2Offset = uint64(newL2Offset)
+		img.l2Cache[l2Offset] = make([]uint64, img.l2Entries)
+
+		img.l1Table[l1Index] = l2Offset | OFLAG_COPIED
+		if err := img.writeTableEntry(int64(img.Header.L1TableOffset), l1Index, img.l1Table[l1Index]); err != nil {
+			return err
+		}
+	}
+
+	img.l2Cache[l2Offset][l2Index] = entry
+	return img.writeTableEntry(int64(l2Offset), l2Index, entry)
+}
+
+func (img *Image) writeTableEntry(tableOffset int64, index int64, entry uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, entry)
+	_, err := img.file.WriteAt(buf, tableOffset+index*8)
+	return err
+}
+
+// allocateCluster reserves a zeroed cluster at the end of the image file and
+// sets its refcount to one.
+func (img *Image) allocateCluster() (int64, error) {
+	return img.allocateClusters(1)
+}
+
+// allocateClusters reserves the given number of contiguous zeroed clusters
+// at the end of the image file and sets their refcounts to one.
+func (img *Image) allocateClusters(count int64) (int64, error) {
+	offset, err := img.reserveClusters(count)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := int64(0); i < count; i++ {
+		if err := img.setRefcount(offset+i*img.clusterSize, 1); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+func (img *Image) setRefcount(hostOffset int64, refcount uint64) error {
+	refcountsPerBlock := img.clusterSize / img.refcountBytes
+	clusterIndex := hostOffset / img.clusterSize
+	tableIndex := clusterIndex / refcountsPerBlock
+	if tableIndex >= int64(len(img.refcountTable)) {
+		// Growing the refcount table would require relocating it.
+		return ErrUnsupported
+	}
+
+	blockOffset := int64(img.refcountTable[tableIndex] & REFT_OFFSET_MASK)
+	if blockOffset == 0 {
+		var err error
+		if blockOffset, err = img.reserveClusters(1); err != nil {
+			return err
+		}
+		img.refcountTable[tableIndex] = uint64(blockOffset)
+		if err := img.writeTableEntry(int64(img.Header.RefcountTableOffset), tableIndex, uint64(blockOffset)); err != nil {
+			return err
+		}
+		// The new refcount block has to be accounted for as well.
+		if err := img.setRefcount(blockOffset, 1); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, refcount)
+	entryOffset := blockOffset + (clusterIndex%refcountsPerBlock)*img.refcountBytes
+	_, err := img.file.WriteAt(buf[8-img.refcountBytes:], entryOffset)
+	return err
+}
+
+// reserveClusters extends the image file by the given number of zeroed
+// clusters without touching the refcounts.
+func (img *Image) reserveClusters(count int64) (int64, error) {
+	info, err := img.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	offset := (info.Size() + img.clusterSize - 1) / img.clusterSize * img.clusterSize
+	return offset, img.file.Truncate(offset + count*img.clusterSize)
+}
@@ -0,0 +1,399 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ *
+ * This code implements reading of a ROFS file system as described by
+ * comments in this Python code -
+ * https://raw.githubusercontent.com/cloudius-systems/osv/master/scripts/gen-rofs-img.py.
+ * The file system is read through io.ReaderAt so that it can be accessed
+ * directly within a partition of a disk image.
+ */
+
+package rofs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	BLOCK_SIZE = 512
+	MAGIC      = 0xDEADBEAD
+
+	DIR_MODE  = 0x4000
+	REG_MODE  = 0x8000
+	LINK_MODE = 0xA000
+
+	// Maximum number of symbolic links followed when resolving a path.
+	maxSymlinks = 40
+)
+
+type SuperBlock struct {
+	Magic                    uint64
+	Version                  uint64
+	BlockSize                uint64
+	StructureInfoFirstBlock  uint64
+	StructureInfoBlocksCount uint64
+	DirectoryEntriesCount    uint64
+	SymlinksCount            uint64
+	InodesCount              uint64
+}
+
+type DirectoryEntry struct {
+	InodeNumber uint64
+	Filename    string
+}
+
+type Symlink struct {
+	Filename string
+}
+
+type Inode struct {
+	Mode        uint64
+	InodeNumber uint64
+	DataOffset  uint64
+	Count       uint64 // either file size in bytes or children count
+}
+
+func (inode *Inode) IsDir() bool {
+	return inode.Mode == DIR_MODE
+}
+
+func (inode *Inode) IsRegular() bool {
+	return inode.Mode == REG_MODE
+}
+
+func (inode *Inode) IsSymlink() bool {
+	return inode.Mode == LINK_MODE
+}
+
+// Entry is a named inode within a directory.
+type Entry struct {
+	Name  string
+	Inode *Inode
+}
+
+// Filesystem is a ROFS file system that has been read from an image.
+type Filesystem struct {
+	SuperBlock       SuperBlock
+	DirectoryEntries []*DirectoryEntry
+	Symlinks         []*Symlink
+	Inodes           []*Inode
+
+	reader io.ReaderAt
+}
+
+// ReadSuperBlock reads the super block stored in the first block of the image.
+func ReadSuperBlock(r io.ReaderAt) (*SuperBlock, error) {
+	bytesArray := make([]byte, BLOCK_SIZE)
+	if _, err := r.ReadAt(bytesArray, 0); err != nil {
+		return nil, err
+	}
+
+	superBlock := SuperBlock{}
+	if err := binary.Read(bytes.NewReader(bytesArray), binary.LittleEndian, &superBlock); err != nil {
+		return nil, err
+	}
+
+	return &superBlock, nil
+}
+
+// Probe checks whether the given reader starts with ROFS super block.
+func Probe(r io.ReaderAt) bool {
+	superBlock, err := ReadSuperBlock(r)
+	if err != nil {
+		return false
+	}
+	return superBlock.Magic == MAGIC
+}
+
+// Open reads the super block and the filesystem structure (directory entries,
+// symlinks and inodes) of a ROFS image. File data is read lazily from r.
+func Open(r io.ReaderAt) (*Filesystem, error) {
+	superBlock, err := ReadSuperBlock(r)
+	if err != nil {
+		return nil, err
+	}
+	if superBlock.Magic != MAGIC {
+		return nil, fmt.Errorf("bad ROFS magic: %x", superBlock.Magic)
+	}
+	if superBlock.BlockSize == 0 {
+		return nil, fmt.Errorf("bad ROFS block size: %d", superBlock.BlockSize)
+	}
+
+	structureOffset := int64(superBlock.StructureInfoFirstBlock * superBlock.BlockSize)
+	structureSize := int64(superBlock.StructureInfoBlocksCount * superBlock.BlockSize)
+	reader := bufio.NewReader(io.NewSectionReader(r, structureOffset, structureSize))
+
+	filesystem := Filesystem{SuperBlock: *superBlock, reader: r}
+	for i := uint64(0); i < superBlock.DirectoryEntriesCount; i++ {
+		entry := DirectoryEntry{}
+		if err := binary.Read(reader, binary.LittleEndian, &entry.InodeNumber); err != nil {
+			return nil, fmt.Errorf("failed to read directory entry %d: %s", i, err)
+		}
+		if entry.Filename, err = readString(reader); err != nil {
+			return nil, fmt.Errorf("failed to read directory entry %d: %s", i, err)
+		}
+		filesystem.DirectoryEntries = append(filesystem.DirectoryEntries, &entry)
+	}
+	for i := uint64(0); i < superBlock.SymlinksCount; i++ {
+		symlink := Symlink{}
+		if symlink.Filename, err = readString(reader); err != nil {
+			return nil, fmt.Errorf("failed to read symlink %d: %s", i, err)
+		}
+		filesystem.Symlinks = append(filesystem.Symlinks, &symlink)
+	}
+	for i := uint64(0); i < superBlock.InodesCount; i++ {
+		inode := Inode{}
+		if err := binary.Read(reader, binary.LittleEndian, &inode); err != nil {
+			return nil, fmt.Errorf("failed to read inode %d: %s", i, err)
+		}
+		filesystem.Inodes = append(filesystem.Inodes, &inode)
+	}
+	if len(filesystem.Inodes) == 0 || !filesystem.Inodes[0].IsDir() {
+		return nil, fmt.Errorf("ROFS root inode is missing")
+	}
+
+	return &filesystem, nil
+}
+
+func readString(reader io.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+		return "", err
+	}
+	str := make([]byte, length)
+	if _, err := io.ReadFull(reader, str); err != nil {
+		return "", err
+	}
+	return string(str), nil
+}
+
+// Root returns the inode of the root directory.
+func (fs *Filesystem) Root() *Inode {
+	return fs.Inodes[0]
+}
+
+// ReadDir returns entries of the given directory sorted by name.
+func (fs *Filesystem) ReadDir(directory *Inode) ([]Entry, error) {
+	if !directory.IsDir() {
+		return nil, fmt.Errorf("inode %d is not a directory", directory.InodeNumber)
+	}
+	if directory.DataOffset+directory.Count > uint64(len(fs.DirectoryEntries)) {
+		return nil, fmt.Errorf("directory inode %d points outside of directory entries", directory.InodeNumber)
+	}
+
+	var entries []Entry
+	for _, entry := range fs.DirectoryEntries[directory.DataOffset : directory.DataOffset+directory.Count] {
+		if !validName(entry.Filename) {
+			return nil, fmt.Errorf("directory inode %d has invalid entry name '%s'", directory.InodeNumber, entry.Filename)
+		}
+		if entry.InodeNumber == 0 || entry.InodeNumber > uint64(len(fs.Inodes)) {
+			return nil, fmt.Errorf("directory entry '%s' points to invalid inode %d", entry.Filename, entry.InodeNumber)
+		}
+		entries = append(entries, Entry{Name: entry.Filename, Inode: fs.Inodes[entry.InodeNumber-1]})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Name == entries[i-1].Name {
+			return nil, fmt.Errorf("directory inode %d has duplicate entry '%s'", directory.InodeNumber, entries[i].Name)
+		}
+	}
+
+	return entries, nil
+}
+
+// validName tells whether the name of a directory entry names a single file
+// within the directory.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// Readlink returns the target of the given symbolic link.
+func (fs *Filesystem) Readlink(link *Inode) (string, error) {
+	if !link.IsSymlink() {
+		return "", fmt.Errorf("inode %d is not a symbolic link", link.InodeNumber)
+	}
+	if link.DataOffset >= uint64(len(fs.Symlinks)) {
+		return "", fmt.Errorf("symbolic link inode %d points outside of symlinks", link.InodeNumber)
+	}
+	return fs.Symlinks[link.DataOffset].Filename, nil
+}
+
+// Open returns a reader of the content of the given regular file.
+func (fs *Filesystem) Open(file *Inode) (*io.SectionReader, error) {
+	if !file.IsRegular() {
+		return nil, fmt.Errorf("inode %d is not a regular file", file.InodeNumber)
+	}
+	offset := int64(file.DataOffset * fs.SuperBlock.BlockSize)
+	return io.NewSectionReader(fs.reader, offset, int64(file.Count)), nil
+}
+
+// Lstat returns the inode of the given absolute path. Symbolic links are
+// followed in all but the last path component.
+func (fs *Filesystem) Lstat(filePath string) (*Inode, error) {
+	return fs.lookup(filePath, false, 0)
+}
+
+// Stat returns the inode of the given absolute path following all symbolic links.
+func (fs *Filesystem) Stat(filePath string) (*Inode, error) {
+	return fs.lookup(filePath, true, 0)
+}
+
+func (fs *Filesystem) lookup(filePath string, followLast bool, depth int) (*Inode, error) {
+	if depth > maxSymlinks {
+		return nil, fmt.Errorf("%s: too many levels of symbolic links", filePath)
+	}
+
+	filePath = path.Clean("/" + filePath)
+	components := strings.Split(strings.TrimPrefix(filePath, "/"), "/")
+	inode := fs.Root()
+	currentPath := "/"
+	for i, component := range components {
+		if component == "" {
+			continue
+		}
+		if !inode.IsDir() {
+			return nil, fmt.Errorf("%s: not a directory", currentPath)
+		}
+
+		entries, err := fs.ReadDir(inode)
+		if err != nil {
+			return nil, err
+		}
+		var found *Inode
+		for _, entry := range entries {
+			if entry.Name == component {
+				found = entry.Inode
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("%s: no such file or directory", filePath)
+		}
+
+		last := i == len(components)-1
+		if found.IsSymlink() && (!last || followLast) {
+			target, err := fs.Readlink(found)
+			if err != nil {
+				return nil, err
+			}
+			if !path.IsAbs(target) {
+				target = path.Join(currentPath, target)
+			}
+			target = path.Join(append([]string{target}, components[i+1:]...)...)
+			return fs.lookup(target, followLast, depth+1)
+		}
+
+		inode = found
+		currentPath = path.Join(currentPath, component)
+	}
+
+	return inode, nil
+}
+
+// WalkFunc is called for every file visited by Walk.
+type WalkFunc func(filePath string, inode *Inode) error
+
+// Walk walks the file tree rooted at the given path in lexical order calling
+// fn for each file or directory, including the root. Symbolic links are not
+// followed.
+func (fs *Filesystem) Walk(root string, fn WalkFunc) error {
+	inode, err := fs.Lstat(root)
+	if err != nil {
+		return err
+	}
+	return fs.walk(path.Clean("/"+root), inode, fn, make(map[*Inode]bool))
+}
+
+// walk visits the tree rooted at the given inode. Directories already visited
+// are an error, since a corrupted image could otherwise make it loop forever.
+func (fs *Filesystem) walk(filePath string, inode *Inode, fn WalkFunc, visited map[*Inode]bool) error {
+	if inode.IsDir() {
+		if visited[inode] {
+			return fmt.Errorf("%s: directory inode %d appears more than once", filePath, inode.InodeNumber)
+		}
+		visited[inode] = true
+	}
+	if err := fn(filePath, inode); err != nil {
+		return err
+	}
+	if !inode.IsDir() {
+		return nil
+	}
+
+	entries, err := fs.ReadDir(inode)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := fs.walk(path.Join(filePath, entry.Name), entry.Inode, fn, visited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Extract copies the file or directory tree at the given path into the
+// destination directory on the host, e.g. extracting /usr/lib into /tmp
+// creates /tmp/lib. Content of the root directory is extracted directly into
+// the destination directory. Symbolic links are extracted as they are, but
+// nothing is ever written through a symbolic link on the host.
+func (fs *Filesystem) Extract(root string, destination string) error {
+	root = path.Clean("/" + root)
+	parent := path.Dir(root)
+
+	return fs.Walk(root, func(filePath string, inode *Inode) error {
+		relativePath := strings.TrimPrefix(filePath, parent)
+		hostPath := filepath.Join(destination, filepath.FromSlash(relativePath))
+
+		if info, err := os.Lstat(hostPath); err == nil && info.Mode()&os.ModeSymlink != 0 && !inode.IsSymlink() {
+			return fmt.Errorf("%s: refusing to write through symbolic link %s", filePath, hostPath)
+		}
+
+		switch {
+		case inode.IsDir():
+			return os.MkdirAll(hostPath, 0755)
+		case inode.IsSymlink():
+			target, err := fs.Readlink(inode)
+			if err != nil {
+				return err
+			}
+			os.Remove(hostPath)
+			return os.Symlink(target, hostPath)
+		case inode.IsRegular():
+			return fs.extractFile(inode, hostPath)
+		default:
+			return fmt.Errorf("%s: unknown file mode %x", filePath, inode.Mode)
+		}
+	})
+}
+
+func (fs *Filesystem) extractFile(inode *Inode, hostPath string) error {
+	reader, err := fs.Open(inode)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(hostPath), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(hostPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, reader)
+	return err
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package rofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type suite struct{}
+
+var _ = Suite(&suite{})
+
+// craftImage serializes the given structure into a ROFS image. Data of the
+// regular files is stored in the blocks following the structure, the
+// DataOffset of their inodes is set accordingly.
+func craftImage(c *C, entries []DirectoryEntry, symlinks []string, inodes []Inode, data map[uint64]string) *bytes.Reader {
+	structure := bytes.Buffer{}
+	for _, entry := range entries {
+		binary.Write(&structure, binary.LittleEndian, entry.InodeNumber)
+		binary.Write(&structure, binary.LittleEndian, uint16(len(entry.Filename)))
+		structure.WriteString(entry.Filename)
+	}
+	for _, symlink := range symlinks {
+		binary.Write(&structure, binary.LittleEndian, uint16(len(symlink)))
+		structure.WriteString(symlink)
+	}
+	structureBlocks := uint64(structure.Len()+len(inodes)*32)/BLOCK_SIZE + 1
+
+	block := 1 + structureBlocks
+	content := bytes.Buffer{}
+	for i := range inodes {
+		inodes[i].InodeNumber = uint64(i + 1)
+		if text, ok := data[inodes[i].InodeNumber]; ok {
+			inodes[i].DataOffset = block
+			inodes[i].Count = uint64(len(text))
+			content.WriteString(text)
+			content.Write(make([]byte, BLOCK_SIZE-len(text)%BLOCK_SIZE))
+			block += uint64(len(text))/BLOCK_SIZE + 1
+		}
+		c.Assert(binary.Write(&structure, binary.LittleEndian, inodes[i]), IsNil)
+	}
+
+	image := bytes.Buffer{}
+	binary.Write(&image, binary.LittleEndian, SuperBlock{
+		Magic:                    MAGIC,
+		Version:                  1,
+		BlockSize:                BLOCK_SIZE,
+		StructureInfoFirstBlock:  1,
+		StructureInfoBlocksCount: structureBlocks,
+		DirectoryEntriesCount:    uint64(len(entries)),
+		SymlinksCount:            uint64(len(symlinks)),
+		InodesCount:              uint64(len(inodes)),
+	})
+	image.Write(make([]byte, BLOCK_SIZE-image.Len()))
+	image.Write(structure.Bytes())
+	image.Write(make([]byte, int(structureBlocks)*BLOCK_SIZE-structure.Len()))
+	image.Write(content.Bytes())
+	return bytes.NewReader(image.Bytes())
+}
+
+func (*suite) TestExtract(c *C) {
+	// Prepare.
+	image := craftImage(c, []DirectoryEntry{
+		{InodeNumber: 2, Filename: "dir"},
+		{InodeNumber: 4, Filename: "link"},
+		{InodeNumber: 3, Filename: "file.txt"},
+	}, []string{"dir/file.txt"}, []Inode{
+		{Mode: DIR_MODE, DataOffset: 0, Count: 2},
+		{Mode: DIR_MODE, DataOffset: 2, Count: 1},
+		{Mode: REG_MODE},
+		{Mode: LINK_MODE, DataOffset: 0},
+	}, map[uint64]string{3: "content"})
+	fs, err := Open(image)
+	c.Assert(err, IsNil)
+	destination := c.MkDir()
+
+	// This is what we're testing here.
+	err = fs.Extract("/", destination)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(destination, "dir", "file.txt"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "content")
+	target, err := os.Readlink(filepath.Join(destination, "link"))
+	c.Assert(err, IsNil)
+	c.Check(target, Equals, "dir/file.txt")
+}
+
+func (*suite) TestInvalidEntryNames(c *C) {
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		c.Logf("name: '%s'", name)
+
+		// Prepare.
+		image := craftImage(c, []DirectoryEntry{
+			{InodeNumber: 2, Filename: name},
+		}, nil, []Inode{
+			{Mode: DIR_MODE, DataOffset: 0, Count: 1},
+			{Mode: REG_MODE},
+		}, map[uint64]string{2: "content"})
+		fs, err := Open(image)
+		c.Assert(err, IsNil)
+
+		// This is what we're testing here.
+		err = fs.Walk("/", func(filePath string, inode *Inode) error { return nil })
+
+		// Expectations.
+		c.Check(err, ErrorMatches, "directory inode 1 has invalid entry name .*")
+	}
+}
+
+func (*suite) TestWalkDirectoryLoop(c *C) {
+	// Prepare.
+	image := craftImage(c, []DirectoryEntry{
+		{InodeNumber: 2, Filename: "dir"},
+		{InodeNumber: 1, Filename: "root"},
+	}, nil, []Inode{
+		{Mode: DIR_MODE, DataOffset: 0, Count: 1},
+		{Mode: DIR_MODE, DataOffset: 1, Count: 1},
+	}, nil)
+	fs, err := Open(image)
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	err = fs.Walk("/", func(filePath string, inode *Inode) error { return nil })
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "/dir/root: directory inode 1 appears more than once")
+}
+
+func (*suite) TestExtractDoesNotWriteThroughSymlink(c *C) {
+	// Prepare.
+	outside := c.MkDir()
+	image := craftImage(c, []DirectoryEntry{
+		{InodeNumber: 2, Filename: "x"},
+		{InodeNumber: 3, Filename: "x"},
+		{InodeNumber: 4, Filename: "file.txt"},
+	}, []string{outside}, []Inode{
+		{Mode: DIR_MODE, DataOffset: 0, Count: 2},
+		{Mode: LINK_MODE, DataOffset: 0},
+		{Mode: DIR_MODE, DataOffset: 2, Count: 1},
+		{Mode: REG_MODE},
+	}, map[uint64]string{4: "content"})
+	fs, err := Open(image)
+	c.Assert(err, IsNil)
+	destination := c.MkDir()
+
+	// This is what we're testing here.
+	err = fs.Extract("/", destination)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "directory inode 1 has duplicate entry 'x'")
+	_, err = os.Stat(filepath.Join(outside, "file.txt"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (*suite) TestExtractRefusesExistingSymlink(c *C) {
+	// Prepare.
+	outside := c.MkDir()
+	image := craftImage(c, []DirectoryEntry{
+		{InodeNumber: 2, Filename: "x"},
+		{InodeNumber: 3, Filename: "file.txt"},
+	}, nil, []Inode{
+		{Mode: DIR_MODE, DataOffset: 0, Count: 1},
+		{Mode: DIR_MODE, DataOffset: 1, Count: 1},
+		{Mode: REG_MODE},
+	}, map[uint64]string{3: "content"})
+	fs, err := Open(image)
+	c.Assert(err, IsNil)
+	destination := c.MkDir()
+	c.Assert(os.Symlink(outside, filepath.Join(destination, "x")), IsNil)
+
+	// This is what we're testing here.
+	err = fs.Extract("/", destination)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "/x: refusing to write through symbolic link .*")
+	_, err = os.Stat(filepath.Join(outside, "file.txt"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
@@ -12,6 +12,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"gopkg.in/yaml.v2"
@@ -50,8 +51,10 @@ type AllCmdConfigs struct {
 //
 //    For a given meta/run.yaml all config sets get the same (a), but are populated
 //    with different values for (b).
-// NOTE: when Capstan needs to know what packages to require, it needs (a), but
-//    not (b). And this function returns exactly this, (a) without (b).
+// NOTE: when Capstan needs to know what packages to require, it mostly needs (a),
+//    but not (b). Since some runtimes (e.g. python3) select the packages they
+//    depend on in the config set, dependencies of the returned runtime are the
+//    union of dependencies of all config sets.
 func PackageRunManifestGeneral(cmdConfigFile string) (Runtime, error) {
 
 	// Take meta/run.yaml from the current directory if not provided.
@@ -82,7 +85,43 @@ func PackageRunManifestGeneral(cmdConfigFile string) (Runtime, error) {
 
 	// Return blank implementation of runtime interface.
 	blankRuntime, err := PickRuntime(internal.Runtime)
-	return blankRuntime, err
+	if err != nil {
+		return nil, err
+	}
+
+	// Any of the config sets can be booted, so all their dependencies are needed.
+	if cmdConf, err := ParsePackageRunManifestData(data); err == nil && len(cmdConf.ConfigSets) > 0 {
+		names := make([]string, 0, len(cmdConf.ConfigSets))
+		for name := range cmdConf.ConfigSets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		deps := []string{}
+		seen := make(map[string]bool)
+		for _, name := range names {
+			for _, dep := range cmdConf.ConfigSets[name].GetDependencies() {
+				if !seen[dep] {
+					seen[dep] = true
+					deps = append(deps, dep)
+				}
+			}
+		}
+		return configSetsRuntime{Runtime: blankRuntime, dependencies: deps}, nil
+	}
+
+	return blankRuntime, nil
+}
+
+// configSetsRuntime is a blank runtime with the dependencies of all config
+// sets of meta/run.yaml.
+type configSetsRuntime struct {
+	Runtime
+	dependencies []string
+}
+
+func (r configSetsRuntime) GetDependencies() []string {
+	return r.dependencies
 }
 
 // ParsePackageRunManifestData returns parsed manifest data.
@@ -181,7 +220,26 @@ func (c *AllCmdConfigs) Persist(mpmDir string) error {
 		}
 	}
 
+	bootCmds, err := c.BootCmds()
+	if err != nil {
+		return err
+	}
+
 	// Persist runscript scripts for all config_sets of all packages.
+	for confName, bootCmd := range bootCmds {
+		cmdFile := filepath.Join(targetDir, confName)
+		if err := ioutil.WriteFile(cmdFile, []byte(bootCmd), 0700); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// BootCmds returns boot commands of all config_sets of all packages by their
+// names. Config sets of packages added later override the earlier ones.
+func (c *AllCmdConfigs) BootCmds() (map[string]string, error) {
+	bootCmds := make(map[string]string)
 	for _, pkgName := range c.order {
 		cmdConf := c.cmdConfigs[pkgName]
 		if cmdConf == nil {
@@ -192,24 +250,19 @@ func (c *AllCmdConfigs) Persist(mpmDir string) error {
 			currConf := cmdConf.ConfigSets[confName]
 			// Validate.
 			if err := currConf.Validate(); err != nil {
-				return fmt.Errorf("Validation failed for configuration set '%s': %s", confName, err)
+				return nil, fmt.Errorf("Validation failed for configuration set '%s': %s", confName, err)
 			}
 
 			// Calculate boot command.
 			bootCmd, err := currConf.GetBootCmd(c.cmdConfigs, map[string]string{})
 			if err != nil {
-				return err
-			}
-
-			// Persist to file.
-			cmdFile := filepath.Join(targetDir, confName)
-			if err := ioutil.WriteFile(cmdFile, []byte(bootCmd), 0700); err != nil {
-				return err
+				return nil, err
 			}
+			bootCmds[confName] = bootCmd
 		}
 	}
 
-	return nil
+	return bootCmds, nil
 }
 
 // keysOfMap does nothing but returns a list of all the keys in a map.
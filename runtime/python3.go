@@ -0,0 +1,176 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// python3Package is the package providing Python 3 unless the config set
+// selects another one with the `python` setting.
+const python3Package = "osv.python3x"
+
+// python3Interpreter is the path of the interpreter in Python 3 packages.
+const python3Interpreter = "/usr/bin/python3"
+
+type python3Runtime struct {
+	CommonRuntime `yaml:"-,inline"`
+	Python        string   `yaml:"python"`
+	PythonArgs    []string `yaml:"python_args"`
+	Main          string   `yaml:"main"`
+	Module        string   `yaml:"module"`
+	Args          []string `yaml:"args"`
+	SitePackages  string   `yaml:"site_packages"`
+	PythonPath    []string `yaml:"python_path"`
+	IsShell       bool     `yaml:"shell"` // run interactive python interpreter
+}
+
+//
+// Interface implementation
+//
+
+func (conf python3Runtime) GetRuntimeName() string {
+	return string(Python3)
+}
+func (conf python3Runtime) GetRuntimeDescription() string {
+	return "Run Python 3 application"
+}
+func (conf python3Runtime) GetDependencies() []string {
+	if conf.Python != "" {
+		return []string{conf.Python}
+	}
+	return []string{python3Package}
+}
+func (conf python3Runtime) Validate() error {
+	if conf.Base != "" {
+		if conf.IsShell || conf.Python != "" || len(conf.PythonArgs) > 0 || conf.Main != "" || conf.Module != "" ||
+			len(conf.Args) > 0 || conf.SitePackages != "" || len(conf.PythonPath) > 0 {
+			return fmt.Errorf("incompatible arguments specified [shell,python,python_args,main,module,args,site_packages,python_path] for custom 'base'")
+		}
+	} else if conf.IsShell {
+		if conf.Main != "" || conf.Module != "" || len(conf.Args) > 0 {
+			return fmt.Errorf("incompatible arguments specified [main,module,args] for shell=true")
+		}
+	} else {
+		if conf.Main == "" && conf.Module == "" {
+			return fmt.Errorf("either 'main' or 'module' must be provided")
+		}
+		if conf.Main != "" && conf.Module != "" {
+			return fmt.Errorf("only one of 'main' and 'module' can be provided")
+		}
+	}
+
+	if conf.SitePackages != "" && !path.IsAbs(conf.SitePackages) {
+		return fmt.Errorf("'site_packages' must be an absolute path")
+	}
+	for _, dir := range conf.PythonPath {
+		if strings.Contains(dir, ":") {
+			return fmt.Errorf("'python_path' entries must not contain ':': '%s'", dir)
+		}
+	}
+
+	return conf.CommonRuntime.Validate()
+}
+func (conf python3Runtime) GetBootCmd(cmdConfs map[string]*CmdConfig, env map[string]string) (string, error) {
+	if conf.Base != "" {
+		return conf.CommonRuntime.BuildBootCmd("", cmdConfs, env)
+	}
+
+	// The environment is copied since it is shared with the parsed config set.
+	confEnv := make(map[string]string, len(conf.Env)+1)
+	for key, value := range conf.Env {
+		confEnv[key] = value
+	}
+	conf.Env = confEnv
+
+	pythonPath := conf.concatPythonPath()
+	if userPath := conf.Env["PYTHONPATH"]; userPath != "" && pythonPath != "" {
+		// Directories of the config set follow the ones given in 'env'.
+		conf.Env["PYTHONPATH"] = userPath + ":" + pythonPath
+	} else {
+		conf.setDefaultEnv(map[string]string{
+			"PYTHONPATH": pythonPath,
+		})
+	}
+
+	cmd := []string{python3Interpreter}
+	cmd = append(cmd, conf.PythonArgs...)
+	if !conf.IsShell {
+		if conf.Module != "" {
+			cmd = append(cmd, "-m", conf.Module)
+		} else {
+			cmd = append(cmd, conf.Main)
+		}
+		cmd = append(cmd, conf.Args...)
+	}
+	return conf.CommonRuntime.BuildBootCmd(strings.Join(cmd, " "), cmdConfs, env)
+}
+func (conf python3Runtime) GetYamlTemplate() string {
+	return `
+# REQUIRED
+# Filepath of the Python script.
+# Note that package root will correspond to filesystem root (/) in OSv image.
+# Example value: /hello-world.py
+main: <filepath>
+
+# OPTIONAL
+# Name of the module to run as with 'python3 -m' instead of the script.
+# Only one of 'main' and 'module' can be provided, so uncomment it and
+# remove 'main' to run a module.
+# Example value: http.server
+# module: <name>
+
+# OPTIONAL
+# Package providing the Python 3 interpreter in /usr/bin/python3.
+# Use it to select the version of Python. Default is osv.python3x.
+# Example value: python: osv.python3x
+python: <package-name>
+
+# OPTIONAL
+# A list of Python args.
+# Example value: python_args:
+#                   - -O
+python_args:
+   - <list>
+
+# OPTIONAL
+# A list of command line args used by the application.
+# Example value: args:
+#                   - argument1
+#                   - argument2
+args:
+   - <list>
+
+# OPTIONAL
+# The site-packages directory of the virtual environment of the application.
+# It is added to PYTHONPATH, after any directories given in 'env'.
+# Example value: /venv/lib/python3.6/site-packages
+site_packages: <path>
+
+# OPTIONAL
+# A list of directories added to PYTHONPATH before 'site_packages'.
+# Example value: python_path:
+#                   - /lib
+python_path:
+   - <list>
+` + conf.CommonRuntime.GetYamlTemplate()
+}
+
+//
+// Utility
+//
+
+func (conf python3Runtime) concatPythonPath() string {
+	dirs := append([]string{}, conf.PythonPath...)
+	if conf.SitePackages != "" {
+		dirs = append(dirs, conf.SitePackages)
+	}
+	return strings.Join(dirs, ":")
+}
@@ -0,0 +1,469 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/cloudius-systems/capstan/testing"
+	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v2"
+)
+
+type python3Suite struct {
+}
+
+var _ = Suite(&python3Suite{})
+
+func (*python3Suite) TestGetBootCmd(c *C) {
+	// Simulate meta/run.yaml of a package the config set can be based on.
+	cmdConfs := map[string]*CmdConfig{
+		"mypackage": &CmdConfig{
+			RuntimeType:      Native,
+			ConfigSetDefault: "run",
+			ConfigSets: map[string]Runtime{
+				"run": nativeRuntime{
+					BootCmd: "/mypackage.so",
+				},
+			},
+		},
+	}
+
+	m := []struct {
+		comment      string
+		runYamlText  string
+		expectedBoot string
+		expectedEnv  []string
+	}{
+		{
+			"simple",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    main: /script.py
+			`,
+			"/usr/bin/python3 /script.py", []string{},
+		},
+		{
+			"module",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    module: http.server
+			    args:
+			        - 8000
+			`,
+			"/usr/bin/python3 -m http.server 8000", []string{},
+		},
+		{
+			"python args and args",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    main: /script.py
+			    python_args:
+			        - -O
+			        - -u
+			    args:
+			        - localhost
+			        - 8000
+			`,
+			"/usr/bin/python3 -O -u /script.py localhost 8000", []string{},
+		},
+		{
+			"shell",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    shell: true
+			    python_args:
+			        - -q
+			`,
+			"/usr/bin/python3 -q", []string{},
+		},
+		{
+			"site packages",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    main: /script.py
+			    site_packages: /venv/lib/python3.6/site-packages
+			`,
+			"/usr/bin/python3 /script.py", []string{
+				"--env=PYTHONPATH?=/venv/lib/python3.6/site-packages",
+			},
+		},
+		{
+			"python path before site packages",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    main: /script.py
+			    site_packages: /venv/lib/python3.6/site-packages
+			    python_path:
+			        - /lib
+			        - /src
+			`,
+			"/usr/bin/python3 /script.py", []string{
+				"--env=PYTHONPATH?=/lib:/src:/venv/lib/python3.6/site-packages",
+			},
+		},
+		{
+			"env merged with python path",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    main: /script.py
+			    site_packages: /venv/lib/python3.6/site-packages
+			    python_path:
+			        - /lib
+			    env:
+			      PYTHONPATH: /other
+			`,
+			"/usr/bin/python3 /script.py", []string{
+				"--env=PYTHONPATH?=/other:/lib:/venv/lib/python3.6/site-packages",
+			},
+		},
+		{
+			"env without python path",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    main: /script.py
+			    env:
+			      PYTHONPATH: /other
+			`,
+			"/usr/bin/python3 /script.py", []string{
+				"--env=PYTHONPATH?=/other",
+			},
+		},
+		{
+			"custom base",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    base: "mypackage:run"
+			`,
+			"/mypackage.so", []string{},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare
+		cmdConfig, err := ParsePackageRunManifestData([]byte(FixIndent(args.runYamlText)))
+		testRuntime, _ := cmdConfig.selectConfigSetByName("default")
+
+		// This is what we're testing here.
+		boot, err := testRuntime.GetBootCmd(cmdConfs, map[string]string{})
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(boot, BootCmdEquals, args.expectedBoot, args.expectedEnv)
+	}
+}
+
+func (*python3Suite) TestGetBootCmdKeepsConfigSetEnv(c *C) {
+	// Prepare
+	cmdConfig, err := ParsePackageRunManifestData([]byte(FixIndent(`
+		runtime: python3
+		config_set:
+		  default:
+		    main: /script.py
+		    site_packages: /venv/site
+		    python_path:
+		        - /lib
+		    env:
+		      FOO: bar
+	`)))
+	c.Assert(err, IsNil)
+	testRuntime, _ := cmdConfig.selectConfigSetByName("default")
+
+	for i := 0; i < 2; i++ {
+		c.Logf("CALL #%d", i)
+
+		// This is what we're testing here.
+		boot, err := testRuntime.GetBootCmd(nil, map[string]string{})
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(boot, BootCmdEquals, "/usr/bin/python3 /script.py", []string{
+			"--env=FOO?=bar",
+			"--env=PYTHONPATH?=/lib:/venv/site",
+		})
+	}
+}
+
+func (*python3Suite) TestGetDependencies(c *C) {
+	m := []struct {
+		comment      string
+		runYamlText  string
+		expectedDeps []string
+	}{
+		{
+			"default package",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    main: /script.py
+			`,
+			[]string{"osv.python3x"},
+		},
+		{
+			"selected package",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    main: /script.py
+			    python: python-3.6
+			`,
+			[]string{"python-3.6"},
+		},
+		{
+			"packages of all config sets",
+			`
+			runtime: python3
+			config_set:
+			  second:
+			    main: /script.py
+			    python: python-3.6
+			  first:
+			    main: /script.py
+			    python: python-3.5
+			  third:
+			    main: /other.py
+			    python: python-3.6
+			config_set_default: second
+			`,
+			[]string{"python-3.5", "python-3.6"},
+		},
+		{
+			"default and selected package",
+			`
+			runtime: python3
+			config_set:
+			  first:
+			    main: /script.py
+			  second:
+			    main: /script.py
+			    python: python-3.6
+			`,
+			[]string{"osv.python3x", "python-3.6"},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare
+		runYamlPath := filepath.Join(c.MkDir(), "run.yaml")
+		err := ioutil.WriteFile(runYamlPath, []byte(FixIndent(args.runYamlText)), os.ModePerm)
+		c.Assert(err, IsNil)
+
+		// This is what we're testing here.
+		testRuntime, err := PackageRunManifestGeneral(runYamlPath)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(testRuntime.GetDependencies(), DeepEquals, args.expectedDeps)
+	}
+}
+
+func (*python3Suite) TestValidate(c *C) {
+	m := []struct {
+		comment     string
+		runYamlText string
+		err         string
+	}{
+		{
+			"incompatible with 'base' - main",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    base: "foo:bar"
+			    main: /script.py
+			`,
+			"incompatible arguments specified \\[shell,python,python_args,main,module,args,site_packages,python_path\\] for custom 'base'",
+		},
+		{
+			"incompatible with 'base' - python",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    base: "foo:bar"
+			    python: python-3.6
+			`,
+			"incompatible arguments specified \\[shell,python,python_args,main,module,args,site_packages,python_path\\] for custom 'base'",
+		},
+		{
+			"incompatible with 'base' - site_packages",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    base: "foo:bar"
+			    site_packages: /venv/lib/python3.6/site-packages
+			`,
+			"incompatible arguments specified \\[shell,python,python_args,main,module,args,site_packages,python_path\\] for custom 'base'",
+		},
+		{
+			"incompatible with 'shell' - main",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    shell: true
+			    main: /script.py
+			`,
+			"incompatible arguments specified \\[main,module,args\\] for shell=true",
+		},
+		{
+			"incompatible with 'shell' - module",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    shell: true
+			    module: http.server
+			`,
+			"incompatible arguments specified \\[main,module,args\\] for shell=true",
+		},
+		{
+			"missing main",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    python_args:
+			      - -O
+			`,
+			"either 'main' or 'module' must be provided",
+		},
+		{
+			"main and module",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    main: /script.py
+			    module: http.server
+			`,
+			"only one of 'main' and 'module' can be provided",
+		},
+		{
+			"relative site_packages",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    main: /script.py
+			    site_packages: venv/lib/python3.6/site-packages
+			`,
+			"'site_packages' must be an absolute path",
+		},
+		{
+			"python_path with colon",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    main: /script.py
+			    python_path:
+			      - /lib:/src
+			`,
+			"'python_path' entries must not contain ':': '/lib:/src'",
+		},
+		{
+			"valid module",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    module: http.server
+			`,
+			"",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare
+		cmdConfig, err := ParsePackageRunManifestData([]byte(FixIndent(args.runYamlText)))
+		testRuntime, _ := cmdConfig.selectConfigSetByName("default")
+
+		// This is what we're testing here.
+		err = testRuntime.Validate()
+
+		// Expectations.
+		if args.err == "" {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, args.err)
+		}
+	}
+}
+
+func (*python3Suite) TestGetYamlTemplateIsComplete(c *C) {
+	// Prepare
+	testRuntime := python3Runtime{}
+
+	// This is what we're testing here.
+	template := testRuntime.GetYamlTemplate()
+
+	// Expectations.
+	c.Check(template, MatchesMultiline, "python:")
+	c.Check(template, MatchesMultiline, "python_args:")
+	c.Check(template, MatchesMultiline, "main:")
+	c.Check(template, MatchesMultiline, "# module:")
+	c.Check(template, MatchesMultiline, "args:")
+	c.Check(template, MatchesMultiline, "site_packages:")
+	c.Check(template, MatchesMultiline, "python_path:")
+	c.Check(template, MatchesMultiline, "env:")
+}
+
+func (*python3Suite) TestGetYamlTemplateSetsOnlyMain(c *C) {
+	// Prepare
+	testRuntime := python3Runtime{}
+	template := testRuntime.GetYamlTemplate()
+
+	// This is what we're testing here.
+	conf := python3Runtime{}
+	err := yaml.Unmarshal([]byte(template), &conf)
+
+	// Expectations.
+	// Only one of 'main' and 'module' can be provided.
+	c.Assert(err, IsNil)
+	c.Check(conf.Main, Not(Equals), "")
+	c.Check(conf.Module, Equals, "")
+}
+
+func (*python3Suite) TestGetYamlTemplateIsValidYaml(c *C) {
+	// Prepare
+	testRuntime := python3Runtime{}
+	template := testRuntime.GetYamlTemplate()
+
+	// This is what we're testing here.
+	err := yaml.Unmarshal([]byte(template), &python3Runtime{})
+
+	// Expectations.
+	c.Assert(err, IsNil)
+}
@@ -19,10 +19,11 @@ import (
 type RuntimeType string
 
 const (
-	Native RuntimeType = "native"
-	NodeJS RuntimeType = "node"
-	Java   RuntimeType = "java"
-	Python RuntimeType = "python"
+	Native  RuntimeType = "native"
+	NodeJS  RuntimeType = "node"
+	Java    RuntimeType = "java"
+	Python  RuntimeType = "python"
+	Python3 RuntimeType = "python3"
 )
 
 var SupportedRuntimes []RuntimeType = []RuntimeType{
@@ -30,6 +31,7 @@ var SupportedRuntimes []RuntimeType = []RuntimeType{
 	NodeJS,
 	Java,
 	Python,
+	Python3,
 }
 
 type RunConfig struct {
@@ -189,6 +191,8 @@ func PickRuntime(runtimeName RuntimeType) (Runtime, error) {
 		return &javaRuntime{}, nil
 	case Python:
 		return &pythonRuntime{}, nil
+	case Python3:
+		return &python3Runtime{}, nil
 	}
 
 	return nil, fmt.Errorf("Unknown runtime: '%s'\n", runtimeName)
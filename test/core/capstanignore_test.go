@@ -8,6 +8,8 @@
 package core_test
 
 import (
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 
 	"github.com/cloudius-systems/capstan/core"
@@ -66,15 +68,19 @@ func (s *testingCapstanignoreSuite) TestIsIgnored(c *C) {
 		},
 		{
 			"fully specified file in any subfolder #1",
-			"/**/file.txt", "/myfile.txt", true,
+			"/**/myfile.txt", "/myfile.txt", true,
 		},
 		{
 			"fully specified file in any subfolder #2",
-			"/**/file.txt", "/myfolder/myfile.txt", true,
+			"/**/myfile.txt", "/myfolder/myfile.txt", true,
 		},
 		{
 			"fully specified file in any subfolder #3",
-			"/**/file.txt", "/myfolder/subfolder/myfile.txt", true,
+			"/**/myfile.txt", "/myfolder/subfolder/myfile.txt", true,
+		},
+		{
+			"fully specified file in any subfolder #4",
+			"/**/file.txt", "/myfolder/myfile.txt", false,
 		},
 		{
 			"whole folder one level #1",
@@ -164,6 +170,10 @@ func (s *testingCapstanignoreSuite) TestIsIgnored(c *C) {
 			"always ignore /volumes",
 			"", "/volumes", true,
 		},
+		{
+			"/capstan.yaml is not ignored by default",
+			"", "/capstan.yaml", false,
+		},
 	}
 	for i, args := range m {
 		c.Logf("CASE #%d: %s", i, args.comment)
@@ -180,6 +190,162 @@ func (s *testingCapstanignoreSuite) TestIsIgnored(c *C) {
 	}
 }
 
+func (s *testingCapstanignoreSuite) TestIsIgnoredGitignoreSemantics(c *C) {
+	m := []struct {
+		comment      string
+		patterns     []string
+		path         string
+		shouldIgnore bool
+	}{
+		{
+			"pattern without slash at any depth #1",
+			[]string{"*.log"}, "/app.log", true,
+		},
+		{
+			"pattern without slash at any depth #2",
+			[]string{"*.log"}, "/myfolder/subfolder/app.log", true,
+		},
+		{
+			"pattern with slash in the middle is anchored",
+			[]string{"myfolder/*.log"}, "/other/myfolder/app.log", false,
+		},
+		{
+			"ignored folder propagates to children",
+			[]string{"/myfolder"}, "/myfolder/subfolder/myfile.txt", true,
+		},
+		{
+			"negation re-includes file",
+			[]string{"*.txt", "!keep.txt"}, "/myfolder/keep.txt", false,
+		},
+		{
+			"negation followed by pattern ignores again",
+			[]string{"!keep.txt", "*.txt"}, "/myfolder/keep.txt", true,
+		},
+		{
+			"negation can not re-include file in ignored folder",
+			[]string{"/myfolder", "!/myfolder/keep.txt"}, "/myfolder/keep.txt", true,
+		},
+		{
+			"negation re-includes file in ignored folder content",
+			[]string{"/myfolder/*", "!/myfolder/keep.txt"}, "/myfolder/keep.txt", false,
+		},
+		{
+			"trailing slash matches directory",
+			[]string{"build/"}, "/myfolder/build/", true,
+		},
+		{
+			"trailing slash does not match file",
+			[]string{"build/"}, "/myfolder/build", false,
+		},
+		{
+			"trailing slash matches file in directory",
+			[]string{"build/"}, "/build/out.o", true,
+		},
+		{
+			"question mark",
+			[]string{"/file?.txt"}, "/file1.txt", true,
+		},
+		{
+			"question mark does not match slash",
+			[]string{"/myfolder?file.txt"}, "/myfolder/file.txt", false,
+		},
+		{
+			"character class #1",
+			[]string{"/file[0-9].txt"}, "/file7.txt", true,
+		},
+		{
+			"character class #2",
+			[]string{"/file[0-9].txt"}, "/fileX.txt", false,
+		},
+		{
+			"negated character class",
+			[]string{"/file[!0-9].txt"}, "/file7.txt", false,
+		},
+		{
+			"named character class",
+			[]string{"/file[[:alpha:]].txt"}, "/fileX.txt", true,
+		},
+		{
+			"escaped star",
+			[]string{"/file\\*.txt"}, "/file1.txt", false,
+		},
+		{
+			"escaped star matches star",
+			[]string{"/file\\*.txt"}, "/file*.txt", true,
+		},
+		{
+			"escaped exclamation mark",
+			[]string{"\\!important.txt"}, "/!important.txt", true,
+		},
+		{
+			"leading two stars",
+			[]string{"**/logs"}, "/myfolder/logs/app.log", true,
+		},
+		{
+			"trailing two stars",
+			[]string{"/myfolder/**"}, "/myfolder/subfolder/myfile.txt", true,
+		},
+		{
+			"trailing two stars keeps folder",
+			[]string{"/myfolder/**"}, "/myfolder/", false,
+		},
+		{
+			"always ignore nested .capstanignore",
+			[]string{}, "/myfolder/.capstanignore", true,
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Setup
+		capstanignore, _ := core.CapstanignoreInit("")
+		for _, pattern := range args.patterns {
+			c.Assert(capstanignore.AddPattern(pattern), IsNil)
+		}
+
+		// This is what we're testing here.
+		ignoreYesNo := capstanignore.IsIgnored(args.path)
+
+		// Expectations.
+		c.Check(ignoreYesNo, Equals, args.shouldIgnore)
+	}
+}
+
+func (s *testingCapstanignoreSuite) TestLoadNestedFile(c *C) {
+	// Setup
+	tmp := c.MkDir()
+	rootFile := filepath.Join(tmp, "root")
+	nestedFile := filepath.Join(tmp, "nested")
+	c.Assert(ioutil.WriteFile(rootFile, []byte("# comment\n*.txt\n/data\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(nestedFile, []byte("!keep.txt\n/data\n"), 0644), IsNil)
+	capstanignore, err := core.CapstanignoreInit(rootFile)
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	err = capstanignore.LoadNestedFile(nestedFile, "/myfolder")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(capstanignore.IsIgnored("/keep.txt"), Equals, true)
+	c.Check(capstanignore.IsIgnored("/myfolder/keep.txt"), Equals, false)
+	c.Check(capstanignore.IsIgnored("/myfolder/subfolder/keep.txt"), Equals, false)
+	c.Check(capstanignore.IsIgnored("/myfolder/other.txt"), Equals, true)
+	c.Check(capstanignore.IsIgnored("/data/"), Equals, true)
+	c.Check(capstanignore.IsIgnored("/myfolder/data/"), Equals, true)
+	c.Check(capstanignore.IsIgnored("/other/data/"), Equals, false)
+}
+
+func (s *testingCapstanignoreSuite) TestAddPatternInvalid(c *C) {
+	// Setup
+	capstanignore, _ := core.CapstanignoreInit("")
+
+	// This is what we're testing here.
+	err := capstanignore.AddPattern("/myfolder\\")
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "invalid pattern '/myfolder\\\\': trailing backslash")
+}
+
 func (s *testingCapstanignoreSuite) TestIsIgnoredMeta(c *C) {
 	// Setup
 	capstanignore, _ := core.CapstanignoreInit("")
@@ -190,3 +356,15 @@ func (s *testingCapstanignoreSuite) TestIsIgnoredMeta(c *C) {
 	// Expectations.
 	c.Check(err, ErrorMatches, "please remove '/meta' from .capstanignore")
 }
+
+func (s *testingCapstanignoreSuite) TestNewCapstanignore(c *C) {
+	// This is what we're testing here.
+	capstanignore, err := core.NewCapstanignore([]string{"/usr/share/doc", "/**/*.h"})
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(capstanignore.IsIgnored("/usr/share/doc"), Equals, true)
+	c.Check(capstanignore.IsIgnored("/usr/include/stdio.h"), Equals, true)
+	c.Check(capstanignore.IsIgnored("/volumes"), Equals, false)
+	c.Check(capstanignore.IsIgnored("/meta/package.yaml"), Equals, false)
+}
@@ -0,0 +1,581 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileTree is a virtual tree of the files an image is composed of. Files are
+// added from package archives, from directories on the host and from memory.
+// A file added later overrides the file at the same path, just like when the
+// content is extracted into the same directory one package after another.
+// The tree only records where the data of each file comes from, the data is
+// streamed from its source when the tree is written (see StreamData).
+type FileTree struct {
+	root     *FileNode
+	archives []*treeArchive
+	// hostFiles maps identities of files on the host with several hard links
+	// to the first node added for them.
+	hostFiles map[interface{}]*FileNode
+}
+
+// FileNode is a directory, regular file or symbolic link in the FileTree.
+type FileNode struct {
+	Name    string
+	Path    string
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+	// Link is the target of a symbolic link.
+	Link string
+	// Source is the name of the package (or other origin) the file comes from.
+	Source string
+	// Shadows is the source of the file this file has overridden, if it came
+	// from a different source.
+	Shadows string
+	// Hash is SHA256 hash of the content of a regular file. It is only known
+	// once the data of the file has been streamed.
+	Hash string
+
+	children map[string]*FileNode
+	// origin is the first node of a set of hard links to the same file.
+	origin   *FileNode
+	hostPath string
+	data     []byte
+	archive  *treeArchive
+	entry    int
+}
+
+// ArchiveOpener opens a tar archive for reading. The closer is closed once
+// the archive has been read.
+type ArchiveOpener func() (*tar.Reader, io.Closer, error)
+
+// ArchiveFilter decides whether the tar entry is added to the tree. It may
+// read the data of the entry, e.g. to parse the metadata of a package.
+type ArchiveFilter func(header *tar.Header, data io.Reader) (bool, error)
+
+type treeArchive struct {
+	source string
+	open   ArchiveOpener
+}
+
+// NewFileTree returns a tree holding just the root directory.
+func NewFileTree() *FileTree {
+	return &FileTree{
+		root:      &FileNode{Path: "/", Mode: os.ModeDir | 0755, children: map[string]*FileNode{}},
+		hostFiles: make(map[interface{}]*FileNode),
+	}
+}
+
+// NewFileTreeFromPaths returns a tree of the given host paths mapped to their
+// target paths, as returned by CollectDirectoryContents.
+func NewFileTreeFromPaths(paths map[string]string) (*FileTree, error) {
+	tree := NewFileTree()
+	for hostPath, targetPath := range paths {
+		if targetPath == "/" {
+			continue
+		}
+		info, err := os.Lstat(hostPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := tree.AddHostPath(targetPath, hostPath, info, ""); err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+func (n *FileNode) IsDir() bool {
+	return n.Mode.IsDir()
+}
+
+func (n *FileNode) IsRegular() bool {
+	return n.Mode.IsRegular()
+}
+
+func (n *FileNode) IsSymlink() bool {
+	return n.Mode&os.ModeSymlink != 0
+}
+
+// HostPath returns the path of the file on the host or an empty string if
+// the data of the file comes from an archive or memory.
+func (n *FileNode) HostPath() string {
+	return n.hostPath
+}
+
+// LinkOrigin returns the node that the file is a hard link to, or the node
+// itself if the file has a single link within the tree. All hard links to the
+// same file share the same data and inode.
+func (n *FileNode) LinkOrigin() *FileNode {
+	if n.origin != nil {
+		return n.origin
+	}
+	return n
+}
+
+// Children returns entries of the directory sorted by their names.
+func (n *FileNode) Children() []*FileNode {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	children := make([]*FileNode, len(names))
+	for i, name := range names {
+		children[i] = n.children[name]
+	}
+	return children
+}
+
+// Root returns the root directory of the tree.
+func (t *FileTree) Root() *FileNode {
+	return t.root
+}
+
+// Lookup returns the node at the given path or nil if there is none. Symbolic
+// links are not followed.
+func (t *FileTree) Lookup(filePath string) *FileNode {
+	node := t.root
+	for _, name := range splitTreePath(filePath) {
+		if node = node.children[name]; node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// Walk calls fn for every node of the tree except the root. Directories are
+// visited before their entries and entries are visited in the order of their
+// names.
+func (t *FileTree) Walk(fn func(node *FileNode) error) error {
+	return walkTree(t.root, fn)
+}
+
+func walkTree(dir *FileNode, fn func(node *FileNode) error) error {
+	for _, child := range dir.Children() {
+		if err := fn(child); err != nil {
+			return err
+		}
+		if child.IsDir() {
+			if err := walkTree(child, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AddDir adds a directory. Content of an existing directory is kept.
+func (t *FileTree) AddDir(dirPath string, mode os.FileMode, modTime time.Time, source string) {
+	t.add(&FileNode{Path: dirPath, Mode: os.ModeDir | mode.Perm(), ModTime: modTime, Source: source})
+}
+
+// AddSymlink adds a symbolic link pointing to the given target.
+func (t *FileTree) AddSymlink(linkPath, target string, modTime time.Time, source string) {
+	t.add(&FileNode{Path: linkPath, Mode: os.ModeSymlink | 0777, Size: int64(len(target)), ModTime: modTime,
+		Link: target, Source: source})
+}
+
+// AddData adds a regular file with the given content.
+func (t *FileTree) AddData(filePath string, data []byte, mode os.FileMode, source string) {
+	t.add(&FileNode{Path: filePath, Mode: mode.Perm(), Size: int64(len(data)), Source: source,
+		Hash: fmt.Sprintf("%x", sha256.Sum256(data)), data: data})
+}
+
+// AddHostPath adds the file on the host described by info at the given path.
+func (t *FileTree) AddHostPath(filePath, hostPath string, info os.FileInfo, source string) error {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(hostPath)
+		if err != nil {
+			return err
+		}
+		t.AddSymlink(filePath, target, info.ModTime(), source)
+	case info.IsDir():
+		t.AddDir(filePath, info.Mode(), info.ModTime(), source)
+	case info.Mode().IsRegular():
+		node := &FileNode{Path: filePath, Mode: info.Mode().Perm(), Size: info.Size(), ModTime: info.ModTime(),
+			Source: source, hostPath: hostPath}
+		// Hard links of the same host file become links of the same node,
+		// so their data is hashed and written into the image only once.
+		if key, nlink := HardLinkIdentity(info); key != nil && nlink > 1 {
+			if origin, ok := t.hostFiles[key]; ok {
+				node.origin = origin
+			} else {
+				t.hostFiles[key] = node
+			}
+		}
+		t.add(node)
+	default:
+		return fmt.Errorf("File %s has unsupported mode %v", hostPath, info.Mode())
+	}
+	return nil
+}
+
+// AddArchive adds all entries of the tar archive accepted by the filter (nil
+// accepts all of them). Only the headers are read here, the archive is opened
+// again to stream the data of its files. Hard links share the data of the
+// file they point to. If that file is not accepted by the filter, the first
+// accepted link to it becomes a regular file owning the data.
+func (t *FileTree) AddArchive(source string, open ArchiveOpener, filter ArchiveFilter) error {
+	reader, closer, err := open()
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	archive := &treeArchive{source: source, open: open}
+	t.archives = append(t.archives, archive)
+	// Regular files left out by the filter, so that hard links to them can
+	// still refer to their data.
+	excluded := make(map[string]*FileNode)
+
+	for entry := 0; ; entry++ {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", source, err)
+		}
+
+		if filter != nil {
+			include, err := filter(header, reader)
+			if err != nil {
+				return err
+			}
+			if !include {
+				if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+					excluded[path.Clean("/"+header.Name)] = &FileNode{Size: header.Size, archive: archive, entry: entry}
+				}
+				continue
+			}
+		}
+
+		filePath := path.Clean("/" + header.Name)
+		if filePath == "/" {
+			continue
+		}
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			t.AddDir(filePath, mode, header.ModTime, source)
+		case tar.TypeSymlink:
+			t.AddSymlink(filePath, header.Linkname, header.ModTime, source)
+		case tar.TypeReg, tar.TypeRegA:
+			t.add(&FileNode{Path: filePath, Mode: mode, Size: header.Size, ModTime: header.ModTime,
+				Source: source, archive: archive, entry: entry})
+		case tar.TypeLink:
+			linkPath := path.Clean("/" + header.Linkname)
+			target := t.Lookup(linkPath)
+			if data, ok := excluded[linkPath]; ok && data.Path == "" {
+				node := &FileNode{Path: filePath, Mode: mode, Size: data.Size, ModTime: header.ModTime,
+					Source: source, archive: archive, entry: data.entry}
+				t.add(node)
+				excluded[linkPath] = node
+				continue
+			} else if ok {
+				target = data
+			}
+			if target == nil || target.archive != archive {
+				return fmt.Errorf("%s: %s is a hard link to %s which is not in the archive", source, filePath, header.Linkname)
+			}
+			t.add(&FileNode{Path: filePath, Mode: mode, Size: target.Size, ModTime: header.ModTime,
+				Source: source, archive: archive, entry: target.entry, origin: target.LinkOrigin()})
+		default:
+			return fmt.Errorf("%s: file %s has unsupported type %c", source, filePath, header.Typeflag)
+		}
+	}
+}
+
+// Remove removes the node at the given path along with its content.
+func (t *FileTree) Remove(filePath string) {
+	names := splitTreePath(filePath)
+	if len(names) == 0 {
+		return
+	}
+	if parent := t.Lookup(path.Dir(path.Clean("/" + filePath))); parent != nil && parent.IsDir() {
+		delete(parent.children, names[len(names)-1])
+	}
+}
+
+// StreamData calls fn with the data of every regular file accepted by want
+// (nil accepts all of them). Archives are read once each in the order they
+// were added, followed by the files on the host and in memory. Hard links to
+// the same file are passed to fn together.
+// Hash of the files is set once fn returns.
+func (t *FileTree) StreamData(want func(node *FileNode) bool, fn func(nodes []*FileNode, data io.Reader) error) error {
+	entries := make(map[*treeArchive]map[int][]*FileNode)
+	var others [][]*FileNode
+	links := make(map[*FileNode]int)
+	t.Walk(func(node *FileNode) error {
+		if !node.IsRegular() || (want != nil && !want(node)) {
+			return nil
+		}
+		if node.archive == nil {
+			if i, ok := links[node.LinkOrigin()]; ok {
+				others[i] = append(others[i], node)
+			} else {
+				links[node.LinkOrigin()] = len(others)
+				others = append(others, []*FileNode{node})
+			}
+			return nil
+		}
+		if entries[node.archive] == nil {
+			entries[node.archive] = make(map[int][]*FileNode)
+		}
+		entries[node.archive][node.entry] = append(entries[node.archive][node.entry], node)
+		return nil
+	})
+
+	for _, archive := range t.archives {
+		if err := archive.stream(entries[archive], fn); err != nil {
+			return err
+		}
+	}
+
+	for _, nodes := range others {
+		if err := streamFile(nodes, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadFile returns the data of the regular file at the given path.
+func (t *FileTree) ReadFile(filePath string) ([]byte, error) {
+	node := t.Lookup(filePath)
+	if node == nil || !node.IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", filePath)
+	}
+
+	var data []byte
+	err := t.StreamData(func(n *FileNode) bool {
+		return n == node
+	}, func(nodes []*FileNode, reader io.Reader) error {
+		var err error
+		data, err = ioutil.ReadAll(reader)
+		return err
+	})
+	return data, err
+}
+
+// streamFile streams the data of the file on the host or in memory.
+func streamFile(nodes []*FileNode, fn func(nodes []*FileNode, data io.Reader) error) error {
+	if nodes[0].hostPath == "" {
+		return streamNodes(nodes, bytes.NewReader(nodes[0].data), fn)
+	}
+
+	file, err := os.Open(nodes[0].hostPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return streamNodes(nodes, file, fn)
+}
+
+func (a *treeArchive) stream(entries map[int][]*FileNode, fn func(nodes []*FileNode, data io.Reader) error) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	reader, closer, err := a.open()
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	for entry := 0; len(entries) > 0; entry++ {
+		if _, err := reader.Next(); err == io.EOF {
+			return fmt.Errorf("%s: archive has changed while its content was being read", a.source)
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", a.source, err)
+		}
+
+		if nodes, ok := entries[entry]; ok {
+			if err := streamNodes(nodes, reader, fn); err != nil {
+				return err
+			}
+			delete(entries, entry)
+		}
+	}
+	return nil
+}
+
+// streamNodes passes the data to fn and records its hash in the nodes.
+func streamNodes(nodes []*FileNode, data io.Reader, fn func(nodes []*FileNode, data io.Reader) error) error {
+	h := sha256.New()
+	tee := io.TeeReader(data, h)
+	if err := fn(nodes, tee); err != nil {
+		return err
+	}
+	// The data not consumed by fn is still part of the file.
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return err
+	}
+
+	hash := fmt.Sprintf("%x", h.Sum(nil))
+	for _, node := range nodes {
+		node.Hash = hash
+	}
+	return nil
+}
+
+// Extract writes the content of the tree into the target directory. Just like
+// when extracting packages, symbolic links that cannot be created on the host
+// are silently skipped.
+func (t *FileTree) Extract(targetPath string) error {
+	err := t.Walk(func(node *FileNode) error {
+		hostPath := filepath.Join(targetPath, filepath.FromSlash(node.Path))
+		switch {
+		case node.IsDir():
+			return os.MkdirAll(hostPath, node.Mode.Perm())
+		case node.IsSymlink():
+			os.Symlink(node.Link, hostPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.StreamData(nil, func(nodes []*FileNode, data io.Reader) error {
+		for i, node := range nodes {
+			hostPath := filepath.Join(targetPath, filepath.FromSlash(node.Path))
+			if i > 0 {
+				firstPath := filepath.Join(targetPath, filepath.FromSlash(nodes[0].Path))
+				if err := os.Link(firstPath, hostPath); err != nil {
+					if err := CopyLocalFile(hostPath, firstPath); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			file, err := os.OpenFile(hostPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, node.Mode.Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(file, data); err != nil {
+				file.Close()
+				return err
+			}
+			if err := file.Close(); err != nil {
+				return err
+			}
+			if err := os.Chmod(hostPath, node.Mode.Perm()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// add puts the node into the tree, creating the missing parent directories.
+// Symbolic links among the parents are followed within the tree unless they
+// lead to a file, so the node ends up in the directory they point to and the
+// links are kept. Any other parent that is not a directory is replaced by
+// one. Existing directory only takes over the attributes of the new one while
+// any other existing node is replaced.
+func (t *FileTree) add(node *FileNode) {
+	names := splitTreePath(node.Path)
+	if len(names) == 0 {
+		return
+	}
+	if dirs, ok := t.resolveDir(names[:len(names)-1], 0); ok {
+		names = append(append([]string{}, dirs...), names[len(names)-1])
+	}
+
+	parent := t.root
+	for i, name := range names[:len(names)-1] {
+		child := parent.children[name]
+		if child == nil || !child.IsDir() {
+			child = &FileNode{
+				Name:     name,
+				Path:     "/" + strings.Join(names[:i+1], "/"),
+				Mode:     os.ModeDir | 0775,
+				Source:   node.Source,
+				children: map[string]*FileNode{},
+			}
+			parent.children[name] = child
+		}
+		parent = child
+	}
+
+	node.Name = names[len(names)-1]
+	node.Path = "/" + strings.Join(names, "/")
+	existing := parent.children[node.Name]
+	if existing != nil && existing.IsDir() && node.IsDir() {
+		existing.Mode, existing.ModTime, existing.Source = node.Mode, node.ModTime, node.Source
+		return
+	}
+	if existing != nil && !existing.IsDir() && !node.IsDir() {
+		node.Shadows = existing.Shadows
+		if existing.Source != node.Source {
+			node.Shadows = existing.Source
+		}
+	}
+	if node.IsDir() {
+		node.children = map[string]*FileNode{}
+	}
+	parent.children[node.Name] = node
+}
+
+// maxSymlinks is the number of symbolic links followed when resolving a path,
+// so that loops of links are detected.
+const maxSymlinks = 40
+
+// resolveDir returns the directory path with all symbolic links among its
+// components followed. Components that do not exist yet are kept as they
+// are. False is returned if the path leads to a file or too many links.
+func (t *FileTree) resolveDir(names []string, links int) ([]string, bool) {
+	dir := t.root
+	for i, name := range names {
+		child := dir.children[name]
+		switch {
+		case child == nil:
+			return names, true
+		case child.IsSymlink():
+			if links == maxSymlinks {
+				return nil, false
+			}
+			target := child.Link
+			if !path.IsAbs(target) {
+				target = path.Join(dir.Path, target)
+			}
+			return t.resolveDir(append(splitTreePath(target), names[i+1:]...), links+1)
+		case !child.IsDir():
+			return nil, false
+		}
+		dir = child
+	}
+	return names, true
+}
+
+func splitTreePath(filePath string) []string {
+	filePath = strings.Trim(path.Clean("/"+filepath.ToSlash(filePath)), "/")
+	if filePath == "" {
+		return nil
+	}
+	return strings.Split(filePath, "/")
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudius-systems/capstan/util"
+	. "gopkg.in/check.v1"
+)
+
+type fileTreeSuite struct{}
+
+var _ = Suite(&fileTreeSuite{})
+
+// tarEntry is either a directory (name ending with /), a symbolic link (link
+// is set), a hard link (hardLink is set) or a regular file.
+type tarEntry struct {
+	name     string
+	content  string
+	link     string
+	hardLink string
+}
+
+func archiveOpener(c *C, entries []tarEntry) util.ArchiveOpener {
+	buf := bytes.Buffer{}
+	w := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.content))}
+		switch {
+		case e.link != "":
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, e.link, 0
+		case e.hardLink != "":
+			header.Typeflag, header.Linkname, header.Size = tar.TypeLink, e.hardLink, 0
+		case e.name[len(e.name)-1] == '/':
+			header.Typeflag, header.Mode = tar.TypeDir, 0755
+		}
+		c.Assert(w.WriteHeader(header), IsNil)
+		if header.Typeflag == tar.TypeReg {
+			_, err := w.Write([]byte(e.content))
+			c.Assert(err, IsNil)
+		}
+	}
+	c.Assert(w.Close(), IsNil)
+
+	return func() (*tar.Reader, io.Closer, error) {
+		return tar.NewReader(bytes.NewReader(buf.Bytes())), ioutil.NopCloser(nil), nil
+	}
+}
+
+func (*fileTreeSuite) TestFileTreeOverridesEarlierFiles(c *C) {
+	tree := util.NewFileTree()
+	err := tree.AddArchive("first", archiveOpener(c, []tarEntry{
+		{name: "etc/"},
+		{name: "etc/config", content: "first"},
+		{name: "lib/file.so", content: "library"},
+		{name: "lib/link.so", link: "file.so"},
+		{name: "meta/run.yaml", content: "runtime: native"},
+	}), func(header *tar.Header, data io.Reader) (bool, error) {
+		return header.Name != "meta/run.yaml", nil
+	})
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	tree.AddData("/etc/config", []byte("second"), 0600, "second")
+	tree.AddData("/lib/link.so/file", []byte("data"), 0644, "second")
+
+	// Expectations.
+	c.Check(tree.Lookup("/meta"), IsNil)
+	c.Check(tree.Lookup("/etc/config").Source, Equals, "second")
+	c.Check(tree.Lookup("/etc/config").Size, Equals, int64(6))
+	c.Check(tree.Lookup("/etc/config").Shadows, Equals, "first")
+	c.Check(tree.Lookup("/lib/file.so").Shadows, Equals, "")
+	c.Check(tree.Lookup("/lib/file.so").Source, Equals, "first")
+	c.Check(tree.Lookup("lib/link.so").IsDir(), Equals, true)
+
+	var paths []string
+	tree.Walk(func(node *util.FileNode) error {
+		paths = append(paths, node.Path)
+		return nil
+	})
+	c.Check(paths, DeepEquals, []string{"/etc", "/etc/config", "/lib", "/lib/file.so", "/lib/link.so", "/lib/link.so/file"})
+}
+
+func (*fileTreeSuite) TestFileTreeFollowsSymlinkedParents(c *C) {
+	tree := util.NewFileTree()
+	err := tree.AddArchive("first", archiveOpener(c, []tarEntry{
+		{name: "usr/lib/jvm/java-8/"},
+		{name: "usr/lib/jvm/java", link: "java-8"},
+		{name: "usr/lib/jvm/default", link: "/usr/lib/jvm/java"},
+		{name: "usr/lib/jvm/missing", link: "java-9"},
+		{name: "loop", link: "loop"},
+	}), nil)
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	tree.AddData("/usr/lib/jvm/java/lib/x.jar", []byte("x"), 0644, "second")
+	tree.AddData("/usr/lib/jvm/default/y.jar", []byte("y"), 0644, "second")
+	tree.AddData("/usr/lib/jvm/missing/z.jar", []byte("z"), 0644, "second")
+	tree.AddData("/loop/file", []byte("loop"), 0644, "second")
+
+	// Expectations.
+	c.Check(tree.Lookup("/usr/lib/jvm/java").Link, Equals, "java-8")
+	c.Check(tree.Lookup("/usr/lib/jvm/java-8/lib/x.jar").Path, Equals, "/usr/lib/jvm/java-8/lib/x.jar")
+	c.Check(tree.Lookup("/usr/lib/jvm/default").Link, Equals, "/usr/lib/jvm/java")
+	c.Check(tree.Lookup("/usr/lib/jvm/java-8/y.jar").Source, Equals, "second")
+	c.Check(tree.Lookup("/usr/lib/jvm/missing").Link, Equals, "java-9")
+	c.Check(tree.Lookup("/usr/lib/jvm/java-9/z.jar").Source, Equals, "second")
+	// A loop of links can't be followed, so the link is replaced.
+	c.Check(tree.Lookup("/loop").IsDir(), Equals, true)
+	c.Check(tree.Lookup("/loop/file").Source, Equals, "second")
+}
+
+func (*fileTreeSuite) TestFileTreeStreamData(c *C) {
+	tree := util.NewFileTree()
+	err := tree.AddArchive("pkg", archiveOpener(c, []tarEntry{
+		{name: "a", content: "archived a"},
+		{name: "b", content: "archived b"},
+		{name: "c", hardLink: "b"},
+		{name: "d", content: "archived d"},
+	}), nil)
+	c.Assert(err, IsNil)
+	tree.AddData("/a", []byte("memory a"), 0644, "")
+
+	// This is what we're testing here.
+	var streamed []string
+	err = tree.StreamData(func(node *util.FileNode) bool {
+		return node.Path != "/d"
+	}, func(nodes []*util.FileNode, data io.Reader) error {
+		content, err := ioutil.ReadAll(data)
+		c.Assert(err, IsNil)
+		for _, node := range nodes {
+			streamed = append(streamed, node.Path+"="+string(content))
+		}
+		return nil
+	})
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(streamed, DeepEquals, []string{"/b=archived b", "/c=archived b", "/a=memory a"})
+	c.Check(tree.Lookup("/b").Hash, Equals, "818cf120c467a9d8a6af6ea3304a423b1e3d0a4d95ad65e2fc8d0ce708e6ac89")
+	c.Check(tree.Lookup("/c").Hash, Equals, tree.Lookup("/b").Hash)
+	c.Check(tree.Lookup("/d").Hash, Equals, "")
+}
+
+func (*fileTreeSuite) TestFileTreeHardLinkToExcludedFile(c *C) {
+	tree := util.NewFileTree()
+
+	// This is what we're testing here.
+	err := tree.AddArchive("pkg", archiveOpener(c, []tarEntry{
+		{name: "excluded", content: "shared"},
+		{name: "a", hardLink: "excluded"},
+		{name: "b", hardLink: "excluded"},
+	}), func(header *tar.Header, data io.Reader) (bool, error) {
+		return header.Name != "excluded", nil
+	})
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(tree.Lookup("/excluded"), IsNil)
+	a, b := tree.Lookup("/a"), tree.Lookup("/b")
+	c.Check(a.LinkOrigin(), Equals, a)
+	c.Check(b.LinkOrigin(), Equals, a)
+	c.Check(b.Size, Equals, int64(len("shared")))
+	data, err := tree.ReadFile("/b")
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "shared")
+}
+
+func (*fileTreeSuite) TestFileTreeExtract(c *C) {
+	tmp, _ := ioutil.TempDir("", "pkg")
+	defer os.RemoveAll(tmp)
+	tree := util.NewFileTree()
+	err := tree.AddArchive("pkg", archiveOpener(c, []tarEntry{
+		{name: "dir/file", content: "archived"},
+		{name: "dir/link", link: "file"},
+	}), nil)
+	c.Assert(err, IsNil)
+	tree.AddData("/run/cmd", []byte("/dir/file"), 0700, "")
+
+	// This is what we're testing here.
+	err = tree.Extract(tmp)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	content, err := ioutil.ReadFile(filepath.Join(tmp, "dir", "link"))
+	c.Assert(err, IsNil)
+	c.Check(string(content), Equals, "archived")
+	info, err := os.Stat(filepath.Join(tmp, "run", "cmd"))
+	c.Assert(err, IsNil)
+	c.Check(info.Mode().Perm(), Equals, os.FileMode(0700))
+}
@@ -9,9 +9,18 @@
 package util
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"time"
+
+	"github.com/cloudius-systems/capstan/image"
+	"github.com/cloudius-systems/capstan/image/mbr"
+	"github.com/cloudius-systems/capstan/image/qcow2"
 )
 
 func ConvertImageToQCOW2(imagePath string) error {
@@ -19,10 +28,8 @@ func ConvertImageToQCOW2(imagePath string) error {
 		return err
 	}
 
-	cmd := exec.Command("qemu-img", "convert", "-f", "raw", "-O", "qcow2", imagePath, imagePath+".qcow2")
-	_, err := cmd.Output()
-	if err != nil {
-		fmt.Printf("Converting image %s to QCOW2 format failed in qemu-img\n", imagePath)
+	if err := qcow2.ConvertFromRaw(imagePath, imagePath+".qcow2"); err != nil {
+		fmt.Printf("Converting image %s to QCOW2 format failed\n", imagePath)
 		return err
 	}
 
@@ -40,97 +47,261 @@ func ConvertImageToQCOW2(imagePath string) error {
 }
 
 func ResizeImage(imagePath string, targetSize uint64) error {
-	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+	format, err := image.Probe(imagePath)
+	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command("qemu-img", "resize", imagePath, fmt.Sprintf("%db", targetSize))
-	_, err := cmd.Output()
+	switch format {
+	case image.QCOW2:
+		err = qcow2.Resize(imagePath, int64(targetSize))
+		if errors.Is(err, qcow2.ErrUnsupported) {
+			// Layout of the image is not supported by the in-process writer.
+			err = resizeWithQemuImg(imagePath, targetSize)
+		}
+	case image.RAW:
+		err = os.Truncate(imagePath, int64(targetSize))
+	default:
+		err = resizeWithQemuImg(imagePath, targetSize)
+	}
 	if err != nil {
-		fmt.Printf("Resizing %s to new size %db failed in qemu-img\n", imagePath, targetSize)
+		fmt.Printf("Resizing %s to new size %db failed\n", imagePath, targetSize)
 		return err
 	}
 
 	return nil
 }
 
-func SetPartition(image string, partition int, start uint64, size uint64) error {
-	partition = 0x1be + ((partition - 1) * 0x10)
+func resizeWithQemuImg(imagePath string, targetSize uint64) error {
+	_, err := exec.Command("qemu-img", "resize", imagePath, fmt.Sprintf("%db", targetSize)).Output()
+	return err
+}
+
+// GCE requires the size of the disk.raw file to be a multiple of 1GB.
+var gceDiskSizeAlignment int64 = 1 << 30
 
-	cyl, head, sec := chs(start / 512)
-	cyl_end, head_end, sec_end := chs((start + size) / 512)
+// ExportImage writes the QCOW2 or raw image at srcPath to dstPath in the given
+// format. VMDK and VDI images are produced using qemu-img. GCE tarball is a
+// gzipped tar archive containing the raw disk named disk.raw.
+func ExportImage(srcPath string, dstPath string, format image.ImageFormat) error {
+	switch format {
+	case image.RAW:
+		return exportRawImage(srcPath, dstPath)
+	case image.GCE_TARBALL:
+		return exportGCETarball(srcPath, dstPath)
+	case image.QCOW2:
+		srcFormat, err := image.Probe(srcPath)
+		if err != nil {
+			return err
+		}
+		if srcFormat == image.RAW {
+			return qcow2.ConvertFromRaw(srcPath, dstPath)
+		}
+		return CopyLocalFile(dstPath, srcPath)
+	case image.VMDK, image.VDI:
+		qemuFormat := "vmdk"
+		if format == image.VDI {
+			qemuFormat = "vdi"
+		}
+		out, err := exec.Command("qemu-img", "convert", "-O", qemuFormat, srcPath, dstPath).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("qemu-img failed to convert %s to %s: %s: %s", srcPath, qemuFormat, err, out)
+		}
+		return nil
+	default:
+		return fmt.Errorf("exporting images to %s format is not supported", format)
+	}
+}
 
-	nbdFile, err := NewNbdFile(image)
+func exportRawImage(srcPath string, dstPath string) error {
+	disk, err := image.OpenDisk(srcPath)
 	if err != nil {
 		return err
 	}
+	defer disk.Close()
 
-	if err := nbdFile.WriteByte(uint64(partition+1), byte(head)); err != nil {
+	out, err := os.Create(dstPath)
+	if err != nil {
 		return err
 	}
-	if err := nbdFile.WriteByte(uint64(partition+5), byte(head_end)); err != nil {
-		return err
+	defer out.Close()
+
+	// Blocks of zeros are skipped to keep the raw image sparse.
+	buf := make([]byte, 1<<20)
+	for offset := int64(0); offset < disk.Size(); offset += int64(len(buf)) {
+		n, err := disk.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if !isZero(buf[:n]) {
+			if _, err := out.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+		}
 	}
-	if err := nbdFile.WriteShort(uint64(partition+2), uint16(cyl<<6|sec)); err != nil {
+
+	if err := out.Truncate(disk.Size()); err != nil {
 		return err
 	}
-	if err := nbdFile.WriteShort(uint64(partition+6), uint16(cyl_end<<6|sec_end)); err != nil {
+	return out.Close()
+}
+
+func exportGCETarball(srcPath string, dstPath string) error {
+	disk, err := image.OpenDisk(srcPath)
+	if err != nil {
 		return err
 	}
+	defer disk.Close()
 
-	systemId := 0x83
-	if err := nbdFile.WriteByte(uint64(partition+4), byte(systemId)); err != nil {
+	out, err := os.Create(dstPath)
+	if err != nil {
 		return err
 	}
+	defer out.Close()
 
-	if err := nbdFile.WriteInt(uint64(partition+8), uint32(start/512)); err != nil {
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	size := (disk.Size() + gceDiskSizeAlignment - 1) / gceDiskSizeAlignment * gceDiskSizeAlignment
+	header := &tar.Header{
+		Name:     "disk.raw",
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatGNU,
+	}
+	if err := tw.WriteHeader(header); err != nil {
 		return err
 	}
-	if err := nbdFile.WriteInt(uint64(partition+12), uint32(size/512)); err != nil {
+
+	// Disk content is followed by zeros up to the aligned size.
+	content := io.MultiReader(io.NewSectionReader(disk, 0, disk.Size()), &zeroReader{size - disk.Size()})
+	if _, err := io.Copy(tw, content); err != nil {
 		return err
 	}
 
-	if err := nbdFile.Close(); err != nil {
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
 		return err
 	}
+	return out.Close()
+}
 
-	return nil
+// zeroReader reads the given number of zero bytes.
+type zeroReader struct {
+	remaining int64
 }
 
-func SetCmdLine(imagePath string, cmdLine string) error {
-	nbdFile, err := NewNbdFile(imagePath)
-	if err != nil {
+func (z *zeroReader) Read(p []byte) (int, error) {
+	if z.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > z.remaining {
+		p = p[:z.remaining]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	z.remaining -= int64(len(p))
+	return len(p), nil
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func SetPartition(image string, partition int, start uint64, size uint64) error {
+	entry := mbr.NewPartition(start, size, mbr.LINUX_SYSTEM_ID)
+
+	// The status (boot indicator) of the partition is left intact.
+	return updateImage(image, func(f io.WriterAt) error {
+		_, err := f.WriteAt(entry.Bytes()[1:], mbr.PartitionOffset(partition)+1)
 		return err
+	})
+}
+
+// SetCmdLine stores the boot command line into the image. The command line
+// has to fit, including the terminating NUL, into the sectors between the boot
+// sector and the loader.
+func SetCmdLine(imagePath string, cmdLine string) error {
+	if len(cmdLine) >= image.CMDLINE_MAX_SIZE {
+		return fmt.Errorf("command line is %d bytes long, but at most %d bytes fit into the image",
+			len(cmdLine), image.CMDLINE_MAX_SIZE-1)
 	}
 
 	padding := 512 - (len(cmdLine) % 512)
 
 	data := append([]byte(cmdLine), make([]byte, padding)...)
 
-	if err := nbdFile.Write(512, data); err != nil {
+	return updateImage(imagePath, func(f io.WriterAt) error {
+		_, err := f.WriteAt(data, 512)
 		return err
-	}
+	})
+}
 
-	if err := nbdFile.Close(); err != nil {
-		return err
+// GetCmdLine reads the boot command line stored in the image.
+func GetCmdLine(imagePath string) (string, error) {
+	disk, err := image.OpenDisk(imagePath)
+	if err != nil {
+		return "", err
 	}
+	defer disk.Close()
 
-	return nil
+	return image.ReadCmdLine(disk)
 }
 
-func chs(x uint64) (uint64, uint64, uint64) {
-	sectorsPerTrack := uint64(63)
-	heads := uint64(255)
+type imageWriter interface {
+	io.WriterAt
+	io.Closer
+}
+
+func openImageForUpdate(imagePath string) (imageWriter, error) {
+	format, err := image.Probe(imagePath)
+	if err != nil {
+		return nil, err
+	}
 
-	c := (x / sectorsPerTrack) / heads
-	h := (x / sectorsPerTrack) % heads
-	s := (x % sectorsPerTrack) + 1
+	switch format {
+	case image.RAW:
+		return os.OpenFile(imagePath, os.O_RDWR, 0)
+	case image.QCOW2:
+		return qcow2.OpenForUpdate(imagePath)
+	default:
+		return NewNbdFile(imagePath)
+	}
+}
 
-	if c > 1023 {
-		c = 1023
-		h = 254
-		s = 63
+// updateImage applies update to the virtual disk of the image. Raw and QCOW2
+// images are modified directly. Other formats, as well as QCOW2 images with
+// layout the in-process writer cannot handle, are modified through qemu-nbd.
+func updateImage(imagePath string, update func(f io.WriterAt) error) error {
+	f, err := openImageForUpdate(imagePath)
+	if err == nil {
+		err = update(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if !errors.Is(err, qcow2.ErrUnsupported) {
+		return err
+	}
+
+	nbdFile, err := NewNbdFile(imagePath)
+	if err != nil {
+		return err
+	}
+	if err := update(nbdFile); err != nil {
+		nbdFile.Close()
+		return err
 	}
 
-	return c, h, s
+	return nbdFile.Close()
 }
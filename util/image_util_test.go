@@ -0,0 +1,210 @@
+/*
+ * Copyright (C) 2026 agent.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudius-systems/capstan/image"
+	"github.com/cloudius-systems/capstan/image/mbr"
+	"github.com/cloudius-systems/capstan/image/qcow2"
+	. "gopkg.in/check.v1"
+)
+
+type imageUtilSuite struct{}
+
+var _ = Suite(&imageUtilSuite{})
+
+func (*imageUtilSuite) TestSetPartitionRaw(c *C) {
+	imagePath := filepath.Join(c.MkDir(), "disk.raw")
+	c.Assert(ioutil.WriteFile(imagePath, make([]byte, 4<<20), 0644), IsNil)
+
+	// This is what we're testing here.
+	err := SetPartition(imagePath, 2, 2<<20, 1<<20)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	f, err := os.Open(imagePath)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	partitions, err := mbr.ReadPartitions(f)
+	c.Assert(err, IsNil)
+	c.Check(partitions[0].IsEmpty(), Equals, true)
+	c.Check(partitions[1].SystemId, Equals, uint8(0x83))
+	c.Check(partitions[1].Start(), Equals, int64(2<<20))
+	c.Check(partitions[1].Size(), Equals, int64(1<<20))
+	c.Check(partitions[1].FirstCHS, Equals, [3]byte{65, 2, 0})
+	info, err := f.Stat()
+	c.Assert(err, IsNil)
+	c.Check(info.Size(), Equals, int64(4<<20))
+}
+
+func (*imageUtilSuite) TestSetCmdLineRaw(c *C) {
+	imagePath := filepath.Join(c.MkDir(), "disk.raw")
+	disk := make([]byte, 4096)
+	for i := range disk {
+		disk[i] = 0xff
+	}
+	c.Assert(ioutil.WriteFile(imagePath, disk, 0644), IsNil)
+
+	// This is what we're testing here.
+	err := SetCmdLine(imagePath, "/hello.so")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(imagePath)
+	c.Assert(err, IsNil)
+	c.Check(string(data[512:521]), Equals, "/hello.so")
+	c.Check(data[521:1024], DeepEquals, make([]byte, 503))
+	c.Check(data[511], Equals, byte(0xff))
+	c.Check(data[1024], Equals, byte(0xff))
+}
+
+func (*imageUtilSuite) TestSetCmdLineTooLong(c *C) {
+	imagePath := filepath.Join(c.MkDir(), "disk.raw")
+	c.Assert(ioutil.WriteFile(imagePath, make([]byte, 64<<10), 0644), IsNil)
+
+	// This is what we're testing here.
+	err := SetCmdLine(imagePath, strings.Repeat("x", 63*512))
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "command line is 32256 bytes long, but at most 32255 bytes fit into the image")
+	data, err := ioutil.ReadFile(imagePath)
+	c.Assert(err, IsNil)
+	c.Check(data, DeepEquals, make([]byte, 64<<10))
+}
+
+func (*imageUtilSuite) TestGetCmdLine(c *C) {
+	m := []struct {
+		comment string
+		cmdLine string
+	}{
+		{"simple", "/hello.so"},
+		{"empty", ""},
+		{"whole sector", strings.Repeat("x", 512)},
+		{"longest", strings.Repeat("x", 63*512-1)},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		imagePath := filepath.Join(c.MkDir(), "disk.raw")
+		c.Assert(ioutil.WriteFile(imagePath, make([]byte, 64<<10), 0644), IsNil)
+		c.Assert(SetCmdLine(imagePath, args.cmdLine), IsNil)
+
+		// This is what we're testing here.
+		cmdLine, err := GetCmdLine(imagePath)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(cmdLine, Equals, args.cmdLine)
+	}
+}
+
+// prepareQcow2Image creates a QCOW2 image with some data at the beginning and
+// at the end of the disk and returns the path along with the raw disk content.
+func prepareQcow2Image(c *C) (string, []byte) {
+	tmp := c.MkDir()
+	disk := make([]byte, 3<<20)
+	copy(disk, "beginning")
+	copy(disk[len(disk)-3:], "end")
+	rawPath := filepath.Join(tmp, "disk.raw")
+	c.Assert(ioutil.WriteFile(rawPath, disk, 0644), IsNil)
+	imagePath := filepath.Join(tmp, "disk.qcow2")
+	c.Assert(qcow2.ConvertFromRaw(rawPath, imagePath), IsNil)
+	return imagePath, disk
+}
+
+func (*imageUtilSuite) TestExportImageRaw(c *C) {
+	imagePath, disk := prepareQcow2Image(c)
+	rawPath := filepath.Join(c.MkDir(), "exported.raw")
+
+	// This is what we're testing here.
+	err := ExportImage(imagePath, rawPath, image.RAW)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(rawPath)
+	c.Assert(err, IsNil)
+	c.Check(data, DeepEquals, disk)
+}
+
+func (*imageUtilSuite) TestExportImageGCETarball(c *C) {
+	defer func(alignment int64) { gceDiskSizeAlignment = alignment }(gceDiskSizeAlignment)
+	gceDiskSizeAlignment = 2 << 20
+	imagePath, disk := prepareQcow2Image(c)
+	tarballPath := filepath.Join(c.MkDir(), "exported.tar.gz")
+
+	// This is what we're testing here.
+	err := ExportImage(imagePath, tarballPath, image.GCE_TARBALL)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	format, err := image.Probe(tarballPath)
+	c.Assert(err, IsNil)
+	c.Check(format, Equals, image.GCE_TARBALL)
+
+	f, err := os.Open(tarballPath)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	c.Assert(err, IsNil)
+	tr := tar.NewReader(gz)
+	header, err := tr.Next()
+	c.Assert(err, IsNil)
+	c.Check(header.Name, Equals, "disk.raw")
+	c.Check(header.Size, Equals, int64(4<<20))
+	data, err := ioutil.ReadAll(tr)
+	c.Assert(err, IsNil)
+	c.Check(data[:len(disk)], DeepEquals, disk)
+	c.Check(data[len(disk):], DeepEquals, make([]byte, (4<<20)-len(disk)))
+	_, err = tr.Next()
+	c.Check(err, NotNil)
+}
+
+func (*imageUtilSuite) TestExportImageUnsupportedFormat(c *C) {
+	imagePath, _ := prepareQcow2Image(c)
+
+	// This is what we're testing here.
+	err := ExportImage(imagePath, filepath.Join(c.MkDir(), "image"), image.GCE_GS)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "exporting images to GCE image format is not supported")
+}
+
+func (*imageUtilSuite) TestResizeImageFallsBackToQemuImg(c *C) {
+	// Prepare.
+	tmp := c.MkDir()
+	imagePath := filepath.Join(tmp, "disk.qcow2")
+	c.Assert(qcow2.Create(imagePath, 1<<20, ""), IsNil)
+	// Dirty images are not supported by the in-process writer.
+	f, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+	c.Assert(err, IsNil)
+	_, err = f.WriteAt([]byte{0, 0, 0, 0, 0, 0, 0, 1}, 72)
+	f.Close()
+	c.Assert(err, IsNil)
+	// Replace qemu-img with a script recording its arguments.
+	argsPath := filepath.Join(tmp, "args")
+	script := "#!/bin/sh\necho \"$@\" > " + argsPath + "\n"
+	c.Assert(ioutil.WriteFile(filepath.Join(tmp, "qemu-img"), []byte(script), 0755), IsNil)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// This is what we're testing here.
+	err = ResizeImage(imagePath, 2<<20)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	args, err := ioutil.ReadFile(argsPath)
+	c.Assert(err, IsNil)
+	c.Check(string(args), Equals, "resize "+imagePath+" 2097152b\n")
+}
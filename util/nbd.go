@@ -13,6 +13,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
@@ -41,6 +42,8 @@ const (
 type NbdFile struct {
 	Cmd     *exec.Cmd
 	Session *NbdSession
+	// Private directory holding the socket qemu-nbd listens on.
+	socketDir string
 }
 
 type NbdSession struct {
@@ -65,8 +68,29 @@ type NbdReply struct {
 	Handle uint64
 }
 
+// NewNbdFile exports the image with qemu-nbd and connects to it. Each export
+// listens on its own endpoint, so several images can be modified at once.
 func NewNbdFile(imagePath string) (*NbdFile, error) {
-	cmd := exec.Command("qemu-nbd", "-p", "10809", imagePath)
+	socketDir, err := ioutil.TempDir("", "capstan-nbd")
+	if err != nil {
+		return nil, err
+	}
+	args, network, address, err := nbdEndpoint(socketDir)
+	if err != nil {
+		os.RemoveAll(socketDir)
+		return nil, err
+	}
+	file, err := startNbd(append(args, imagePath), network, address)
+	if err != nil {
+		os.RemoveAll(socketDir)
+		return nil, err
+	}
+	file.socketDir = socketDir
+	return file, nil
+}
+
+func startNbd(args []string, network, address string) (*NbdFile, error) {
+	cmd := exec.Command("qemu-nbd", args...)
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -83,8 +107,9 @@ func NewNbdFile(imagePath string) (*NbdFile, error) {
 	go io.Copy(os.Stdout, stdout)
 	go io.Copy(os.Stderr, stderr)
 
-	conn, err := ConnectAndWait("tcp", "localhost:10809")
+	conn, err := ConnectAndWait(network, address)
 	if err != nil {
+		cmd.Process.Kill()
 		return nil, err
 	}
 
@@ -94,10 +119,12 @@ func NewNbdFile(imagePath string) (*NbdFile, error) {
 	}
 
 	if err := session.Handshake(); err != nil {
+		conn.Close()
+		cmd.Process.Kill()
 		return nil, err
 	}
 
-	return &NbdFile{cmd, session}, nil
+	return &NbdFile{Cmd: cmd, Session: session}, nil
 }
 
 func (file *NbdFile) Write(offset uint64, data []byte) error {
@@ -122,6 +149,14 @@ func (file *NbdFile) Write(offset uint64, data []byte) error {
 	return file.Session.Flush()
 }
 
+// WriteAt allows NbdFile to be used as io.WriterAt.
+func (file *NbdFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := file.Write(uint64(off), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
 func (file *NbdFile) WriteByte(offset uint64, b byte) error {
 	buf := bytes.Buffer{}
 
@@ -168,6 +203,7 @@ func (file *NbdFile) Close() error {
 	}
 	file.Session.Conn.Close()
 	file.Wait()
+	os.RemoveAll(file.socketDir)
 
 	return nil
 }
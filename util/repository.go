@@ -19,12 +19,14 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cloudius-systems/capstan/core"
 	"github.com/cloudius-systems/capstan/image"
+	"github.com/cloudius-systems/capstan/image/qcow2"
 	"gopkg.in/yaml.v2"
 )
 
@@ -122,6 +124,11 @@ type ImageInfo struct {
 	Created       string
 	Description   string
 	Build         string
+	Binary        map[string]string `yaml:"binary,omitempty"`
+	// Base is the name of the image this image is an overlay of.
+	Base string `yaml:"base,omitempty"`
+	// Packages lists the packages composed into a base image.
+	Packages []string `yaml:"packages,omitempty"`
 }
 
 func (r *Repo) PrintRepo() {
@@ -184,6 +191,47 @@ func (r *Repo) ImportImage(imageName string, file string, version string, create
 	return nil
 }
 
+// ImageIndexPath returns path of the index.yaml file describing the image.
+func (r *Repo) ImageIndexPath(image string) string {
+	return filepath.Join(r.RepoPath(), image, "index.yaml")
+}
+
+// ImageSizeReportPath returns path of the size report of the image, which is
+// stored next to its index.yaml.
+func (r *Repo) ImageSizeReportPath(image string) string {
+	return filepath.Join(r.RepoPath(), image, "size.yaml")
+}
+
+// ReadImageInfo parses index.yaml of the image with given name.
+func (r *Repo) ReadImageInfo(image string) (*ImageInfo, error) {
+	return ReadImageInfoFile(r.ImageIndexPath(image))
+}
+
+// ReadImageInfoFile parses index.yaml at the given path.
+func ReadImageInfoFile(indexPath string) (*ImageInfo, error) {
+	data, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	info := ImageInfo{}
+	if err := yaml.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// WriteImageInfo stores index.yaml of the image with given name.
+func (r *Repo) WriteImageInfo(image string, info *ImageInfo) error {
+	value, err := yaml.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(r.ImageIndexPath(image), value, 0644)
+}
+
 func (r *Repo) ImageExists(hypervisor, image string) bool {
 	file := r.ImagePath(hypervisor, image)
 	if _, err := os.Stat(file); os.IsNotExist(err) {
@@ -211,11 +259,87 @@ func (r *Repo) RemoveImage(image string) error {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return errors.New(fmt.Sprintf("%s: no such image\n", image))
 	}
+	if err := r.CheckNoDependents(image); err != nil {
+		return err
+	}
 	fmt.Printf("Removing %s...\n", image)
 	err := os.RemoveAll(path)
 	return err
 }
 
+// ImageDependents returns names of the images that are overlays of the given
+// image, i.e. use it as their backing file.
+func (r *Repo) ImageDependents(image string) []string {
+	var dependents []string
+	namespaces, _ := ioutil.ReadDir(r.RepoPath())
+	for _, n := range namespaces {
+		if !n.IsDir() {
+			continue
+		}
+		names := []string{n.Name()}
+		if _, err := os.Stat(r.ImageIndexPath(n.Name())); os.IsNotExist(err) {
+			names = nil
+			images, _ := ioutil.ReadDir(filepath.Join(r.RepoPath(), n.Name()))
+			for _, i := range images {
+				if i.IsDir() {
+					names = append(names, path.Join(n.Name(), i.Name()))
+				}
+			}
+		}
+
+		for _, name := range names {
+			info, err := r.ReadImageInfo(name)
+			if err != nil {
+				continue
+			}
+			if info.Base == image {
+				dependents = append(dependents, name)
+			}
+		}
+	}
+
+	sort.Strings(dependents)
+	return dependents
+}
+
+// CheckNoDependents fails if other images use the given image as their base,
+// since removing or modifying it would corrupt them.
+func (r *Repo) CheckNoDependents(image string) error {
+	if dependents := r.ImageDependents(image); len(dependents) > 0 {
+		return fmt.Errorf("%s: image is the base of %s, remove them first", image, strings.Join(dependents, ", "))
+	}
+	return nil
+}
+
+// CreateOverlayImage creates a QCOW2 image that only stores changes relative
+// to the given base image. The base image is referred to by its absolute path.
+func (r *Repo) CreateOverlayImage(baseName string, imageName string) error {
+	basePath, err := filepath.Abs(r.ImagePath("qemu", baseName))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(basePath); os.IsNotExist(err) {
+		return fmt.Errorf("%s: no such base image", baseName)
+	}
+
+	imagePath := r.ImagePath("qemu", imageName)
+	if err := os.MkdirAll(filepath.Dir(imagePath), 0775); err != nil {
+		return err
+	}
+	fmt.Printf("Creating overlay %s of base image %s\n", imageName, baseName)
+	os.Remove(imagePath)
+	if err := qcow2.Create(imagePath, 0, basePath); err != nil {
+		return err
+	}
+
+	info := ImageInfo{
+		FormatVersion: "1",
+		Created:       time.Now().Format(core.FRIENDLY_TIME_F),
+		Base:          baseName,
+	}
+	return r.WriteImageInfo(imageName, &info)
+}
+
 func (r *Repo) RepoPath() string {
 	return filepath.Join(r.Path, "repository")
 }
@@ -232,6 +356,14 @@ func (r *Repo) ImageCachePath(hypervisor string, image string) string {
 	return filepath.Join(r.RepoPath(), image, fmt.Sprintf("%s.%s.cache", filepath.Base(image), hypervisor))
 }
 
+// ImageRofsCachePath returns path of the hash cache of the files in the ROFS
+// partition of the image. It is separate from the cache of ZFS images, so
+// that composing the image with either filesystem does not invalidate the
+// data kept for the other.
+func (r *Repo) ImageRofsCachePath(hypervisor string, image string) string {
+	return filepath.Join(r.RepoPath(), image, fmt.Sprintf("%s.%s.rofs.cache", filepath.Base(image), hypervisor))
+}
+
 func (r *Repo) PackagePath(packageName string) string {
 	return filepath.Join(r.Path, "packages", fmt.Sprintf("%s.mpm", packageName))
 }
@@ -336,6 +468,38 @@ func (r *Repo) getLoaderImageInfo(loaderImage string) (string, os.FileInfo, erro
 	return loaderImagePath, loaderInfo, err
 }
 
+// UserPartitionStart returns the offset of the user partition (ZFS or ROFS)
+// in images based on the given loader image. The partition starts at the
+// first 2MB boundary after the loader.
+func (r *Repo) UserPartitionStart(loaderImage string) (int64, error) {
+	_, loaderInfo, err := r.getLoaderImageInfo(loaderImage)
+	if err != nil {
+		return 0, err
+	}
+	return (loaderInfo.Size() + 2097151) & ^2097151, nil
+}
+
+// EstimateZfsPartitionSize returns the size of the ZFS partition (in bytes)
+// that is able to hold files of the given total size and the given number of
+// filesystem entries. Besides the data, the estimate accounts for per-entry
+// metadata, the ZFS labels and metaslab structures (fixed overhead) and the
+// space ZFS reserves and refuses to allocate (1/32 of the pool).
+func EstimateZfsPartitionSize(contentSize int64, entries int) int64 {
+	const (
+		blockSize     = 4096
+		entryOverhead = 2048
+		fixedOverhead = 32 << 20
+	)
+
+	// Data is allocated in whole blocks and ZFS keeps metadata about the
+	// allocated blocks as well (indirect blocks, block pointers).
+	dataSize := (contentSize+blockSize-1)/blockSize*blockSize + int64(entries)*(blockSize+entryOverhead)
+	dataSize += dataSize / 16
+
+	size := dataSize + fixedOverhead
+	return size + size/31
+}
+
 func (r *Repo) GetZfsBuilderImagePath() (string, error) {
 	//
 	// Get the actual path of the image.
@@ -552,19 +716,28 @@ func (r *Repo) GetPackage(pkgname string) (io.ReadSeeker, error) {
 
 // GetPackageTarReader returns tar reader for package with given name.
 func (r *Repo) GetPackageTarReader(pkgname string) (*tar.Reader, error) {
-	reader, err := r.GetPackage(pkgname)
+	reader, _, err := r.OpenPackageArchive(pkgname)
+	return reader, err
+}
+
+// OpenPackageArchive returns tar reader for package with given name along
+// with the closer of the underlying package file.
+func (r *Repo) OpenPackageArchive(pkgname string) (*tar.Reader, io.Closer, error) {
+	pkgpath := r.PackagePath(pkgname)
+	file, err := os.Open(pkgpath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Load package (tar.gz or tar supported).
-	if gzReader, err := gzip.NewReader(reader); err == nil {
-		return tar.NewReader(gzReader), nil
+	if gzReader, err := gzip.NewReader(file); err == nil {
+		return tar.NewReader(gzReader), file, nil
 	} else if err == gzip.ErrHeader {
-		reader.Seek(0, io.SeekStart) // revert offset that gzReader has corrupted
-		return tar.NewReader(reader), nil
+		file.Seek(0, io.SeekStart) // revert offset that gzReader has corrupted
+		return tar.NewReader(file), file, nil
 	} else {
-		return nil, err
+		file.Close()
+		return nil, nil, err
 	}
 }
 
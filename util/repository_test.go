@@ -10,9 +10,12 @@ package util_test
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 
 	"github.com/cloudius-systems/capstan/cmd"
+	"github.com/cloudius-systems/capstan/image/qcow2"
 	"github.com/cloudius-systems/capstan/util"
 
 	. "github.com/cloudius-systems/capstan/testing"
@@ -35,6 +38,96 @@ func (s *suite) TestImagePath(c *C) {
 	c.Assert(path, Equals, filepath.Join(s.repo.Path, "repository", "valid", "valid.qemu"))
 }
 
+func (s *suite) TestUserPartitionStart(c *C) {
+	loaderPath := s.repo.ImagePath("qemu", "osv-loader")
+	c.Assert(os.MkdirAll(filepath.Dir(loaderPath), 0775), IsNil)
+	c.Assert(ioutil.WriteFile(loaderPath, make([]byte, 3<<20), 0644), IsNil)
+
+	// This is what we're testing here.
+	start, err := s.repo.UserPartitionStart("osv-loader")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(start, Equals, int64(4<<20))
+}
+
+func (s *suite) TestEstimateZfsPartitionSize(c *C) {
+	empty := util.EstimateZfsPartitionSize(0, 0)
+	small := util.EstimateZfsPartitionSize(1<<20, 10)
+	large := util.EstimateZfsPartitionSize(1<<30, 10)
+	manyFiles := util.EstimateZfsPartitionSize(1<<20, 10000)
+
+	c.Check(empty >= 32<<20, Equals, true)
+	c.Check(small > empty, Equals, true)
+	c.Check(large > 1<<30+(1<<30)/32, Equals, true)
+	c.Check(large < 1<<30+(1<<30)/4, Equals, true)
+	c.Check(manyFiles > small+10000*4096, Equals, true)
+}
+
+func (s *suite) TestImageDependents(c *C) {
+	PrepareFiles(s.repo.Path, map[string]string{
+		"/repository/base/index.yaml":           "packages:\n- osv.bootstrap\n",
+		"/repository/app/index.yaml":            "base: base\n",
+		"/repository/mike/other/index.yaml":     "base: base\n",
+		"/repository/mike/unrelated/index.yaml": "format_version: \"1\"\n",
+		"/repository/mike/nested/index.yaml":    "base: app\n",
+	})
+
+	// This is what we're testing here.
+	dependents := s.repo.ImageDependents("base")
+
+	// Expectations.
+	c.Check(dependents, DeepEquals, []string{"app", "mike/other"})
+	c.Check(s.repo.ImageDependents("mike/unrelated"), HasLen, 0)
+}
+
+func (s *suite) TestRemoveImageWithDependents(c *C) {
+	PrepareFiles(s.repo.Path, map[string]string{
+		"/repository/base/index.yaml": "format_version: \"1\"\n",
+		"/repository/app/index.yaml":  "base: base\n",
+	})
+
+	// This is what we're testing here.
+	err := s.repo.RemoveImage("base")
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "base: image is the base of app, remove them first")
+	c.Check(filepath.Join(s.repo.RepoPath(), "base"), DirEquals, map[string]interface{}{
+		"index.yaml": "format_version: \"1\"\n",
+	})
+	c.Assert(s.repo.RemoveImage("app"), IsNil)
+	c.Check(s.repo.RemoveImage("base"), IsNil)
+}
+
+func (s *suite) TestCreateOverlayImage(c *C) {
+	basePath := s.repo.ImagePath("qemu", "base")
+	c.Assert(os.MkdirAll(filepath.Dir(basePath), 0775), IsNil)
+	c.Assert(qcow2.Create(basePath, 64<<20, ""), IsNil)
+
+	// This is what we're testing here.
+	err := s.repo.CreateOverlayImage("base", "mike/app")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	img, err := qcow2.Open(s.repo.ImagePath("qemu", "mike/app"))
+	c.Assert(err, IsNil)
+	defer img.Close()
+	c.Check(img.BackingFile, Equals, basePath)
+	c.Check(img.Size(), Equals, int64(64<<20))
+	info, err := s.repo.ReadImageInfo("mike/app")
+	c.Assert(err, IsNil)
+	c.Check(info.Base, Equals, "base")
+	c.Check(s.repo.ImageDependents("base"), DeepEquals, []string{"mike/app"})
+}
+
+func (s *suite) TestCreateOverlayImageMissingBase(c *C) {
+	// This is what we're testing here.
+	err := s.repo.CreateOverlayImage("base", "app")
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "base: no such base image")
+}
+
 func (s *suite) TestPackagePath(c *C) {
 	path := s.repo.PackagePath("package")
 	c.Assert(path, Equals, filepath.Join(s.repo.Path, "packages", "package.mpm"))
@@ -7,7 +7,8 @@
  * This code implements the machanics of creating a ROFS file system
  * as described by comments in this Python code -
  * https://raw.githubusercontent.com/cloudius-systems/osv/master/scripts/gen-rofs-img.py.
- * The main public function used by upstream code is WriteRofsImage().
+ * The main public functions used by upstream code are WriteRofsImage() and
+ * WriteRofsTree().
  */
 
 package util
@@ -17,54 +18,41 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"path/filepath"
-	"sort"
+	"path"
 	"strings"
+
+	"github.com/cloudius-systems/capstan/image"
+	"github.com/cloudius-systems/capstan/image/rofs"
 )
 
 const (
-	BLOCK_SIZE = 512
+	BLOCK_SIZE = rofs.BLOCK_SIZE
+	ROFS_MAGIC = rofs.MAGIC
 
-	DIR_MODE  = 0x4000
-	REG_MODE  = 0x8000
-	LINK_MODE = 0xA000
+	DIR_MODE  = rofs.DIR_MODE
+	REG_MODE  = rofs.REG_MODE
+	LINK_MODE = rofs.LINK_MODE
 )
 
-type RofsSuperBlock struct {
-	Magic                    uint64
-	Version                  uint64
-	BlockSize                uint64
-	StructureInfoFirstBlock  uint64
-	StructureInfoBlocksCount uint64
-	DirectoryEntriesCount    uint64
-	SymlinksCount            uint64
-	InodesCount              uint64
-}
-
-type RofsDirectoryEntry struct {
-	InodeNumber uint64
-	Filename    string
-}
-
-type RofsSymlink struct {
-	Filename string
-}
-
-type RofsInode struct {
-	Mode        uint64
-	InodeNumber uint64
-	DataOffset  uint64
-	Count       uint64 // either file size in bytes or children count
-}
+// The on-disk structures are shared with the ROFS reader.
+type RofsSuperBlock = rofs.SuperBlock
+type RofsDirectoryEntry = rofs.DirectoryEntry
+type RofsSymlink = rofs.Symlink
+type RofsInode = rofs.Inode
 
 type RofsFilesystem struct {
-	SuperBlock             RofsSuperBlock
-	DirectoryEntries       []*RofsDirectoryEntry
-	Symlinks               []*RofsSymlink
-	Inodes                 []*RofsInode
-	DirectoryEntriesByPath map[string][]string
-	CurrentBlock           int
+	SuperBlock       RofsSuperBlock
+	DirectoryEntries []*RofsDirectoryEntry
+	Symlinks         []*RofsSymlink
+	Inodes           []*RofsInode
+	CurrentBlock     int
+	// ReusableInodes maps target paths of unchanged files to their inodes in
+	// the previous image. Data of these files is not written again.
+	ReusableInodes map[string]*RofsInode
+	// linkedInodes maps hard linked files to their shared inode.
+	linkedInodes map[*FileNode]*RofsInode
 }
 
 func pad(buf *bytes.Buffer, count int) error {
@@ -95,22 +83,7 @@ func writeSuperBlock(imageFile *os.File, superBlock *RofsSuperBlock) error {
 }
 
 func ReadRofsSuperBlock(imageFile *os.File) (*RofsSuperBlock, error) {
-	if _, err := imageFile.Seek(0, 0); err != nil {
-		return nil, err
-	}
-
-	bytesArray := make([]byte, BLOCK_SIZE)
-	if _, err := imageFile.Read(bytesArray); err != nil {
-		return nil, err
-	}
-
-	superBlock := RofsSuperBlock{}
-	buffer := bytes.NewBuffer(bytesArray)
-	if err := binary.Read(buffer, binary.LittleEndian, &superBlock); err != nil {
-		return nil, err
-	}
-
-	return &superBlock, nil
+	return rofs.ReadSuperBlock(imageFile)
 }
 
 func writeString(buffer *bytes.Buffer, str string) error {
@@ -155,25 +128,23 @@ func writeInode(imageFile *os.File, inode *RofsInode) (int, error) {
 	return imageFile.Write(buf.Bytes())
 }
 
-func writeFile(filesystem *RofsFilesystem, imageFile *os.File, sourceFilePath string) (int, error) {
-	sourceFile, err := os.Open(sourceFilePath)
-	if err != nil {
-		return 0, err
-	}
-	defer sourceFile.Close()
-
+func writeFile(filesystem *RofsFilesystem, imageFile io.Writer, data io.Reader) (int, error) {
 	buffer := make([]byte, BLOCK_SIZE)
 	totalCount := 0
 	for {
-		count, readError := sourceFile.Read(buffer)
+		count, readError := io.ReadFull(data, buffer)
+		if readError == io.ErrUnexpectedEOF {
+			// The partial block is written as is, EOF is reported next time
+			readError = nil
+		}
 		if readError != nil && readError != io.EOF {
 			return 0, readError
 		}
 		totalCount += count
 		filesystem.CurrentBlock += 1
 		//
-		// Pad last block with 0 if EOF
-		if readError == io.EOF {
+		// Pad last block with 0
+		if count < BLOCK_SIZE {
 			for ; count < BLOCK_SIZE; count++ {
 				buffer[count] = 0
 			}
@@ -186,18 +157,97 @@ func writeFile(filesystem *RofsFilesystem, imageFile *os.File, sourceFilePath st
 			break
 		}
 	}
-	err = imageFile.Sync()
-	return totalCount, err
+	return totalCount, nil
 }
 
-func writeDirectory(filesystem *RofsFilesystem, imageFile *os.File, paths map[string]string,
-	sourceDirectoryPath string, verbose bool) (int, int, error) {
+// writeData writes the data of all regular files of the tree except the
+// reusable ones and returns the inodes (holding just the data offset and
+// size) of the written files. Data is written in the order it is streamed
+// from the sources of the tree, which is unrelated to the order of inodes.
+// Files with identical content share the same data blocks. Only files of the
+// same size can be identical, so those are hashed in a first pass and the
+// data of each content is written just once.
+func writeData(filesystem *RofsFilesystem, imageFile io.Writer, tree *FileTree, verbose bool) (map[*FileNode]*RofsInode, error) {
+	written := make(map[*FileNode]*RofsInode)
+	byHash := make(map[string]*RofsInode)
+	sharedFiles, savedBytes := 0, 0
+	needsWriting := func(node *FileNode) bool {
+		_, ok := filesystem.ReusableInodes[node.Path]
+		return !ok
+	}
 
-	directoryEntries := filesystem.DirectoryEntriesByPath[sourceDirectoryPath]
-	sort.Strings(directoryEntries)
+	// Hard links are a single file, so they are counted once.
+	sizes := make(map[int64]int)
+	tree.Walk(func(node *FileNode) error {
+		if node.IsRegular() && node.LinkOrigin() == node && needsWriting(node) {
+			sizes[node.Size]++
+		}
+		return nil
+	})
+	unhashed := func(node *FileNode) bool {
+		return needsWriting(node) && node.Hash == "" && sizes[node.Size] > 1
+	}
+	// Hash of the streamed files is recorded by StreamData itself.
+	err := tree.StreamData(unhashed, func(nodes []*FileNode, data io.Reader) error {
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tree.StreamData(needsWriting, func(nodes []*FileNode, data io.Reader) error {
+		hash := nodes[0].Hash
+		dataInode, ok := byHash[hash]
+		if ok && hash != "" {
+			if verbose {
+				fmt.Printf("Sharing data of identical file: %s\n", nodes[0].Path)
+			}
+			sharedFiles++
+			savedBytes += int(dataInode.Count)
+		} else {
+			if verbose {
+				fmt.Printf("Adding file: %s\n", nodes[0].Path)
+			}
+			offset := filesystem.CurrentBlock
+			bytesWritten, err := writeFile(filesystem, imageFile, data)
+			if err != nil {
+				return err
+			}
+			dataInode = &RofsInode{Mode: REG_MODE, DataOffset: uint64(offset), Count: uint64(bytesWritten)}
+			if hash != "" {
+				byHash[hash] = dataInode
+			}
+		}
+
+		// Hard links share the data as well.
+		sharedFiles += len(nodes) - 1
+		savedBytes += (len(nodes) - 1) * int(dataInode.Count)
+		for _, node := range nodes {
+			written[node] = dataInode
+		}
+		return nil
+	})
+
+	if verbose && sharedFiles > 0 {
+		fmt.Printf("Data of %d identical files and hard links is shared, %d bytes saved\n", sharedFiles, savedBytes)
+	}
+	return written, err
+}
+
+func writeDirectory(filesystem *RofsFilesystem, directory *FileNode, written map[*FileNode]*RofsInode,
+	verbose bool) (int, int, error) {
 
 	var thisDirectoryEntryInodes []*RofsDirectoryEntry
-	for _, directoryEntry := range directoryEntries {
+	for _, node := range directory.Children() {
+		//
+		// Hard links to the same file share a single inode
+		if linkedInode, ok := filesystem.linkedInodes[node.LinkOrigin()]; ok && node.IsRegular() {
+			thisDirectoryEntryInodes = append(thisDirectoryEntryInodes, &RofsDirectoryEntry{
+				InodeNumber: linkedInode.InodeNumber,
+				Filename:    node.Name,
+			})
+			continue
+		}
 		//
 		// Add new inode
 		newInode := RofsInode{
@@ -208,31 +258,19 @@ func writeDirectory(filesystem *RofsFilesystem, imageFile *os.File, paths map[st
 		// Add new directory entry
 		newDirectoryEntry := RofsDirectoryEntry{
 			InodeNumber: newInode.InodeNumber,
-			Filename:    directoryEntry,
+			Filename:    node.Name,
 		}
 		thisDirectoryEntryInodes = append(thisDirectoryEntryInodes, &newDirectoryEntry)
 		//
 		// Check type of entry
-		directoryEntryPath := filepath.Join(sourceDirectoryPath, directoryEntry)
-		fi, err := os.Lstat(directoryEntryPath)
-		if err != nil {
-			return 0, 0, err
-		}
-
 		switch {
-		case fi.Mode()&os.ModeSymlink == os.ModeSymlink:
-			linkTarget, _ := os.Readlink(directoryEntryPath)
+		case node.IsSymlink():
+			linkTarget := node.Link
 			if strings.HasPrefix(linkTarget, "/") || strings.HasPrefix(linkTarget, "..") {
-				srcDir := filepath.Dir(directoryEntryPath)
-
-				if linkTarget, err = filepath.Abs(filepath.Join(srcDir, linkTarget)); err != nil {
-					return 0, 0, err
-				}
-				dst := paths[directoryEntryPath]
-				linkTarget = strings.TrimPrefix(linkTarget, strings.TrimSuffix(directoryEntryPath, dst))
+				linkTarget = path.Join(path.Dir(node.Path), linkTarget)
 			}
 			if verbose {
-				fmt.Printf("Link %s to %s\n", paths[directoryEntryPath], linkTarget)
+				fmt.Printf("Link %s to %s\n", node.Path, linkTarget)
 			}
 			newInode.Mode = LINK_MODE
 			newInode.DataOffset = uint64(len(filesystem.Symlinks))
@@ -244,8 +282,8 @@ func writeDirectory(filesystem *RofsFilesystem, imageFile *os.File, paths map[st
 			}
 			filesystem.Symlinks = append(filesystem.Symlinks, &newSymlinkEntry)
 
-		case fi.Mode().IsDir():
-			entriesCount, entriesIndex, err := writeDirectory(filesystem, imageFile, paths, directoryEntryPath, verbose)
+		case node.IsDir():
+			entriesCount, entriesIndex, err := writeDirectory(filesystem, node, written, verbose)
 			if err != nil {
 				return 0, 0, err
 			}
@@ -253,17 +291,20 @@ func writeDirectory(filesystem *RofsFilesystem, imageFile *os.File, paths map[st
 			newInode.DataOffset = uint64(entriesIndex)
 			newInode.Count = uint64(entriesCount)
 
-		case fi.Mode().IsRegular():
-			if verbose {
-				fmt.Printf("Adding file: %s\n", paths[directoryEntryPath])
-			}
-			newInode.DataOffset = uint64(filesystem.CurrentBlock)
-			bytesWritten, err := writeFile(filesystem, imageFile, directoryEntryPath)
-			if err != nil {
-				return 0, 0, err
+		case node.IsRegular():
+			dataInode, ok := written[node]
+			if !ok {
+				if dataInode, ok = filesystem.ReusableInodes[node.Path]; !ok {
+					return 0, 0, fmt.Errorf("%s: data of the file has not been written", node.Path)
+				}
+				if verbose {
+					fmt.Printf("Reusing file: %s\n", node.Path)
+				}
 			}
 			newInode.Mode = REG_MODE
-			newInode.Count = uint64(bytesWritten)
+			newInode.DataOffset = dataInode.DataOffset
+			newInode.Count = dataInode.Count
+			filesystem.linkedInodes[node.LinkOrigin()] = &newInode
 		}
 	}
 	thisDirectoryEntriesIndex := len(filesystem.DirectoryEntries)
@@ -271,21 +312,25 @@ func writeDirectory(filesystem *RofsFilesystem, imageFile *os.File, paths map[st
 	return len(thisDirectoryEntryInodes), thisDirectoryEntriesIndex, nil
 }
 
-func writeFileSystem(filesystem *RofsFilesystem, imagePath string, paths map[string]string,
-	sourceRootPath string, verbose bool) error {
-
-	imageFile, err := os.Create(imagePath)
-	if err != nil {
-		return err
-	}
-	defer imageFile.Close()
-
+func writeFileSystem(filesystem *RofsFilesystem, imageFile *os.File, tree *FileTree, verbose bool) error {
 	if verbose {
 		fmt.Printf("Writing ROFS filesystem\n")
 	}
 	//
 	// Write super block
-	if err = writeSuperBlock(imageFile, &filesystem.SuperBlock); err != nil {
+	if err := writeSuperBlock(imageFile, &filesystem.SuperBlock); err != nil {
+		return err
+	}
+	//
+	// Data is appended after the blocks that are already in use
+	if _, err := imageFile.Seek(int64(filesystem.CurrentBlock)*BLOCK_SIZE, 0); err != nil {
+		return err
+	}
+	written, err := writeData(filesystem, imageFile, tree, verbose)
+	if err != nil {
+		return err
+	}
+	if err := imageFile.Sync(); err != nil {
 		return err
 	}
 	//
@@ -296,7 +341,7 @@ func writeFileSystem(filesystem *RofsFilesystem, imagePath string, paths map[str
 	}
 	filesystem.Inodes = append(filesystem.Inodes, &rootInode)
 
-	entriesCount, entriesIndex, err := writeDirectory(filesystem, imageFile, paths, sourceRootPath, verbose)
+	entriesCount, entriesIndex, err := writeDirectory(filesystem, tree.Root(), written, verbose)
 	if err != nil {
 		return err
 	}
@@ -353,32 +398,227 @@ func writeFileSystem(filesystem *RofsFilesystem, imagePath string, paths map[str
 	return writeSuperBlock(imageFile, &filesystem.SuperBlock)
 }
 
-func WriteRofsImage(imagePath string, paths map[string]string, sourceRootPath string, verbose bool) error {
+func newRofsFilesystem() *RofsFilesystem {
 	//
 	// Create main fileystem structure to keep track of all information about
 	// filesystem to be written to an image file
-	filesystem := RofsFilesystem{
+	return &RofsFilesystem{
 		SuperBlock: RofsSuperBlock{
-			Magic:     0xDEADBEAD,
+			Magic:     ROFS_MAGIC,
 			Version:   1,
 			BlockSize: BLOCK_SIZE,
 		},
-		DirectoryEntries:       []*RofsDirectoryEntry{},
-		Symlinks:               []*RofsSymlink{},
-		Inodes:                 []*RofsInode{},
-		DirectoryEntriesByPath: make(map[string][]string),
-		CurrentBlock:           1,
+		DirectoryEntries: []*RofsDirectoryEntry{},
+		Symlinks:         []*RofsSymlink{},
+		Inodes:           []*RofsInode{},
+		CurrentBlock:     1,
+		ReusableInodes:   make(map[string]*RofsInode),
+		linkedInodes:     make(map[*FileNode]*RofsInode),
+	}
+}
+
+// WriteRofsImage writes the files at the given host paths, mapped to their
+// target paths, into a new ROFS image.
+func WriteRofsImage(imagePath string, paths map[string]string, verbose bool) error {
+	tree, err := NewFileTreeFromPaths(paths)
+	if err != nil {
+		return err
+	}
+	return WriteRofsTree(imagePath, tree, verbose)
+}
+
+// WriteRofsTree writes the files of the tree into a new ROFS image. Data of
+// the files is streamed directly from their sources into the image.
+func WriteRofsTree(imagePath string, tree *FileTree, verbose bool) error {
+	imageFile, err := os.Create(imagePath)
+	if err != nil {
+		return err
+	}
+	defer imageFile.Close()
+
+	return writeFileSystem(newRofsFilesystem(), imageFile, tree, verbose)
+}
+
+// UpdateRofsImage is UpdateRofsTree for the files at the given host paths,
+// mapped to their target paths.
+func UpdateRofsImage(imagePath string, paths map[string]string, unchanged map[string]bool, verbose bool) error {
+	tree, err := NewFileTreeFromPaths(paths)
+	if err != nil {
+		return err
 	}
+	return UpdateRofsTree(imagePath, tree, unchanged, verbose)
+}
+
+// UpdateRofsTree updates an existing ROFS image in place. Data blocks of the
+// files whose target paths are marked in unchanged are reused from the existing
+// image. Data of all other files is appended after the data of the existing image
+// and the filesystem structure is written anew. Data of removed or modified files
+// stays in the image unused, so the image is written from scratch when more than
+// half of the existing data would be wasted or when the existing image is invalid.
+func UpdateRofsTree(imagePath string, tree *FileTree, unchanged map[string]bool, verbose bool) error {
+	imageFile, err := os.OpenFile(imagePath, os.O_RDWR, 0644)
+	if err != nil {
+		return WriteRofsTree(imagePath, tree, verbose)
+	}
+	defer imageFile.Close()
+
+	previous, err := rofs.Open(imageFile)
+	if err != nil {
+		if verbose {
+			fmt.Printf("Could not read existing ROFS image, writing it from scratch: %s\n", err)
+		}
+		imageFile.Close()
+		return WriteRofsTree(imagePath, tree, verbose)
+	}
+
+	filesystem := newRofsFilesystem()
+	if reused, err := reuseUnchangedData(filesystem, previous, unchanged, verbose); err != nil {
+		return err
+	} else if !reused {
+		imageFile.Close()
+		return WriteRofsTree(imagePath, tree, verbose)
+	}
+	if err := imageFile.Truncate(int64(filesystem.CurrentBlock) * BLOCK_SIZE); err != nil {
+		return err
+	}
+
+	return writeFileSystem(filesystem, imageFile, tree, verbose)
+}
+
+// UpdateRofsPartition updates the ROFS partition of the disk image in place,
+// just like UpdateRofsTree updates a ROFS image. Only the super block and the
+// blocks following the data of the existing partition are written into the
+// image, data of unchanged files is neither read nor copied. The image and its
+// partition table are resized to fit the new partition. False is returned and
+// the image is left intact if it has no valid ROFS partition or if more than
+// half of the existing data would be wasted. The image is to be composed from
+// scratch then.
+func UpdateRofsPartition(imagePath string, tree *FileTree, unchanged map[string]bool, verbose bool) (bool, error) {
+	disk, err := image.OpenDisk(imagePath)
+	if err != nil {
+		return false, err
+	}
+	number, partition, err := image.RofsPartition(disk)
+	var previous *rofs.Filesystem
+	if err == nil {
+		previous, err = rofs.Open(io.NewSectionReader(disk, partition.Start(), disk.Size()-partition.Start()))
+	}
+	diskSize := disk.Size()
+	disk.Close()
+	if err != nil {
+		if verbose {
+			fmt.Printf("Could not read ROFS partition of %s, writing it from scratch: %s\n", imagePath, err)
+		}
+		return false, nil
+	}
+
+	filesystem := newRofsFilesystem()
+	if reused, err := reuseUnchangedData(filesystem, previous, unchanged, verbose); err != nil || !reused {
+		return false, err
+	}
+
+	// The new content is written into a sparse file at the offsets it has in
+	// the partition, leaving out the data that is reused.
+	partitionFile, err := ioutil.TempFile("", "capstan-rofs")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(partitionFile.Name())
+	defer partitionFile.Close()
+
+	if err := writeFileSystem(filesystem, partitionFile, tree, verbose); err != nil {
+		return false, err
+	}
+	info, err := partitionFile.Stat()
+	if err != nil {
+		return false, err
+	}
+	partitionSize := info.Size()
+
+	start := partition.Start()
+	if start+partitionSize > diskSize {
+		if err := ResizeImage(imagePath, uint64(start+partitionSize)); err != nil {
+			return false, err
+		}
+	}
+	// Super block is written last, so that it never refers to the structure
+	// that has not been written yet.
+	dataEnd := int64(previous.SuperBlock.StructureInfoFirstBlock) * BLOCK_SIZE
+	err = updateImage(imagePath, func(f io.WriterAt) error {
+		if err := copyAt(f, start+dataEnd, io.NewSectionReader(partitionFile, dataEnd, partitionSize-dataEnd)); err != nil {
+			return err
+		}
+		return copyAt(f, start, io.NewSectionReader(partitionFile, 0, BLOCK_SIZE))
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, SetPartition(imagePath, number, uint64(start), uint64(partitionSize))
+}
+
+// reuseUnchangedData marks data of the unchanged files of the previous image
+// as reusable and sets the filesystem to continue after the previous data.
+// False is returned if more than half of the previous data would be wasted.
+func reuseUnchangedData(filesystem *RofsFilesystem, previous *rofs.Filesystem, unchanged map[string]bool,
+	verbose bool) (bool, error) {
 	//
-	// Create supporting map to allow to navigate directory entries
-	for src, dest := range paths {
-		if dest == "/" { // Skip root
-			continue
+	// Find data of unchanged files in the existing image. Data blocks might
+	// be shared by several files, so they are only counted once.
+	reusedBlocks := uint64(0)
+	reusedOffsets := make(map[uint64]bool)
+	err := previous.Walk("/", func(dest string, inode *rofs.Inode) error {
+		if inode.IsRegular() && unchanged[dest] {
+			filesystem.ReusableInodes[dest] = inode
+			if !reusedOffsets[inode.DataOffset] {
+				reusedOffsets[inode.DataOffset] = true
+				reusedBlocks += blocksOfFile(inode.Count)
+			}
 		}
-		//
-		// Break src into directory path and basename and add to the DirectoryEntriesByPath
-		directory, filename := filepath.Dir(src), filepath.Base(src)
-		filesystem.DirectoryEntriesByPath[directory] = append(filesystem.DirectoryEntriesByPath[directory], filename)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	dataBlocks := previous.SuperBlock.StructureInfoFirstBlock - 1
+	if (dataBlocks-reusedBlocks)*2 > dataBlocks {
+		if verbose {
+			fmt.Printf("Most of the existing ROFS image has changed, writing it from scratch\n")
+		}
+		return false, nil
 	}
-	return writeFileSystem(&filesystem, imagePath, paths, sourceRootPath, verbose)
+
+	if verbose {
+		fmt.Printf("Reusing %d out of %d data blocks of the existing ROFS image\n", reusedBlocks, dataBlocks)
+	}
+	// Structure of the existing image is stored after the data, so the data
+	// of changed files is written in its place.
+	filesystem.CurrentBlock = int(previous.SuperBlock.StructureInfoFirstBlock)
+	return true, nil
+}
+
+// copyAt copies all data of the reader into w at the given offset.
+func copyAt(w io.WriterAt, offset int64, r io.Reader) error {
+	buffer := make([]byte, 1024*1024)
+	for {
+		n, err := r.Read(buffer)
+		if n > 0 {
+			if _, err := w.WriteAt(buffer[:n], offset); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// blocksOfFile returns number of data blocks occupied by file of given size.
+// Note that writeFile always ends a file with a padding block.
+func blocksOfFile(size uint64) uint64 {
+	return (size+BLOCK_SIZE-1)/BLOCK_SIZE + 1
 }
@@ -9,6 +9,9 @@ package util_test
 
 import (
 	"github.com/cloudius-systems/capstan/cmd"
+	"github.com/cloudius-systems/capstan/image"
+	"github.com/cloudius-systems/capstan/image/mbr"
+	"github.com/cloudius-systems/capstan/image/rofs"
 	"github.com/cloudius-systems/capstan/util"
 	. "gopkg.in/check.v1"
 	"io"
@@ -35,7 +38,7 @@ func (*rofsSuite) TestWriteRofsImage(c *C) {
 	c.Assert(err, IsNil)
 
 	rofsImagePath := path.Join(tmp, "rofs.img")
-	err = util.WriteRofsImage(rofsImagePath, paths, tmp, true)
+	err = util.WriteRofsImage(rofsImagePath, paths, true)
 	c.Assert(err, IsNil)
 
 	rofsImage, err := os.OpenFile(rofsImagePath, os.O_RDONLY, 0644)
@@ -47,6 +50,278 @@ func (*rofsSuite) TestWriteRofsImage(c *C) {
 	c.Assert(rofsSb.InodesCount, Equals, uint64(11))
 	c.Assert(rofsSb.DirectoryEntriesCount, Equals, uint64(10))
 	c.Assert(rofsSb.SymlinksCount, Equals, uint64(1))
+	checkRofsContent(c, rofsImage, paths)
+}
+
+func (*rofsSuite) TestWriteRofsImageSharesIdenticalContent(c *C) {
+	tmp, _ := ioutil.TempDir("", "pkg")
+	defer os.RemoveAll(tmp)
+	contentDir := filepath.Join(tmp, "content")
+	content := strings.Repeat("identical", 100)
+	for _, name := range []string{"lib/a.so", "lib/b.so", "other.txt"} {
+		c.Assert(os.MkdirAll(filepath.Dir(filepath.Join(contentDir, name)), 0755), IsNil)
+		data := content
+		if name == "other.txt" {
+			data = "other"
+		}
+		c.Assert(ioutil.WriteFile(filepath.Join(contentDir, name), []byte(data), 0644), IsNil)
+	}
+	c.Assert(os.Link(filepath.Join(contentDir, "other.txt"), filepath.Join(contentDir, "hardlink.txt")), IsNil)
+
+	paths, err := cmd.CollectDirectoryContents(contentDir)
+	c.Assert(err, IsNil)
+	rofsImagePath := path.Join(tmp, "rofs.img")
+
+	// This is what we're testing here.
+	err = util.WriteRofsImage(rofsImagePath, paths, false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	rofsImage, err := os.Open(rofsImagePath)
+	c.Assert(err, IsNil)
+	defer rofsImage.Close()
+	checkRofsContent(c, rofsImage, paths)
+
+	rofsSb, err := util.ReadRofsSuperBlock(rofsImage)
+	c.Assert(err, IsNil)
+	// Superblock, identical content (3 blocks with padding) and other.txt (2 blocks).
+	c.Check(rofsSb.StructureInfoFirstBlock, Equals, uint64(6))
+	// Both hard links share an inode, so there are just 4 inodes besides the root.
+	c.Check(rofsSb.DirectoryEntriesCount, Equals, uint64(5))
+	c.Check(rofsSb.InodesCount, Equals, uint64(5))
+
+	fs, err := rofs.Open(rofsImage)
+	c.Assert(err, IsNil)
+	a, _ := fs.Stat("/lib/a.so")
+	b, _ := fs.Stat("/lib/b.so")
+	c.Check(a.DataOffset, Equals, b.DataOffset)
+	c.Check(a.InodeNumber, Not(Equals), b.InodeNumber)
+	other, _ := fs.Stat("/other.txt")
+	hardlink, _ := fs.Stat("/hardlink.txt")
+	c.Check(other.InodeNumber, Equals, hardlink.InodeNumber)
+}
+
+func (*rofsSuite) TestWriteRofsTreeSkipsDuplicates(c *C) {
+	tmp := c.MkDir()
+	content := strings.Repeat("identical", 100)
+	paths := map[string]string{}
+	for name, data := range map[string]string{
+		"a.so":      content,
+		"b.so":      content,
+		"same-size": strings.Repeat("x", len(content)),
+		"other.txt": "other",
+	} {
+		c.Assert(ioutil.WriteFile(filepath.Join(tmp, name), []byte(data), 0644), IsNil)
+		paths[filepath.Join(tmp, name)] = "/" + name
+	}
+	tree, err := util.NewFileTreeFromPaths(paths)
+	c.Assert(err, IsNil)
+	tree.AddData("/in-memory.so", []byte(content), 0644, "")
+	rofsImagePath := filepath.Join(tmp, "rofs.img")
+
+	// This is what we're testing here.
+	err = util.WriteRofsTree(rofsImagePath, tree, false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	rofsImage, err := os.Open(rofsImagePath)
+	c.Assert(err, IsNil)
+	defer rofsImage.Close()
+
+	rofsSb, err := util.ReadRofsSuperBlock(rofsImage)
+	c.Assert(err, IsNil)
+	// Superblock, identical content and same-size (3 blocks with padding each)
+	// and other.txt (2 blocks), nothing else is ever written.
+	c.Check(rofsSb.StructureInfoFirstBlock, Equals, uint64(9))
+
+	fs, err := rofs.Open(rofsImage)
+	c.Assert(err, IsNil)
+	a, _ := fs.Stat("/a.so")
+	b, _ := fs.Stat("/b.so")
+	inMemory, _ := fs.Stat("/in-memory.so")
+	sameSize, _ := fs.Stat("/same-size")
+	c.Check(a.DataOffset, Equals, b.DataOffset)
+	c.Check(inMemory.DataOffset, Equals, a.DataOffset)
+	c.Check(sameSize.DataOffset, Not(Equals), a.DataOffset)
+}
+
+func (*rofsSuite) TestUpdateRofsImage(c *C) {
+	tmp, _ := ioutil.TempDir("", "pkg")
+	defer os.RemoveAll(tmp)
+	contentDir := filepath.Join(tmp, "content")
+	err := copyDirectory("../cmd/testdata/hashing", contentDir)
+	c.Assert(err, IsNil)
+
+	paths, err := cmd.CollectDirectoryContents(contentDir)
+	c.Assert(err, IsNil)
+
+	rofsImagePath := path.Join(tmp, "rofs.img")
+	err = util.WriteRofsImage(rofsImagePath, paths, false)
+	c.Assert(err, IsNil)
+	initial, err := os.Stat(rofsImagePath)
+	c.Assert(err, IsNil)
+
+	// Change one file and mark all the others as unchanged.
+	err = ioutil.WriteFile(filepath.Join(contentDir, "dir1", "file2"), []byte("modified content"), 0644)
+	c.Assert(err, IsNil)
+	unchanged := map[string]bool{}
+	for _, dest := range paths {
+		if dest != "/dir1/file2" {
+			unchanged[dest] = true
+		}
+	}
+
+	// This is what we're testing here.
+	err = util.UpdateRofsImage(rofsImagePath, paths, unchanged, false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	rofsImage, err := os.Open(rofsImagePath)
+	c.Assert(err, IsNil)
+	defer rofsImage.Close()
+
+	rofsSb, err := util.ReadRofsSuperBlock(rofsImage)
+	c.Assert(err, IsNil)
+	c.Assert(rofsSb.InodesCount, Equals, uint64(11))
+	c.Assert(rofsSb.DirectoryEntriesCount, Equals, uint64(10))
+	c.Assert(rofsSb.SymlinksCount, Equals, uint64(1))
+
+	// Only the data blocks of the modified file (its content and a padding block) were appended.
+	updated, err := rofsImage.Stat()
+	c.Assert(err, IsNil)
+	c.Check(updated.Size(), Equals, initial.Size()+2*util.BLOCK_SIZE)
+	checkRofsContent(c, rofsImage, paths)
+}
+
+func (*rofsSuite) TestUpdateRofsImageRewritesChangedImage(c *C) {
+	tmp, _ := ioutil.TempDir("", "pkg")
+	defer os.RemoveAll(tmp)
+	contentDir := filepath.Join(tmp, "content")
+	err := copyDirectory("../cmd/testdata/hashing", contentDir)
+	c.Assert(err, IsNil)
+
+	paths, err := cmd.CollectDirectoryContents(contentDir)
+	c.Assert(err, IsNil)
+
+	rofsImagePath := path.Join(tmp, "rofs.img")
+	err = util.WriteRofsImage(rofsImagePath, paths, false)
+	c.Assert(err, IsNil)
+	initial, err := os.Stat(rofsImagePath)
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	err = util.UpdateRofsImage(rofsImagePath, paths, map[string]bool{}, false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	updated, err := os.Stat(rofsImagePath)
+	c.Assert(err, IsNil)
+	c.Check(updated.Size(), Equals, initial.Size())
+}
+
+func (*rofsSuite) TestUpdateRofsPartition(c *C) {
+	tmp := c.MkDir()
+	contentDir := filepath.Join(tmp, "content")
+	c.Assert(copyDirectory("../cmd/testdata/hashing", contentDir), IsNil)
+	paths, err := cmd.CollectDirectoryContents(contentDir)
+	c.Assert(err, IsNil)
+
+	// Put the ROFS partition into a raw disk image just like into a composed one.
+	rofsImagePath := filepath.Join(tmp, "rofs.img")
+	c.Assert(util.WriteRofsImage(rofsImagePath, paths, false), IsNil)
+	data, err := ioutil.ReadFile(rofsImagePath)
+	c.Assert(err, IsNil)
+	start := int64(2 * 1024 * 1024)
+	imagePath := filepath.Join(tmp, "disk.img")
+	c.Assert(ioutil.WriteFile(imagePath, append(make([]byte, start), data...), 0644), IsNil)
+	c.Assert(util.SetPartition(imagePath, 2, uint64(start), uint64(len(data))), IsNil)
+
+	// Change one file and mark all the others as unchanged.
+	c.Assert(ioutil.WriteFile(filepath.Join(contentDir, "dir1", "file2"), []byte("modified content"), 0644), IsNil)
+	unchanged := map[string]bool{}
+	for _, dest := range paths {
+		if dest != "/dir1/file2" {
+			unchanged[dest] = true
+		}
+	}
+	tree, err := util.NewFileTreeFromPaths(paths)
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	updated, err := util.UpdateRofsPartition(imagePath, tree, unchanged, false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(updated, Equals, true)
+	disk, err := image.OpenDisk(imagePath)
+	c.Assert(err, IsNil)
+	defer disk.Close()
+	// Only the data blocks of the modified file (its content and a padding block) were added.
+	size := int64(len(data)) + 2*util.BLOCK_SIZE
+	c.Check(disk.Size(), Equals, start+size)
+	number, partition, err := image.RofsPartition(disk)
+	c.Assert(err, IsNil)
+	c.Check(number, Equals, 2)
+	c.Check(partition.Start(), Equals, start)
+	c.Check(partition.Size(), Equals, size/mbr.SECTOR_SIZE*mbr.SECTOR_SIZE)
+	checkRofsContent(c, io.NewSectionReader(disk, start, size), paths)
+}
+
+func (*rofsSuite) TestUpdateRofsPartitionWithoutRofs(c *C) {
+	imagePath := filepath.Join(c.MkDir(), "disk.img")
+	c.Assert(ioutil.WriteFile(imagePath, make([]byte, 1024*1024), 0644), IsNil)
+
+	// This is what we're testing here.
+	updated, err := util.UpdateRofsPartition(imagePath, util.NewFileTree(), map[string]bool{}, false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(updated, Equals, false)
+	info, err := os.Stat(imagePath)
+	c.Assert(err, IsNil)
+	c.Check(info.Size(), Equals, int64(1024*1024))
+}
+
+// checkRofsContent reads the ROFS image back and compares it to the host files.
+func checkRofsContent(c *C, rofsImage io.ReaderAt, paths map[string]string) {
+	fs, err := rofs.Open(rofsImage)
+	c.Assert(err, IsNil)
+
+	visited := 0
+	err = fs.Walk("/", func(dest string, inode *rofs.Inode) error {
+		visited++
+		return nil
+	})
+	c.Assert(err, IsNil)
+	// All collected files plus the root directory.
+	c.Check(visited, Equals, len(paths)+1)
+
+	for src, dest := range paths {
+		fi, err := os.Lstat(src)
+		c.Assert(err, IsNil)
+		inode, err := fs.Lstat(dest)
+		c.Assert(err, IsNil, Commentf("missing %s", dest))
+
+		switch {
+		case fi.Mode()&os.ModeSymlink == os.ModeSymlink:
+			c.Assert(inode.IsSymlink(), Equals, true, Commentf("%s is not a symlink", dest))
+			expected, _ := os.Readlink(src)
+			target, err := fs.Readlink(inode)
+			c.Assert(err, IsNil)
+			c.Check(target, Equals, expected)
+		case fi.IsDir():
+			c.Check(inode.IsDir(), Equals, true, Commentf("%s is not a directory", dest))
+		default:
+			c.Assert(inode.IsRegular(), Equals, true, Commentf("%s is not a regular file", dest))
+			expected, err := ioutil.ReadFile(src)
+			c.Assert(err, IsNil)
+			reader, err := fs.Open(inode)
+			c.Assert(err, IsNil)
+			content, err := ioutil.ReadAll(reader)
+			c.Assert(err, IsNil)
+			c.Check(string(content), Equals, string(expected), Commentf("content of %s", dest))
+		}
+	}
 }
 
 func copyDirectory(srcDir string, dest string) error {
@@ -112,6 +112,18 @@ func SearchInstance(name string) (instanceName, instancePlatform string) {
 	return
 }
 
+// FreeTCPPort returns a TCP port on the loopback interface that is currently
+// not in use, e.g. to forward it into a VM.
+func FreeTCPPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
 func ConnectAndWait(network, path string) (net.Conn, error) {
 	var conn net.Conn
 	var err error
@@ -11,8 +11,33 @@ package util
 
 import (
 	"net"
+	"os"
+	"path/filepath"
+	"syscall"
 )
 
 func Connect(network, path string) (net.Conn, error) {
 	return net.Dial(network, path)
 }
+
+// nbdEndpoint returns qemu-nbd arguments making it listen on a unix socket in
+// the given private directory, along with the address to connect to.
+func nbdEndpoint(dir string) ([]string, string, string, error) {
+	socket := filepath.Join(dir, "nbd.sock")
+	return []string{"-k", socket}, "unix", socket, nil
+}
+
+type fileIdentity struct {
+	dev uint64
+	ino uint64
+}
+
+// HardLinkIdentity returns a value identifying the file on the host and the
+// number of its hard links. The identity is nil if it cannot be determined.
+func HardLinkIdentity(info os.FileInfo) (interface{}, uint64) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, 1
+	}
+	return fileIdentity{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, uint64(stat.Nlink)
+}
@@ -8,6 +8,8 @@
 package util
 
 import (
+	"fmt"
+	"net"
 	"os"
 
 	. "gopkg.in/check.v1"
@@ -162,6 +164,32 @@ func (*utilSuite) TestVersionStringToIntInvalid(c *C) {
 // Utility
 //
 
+func (*utilSuite) TestFreeTCPPort(c *C) {
+	// This is what we're testing here.
+	port, err := FreeTCPPort()
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(port > 0, Equals, true)
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	c.Assert(err, IsNil)
+	l.Close()
+}
+
+func (*utilSuite) TestNbdEndpointIsPrivate(c *C) {
+	first, second := c.MkDir(), c.MkDir()
+
+	// This is what we're testing here.
+	firstArgs, _, firstAddress, err := nbdEndpoint(first)
+	c.Assert(err, IsNil)
+	secondArgs, _, secondAddress, err := nbdEndpoint(second)
+	c.Assert(err, IsNil)
+
+	// Expectations.
+	c.Check(firstAddress, Not(Equals), secondAddress)
+	c.Check(firstArgs, Not(DeepEquals), secondArgs)
+}
+
 func setEnvironmentVars(env map[string]string) map[string]string {
 	original := map[string]string{}
 	for key, value := range env {
@@ -10,14 +10,36 @@
 package util
 
 import (
+	"fmt"
 	"gopkg.in/natefinch/npipe.v2"
 	"net"
+	"os"
+	"strconv"
 )
 
 func Connect(network, path string) (net.Conn, error) {
+	if network == "tcp" {
+		return net.Dial(network, path)
+	}
 	return npipe.Dial(path)
 }
 
+// nbdEndpoint returns qemu-nbd arguments making it listen on a free TCP port,
+// along with the address to connect to. Unix sockets are not available.
+func nbdEndpoint(dir string) ([]string, string, string, error) {
+	port, err := FreeTCPPort()
+	if err != nil {
+		return nil, "", "", err
+	}
+	return []string{"-b", "127.0.0.1", "-p", strconv.Itoa(port)}, "tcp", fmt.Sprintf("127.0.0.1:%d", port), nil
+}
+
 func IsDirectIOSupported(path string) bool {
 	return false
 }
+
+// HardLinkIdentity returns a value identifying the file on the host and the
+// number of its hard links. Hard links are not detected on Windows.
+func HardLinkIdentity(info os.FileInfo) (interface{}, uint64) {
+	return nil, 1
+}